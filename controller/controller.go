@@ -4,21 +4,43 @@ import (
 	"encoding/csv"
 	"errors"
 	"fmt"
+	"github.com/shimanekb/project2-B/index"
 	store "github.com/shimanekb/project2-B/store"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 )
 
 const (
-	GET_COMMAND       string = "get"
-	PUT_COMMAND       string = "put"
-	DEL_COMMAND       string = "del"
-	SCAN_COMMAND      string = "scan"
-	FIRST_LINE_RECORD string = "type"
-	STORAGE_DIR       string = "storage"
-	STORAGE_FILE      string = "data_records.txt"
+	GET_COMMAND        string = "get"
+	MGET_COMMAND       string = "mget"
+	PUT_COMMAND        string = "put"
+	PUT_TTL_COMMAND    string = "putttl"
+	DEL_COMMAND        string = "del"
+	MERGE_COMMAND      string = "merge"
+	CAS_COMMAND        string = "cas"
+	PUT_ABSENT_COMMAND string = "putifabsent"
+	DEL_EQUALS_COMMAND string = "delifeq"
+	DELRANGE_COMMAND   string = "delrange"
+	SCAN_COMMAND       string = "scan"
+	RSCAN_COMMAND      string = "rscan"
+	FLUSH_COMMAND      string = "flush"
+	REOPEN_COMMAND     string = "reopen"
+	FAMILY_COMMAND     string = "family"
+	FIRST_LINE_RECORD  string = "type"
+	STORAGE_FILE       string = "data_records.txt"
+)
+
+// Outcomes written for the conditional commands cas, putifabsent and
+// delifeq.
+const (
+	OUTCOME_FAILED    int = 0
+	OUTCOME_APPLIED   int = 1
+	OUTCOME_MISMATCH  int = 2
+	OUTCOME_NOT_FOUND int = 3
 )
 
 type Command struct {
@@ -26,9 +48,11 @@ type Command struct {
 	Key    string
 	KeyTwo string
 	Value  string
+	// Keys are the keys of an mget, every field after its type.
+	Keys []string
 }
 
-func ReadCsvCommands(filePath string, outputPath string, storeFile string) {
+func ReadCsvCommands(filePath string, outputPath string, storeFile string, opts index.Options) {
 	csv_file, err := os.Open(filePath)
 
 	log.Infof("Opening csv file %s", filePath)
@@ -44,19 +68,26 @@ func ReadCsvCommands(filePath string, outputPath string, storeFile string) {
 	}
 
 	reader := csv.NewReader(csv_file)
-	path := filepath.Join(".", STORAGE_DIR)
+	// mget lines hold any number of keys
+	reader.FieldsPerRecord = -1
+	path := filepath.Clean(opts.StorageDir)
 	err = os.MkdirAll(path, os.ModePerm)
 
 	if err != nil {
-		log.Fatalf("Cannot create directory for storage at %s", STORAGE_DIR)
+		log.Fatalf("Cannot create directory for storage at %s", opts.StorageDir)
 	}
 
 	storePath := filepath.Join(path, storeFile)
-	localStore, storeErr := store.NewSsStore(storePath)
+	db, storeErr := store.OpenDB(storePath, opts, nil)
 	if storeErr != nil {
 		log.Fatal("Could not create store.", storeErr)
 	}
 
+	localStore, storeErr := db.Family(store.DEFAULT_FAMILY)
+	if storeErr != nil {
+		log.Fatal("Could not open default column family.", storeErr)
+	}
+
 	log.Infoln("Reading in csv records.")
 	for {
 		record, err := reader.Read()
@@ -72,14 +103,67 @@ func ReadCsvCommands(filePath string, outputPath string, storeFile string) {
 			log.Infoln("First line detected, skipping.")
 			continue
 		}
-		command := Command{record[0], record[1], record[2], record[3]}
+		if len(record) < 4 {
+			log.Fatalf("Record %q has %d fields, want at least 4.", record, len(record))
+		}
+
+		command := Command{Type: record[0], Key: record[1], KeyTwo: record[2], Value: record[3]}
+		if command.Type == MGET_COMMAND {
+			for _, key := range record[1:] {
+				if key != "" {
+					command.Keys = append(command.Keys, key)
+				}
+			}
+		}
+
+		if command.Type == REOPEN_COMMAND {
+			log.Infof("Reopen command given for store %s", storePath)
+			if err = db.Close(); err != nil {
+				log.Fatal("Could not close store before reopening.", err)
+			}
+
+			db, storeErr = store.OpenDB(storePath, opts, nil)
+			if storeErr == nil {
+				localStore, storeErr = db.Family(localStore.Name())
+			}
+
+			if storeErr != nil {
+				log.Fatal("Could not reopen store.", storeErr)
+			}
+
+			WriteOutput(command, 1, "", outputPath)
+			continue
+		}
+
+		if command.Type == FAMILY_COMMAND {
+			log.Infof("Family command given for column family %s", command.Key)
+			family, err := db.Family(command.Key)
+			if errors.Is(err, store.ErrUnknownFamily) {
+				family, err = db.CreateFamily(command.Key, opts)
+			}
+
+			if err != nil {
+				log.Errorln(err)
+				WriteOutput(command, 0, "", outputPath)
+				continue
+			}
+
+			localStore = family
+			WriteOutput(command, 1, "", outputPath)
+			continue
+		}
+
 		cmd_err := ProcessCommand(command, localStore, outputPath)
 		if cmd_err != nil {
 			log.Errorln(cmd_err)
 		}
 	}
 
-	localStore.Flush()
+	if err = db.Close(); err != nil {
+		log.Fatal("Could not close store.", err)
+	}
+
+	log.Infof("Store stats: %+v", localStore.Stats())
 }
 
 func WriteOutputFirstLine(outputPath string) error {
@@ -117,6 +201,17 @@ func WriteOutputs(command Command, outcome int, value []string, outputPath strin
 	return write_err
 
 }
+
+// formatPairs writes each scanned pair as key=value.
+func formatPairs(pairs []store.KeyValue) []string {
+	values := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		values = append(values, fmt.Sprintf("%s=%s", pair.Key, pair.Value))
+	}
+
+	return values
+}
+
 func WriteOutput(command Command, outcome int, value string, outputPath string) error {
 	file, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 
@@ -131,26 +226,61 @@ func WriteOutput(command Command, outcome int, value string, outputPath string)
 
 }
 
+// writeConditional writes the outcome of a conditional command that was
+// applied or not, or failed with err.
+func writeConditional(command Command, applied bool, err error, outputPath string) error {
+	switch {
+	case errors.Is(err, store.ErrNotFound):
+		WriteOutput(command, OUTCOME_NOT_FOUND, "", outputPath)
+		return nil
+	case err != nil:
+		WriteOutput(command, OUTCOME_FAILED, "", outputPath)
+		return err
+	case applied:
+		WriteOutput(command, OUTCOME_APPLIED, "", outputPath)
+	default:
+		WriteOutput(command, OUTCOME_MISMATCH, "", outputPath)
+	}
+
+	return nil
+}
+
 func ProcessCommand(command Command, storage store.Store, outputPath string) error {
 	switch {
-	case SCAN_COMMAND == command.Type:
+	case SCAN_COMMAND == command.Type, RSCAN_COMMAND == command.Type:
 		log.Infof("Scan command given for key: %s, key2: %s", command.Key,
 			command.KeyTwo)
-		values, ok := storage.Scan(command.Key, command.KeyTwo)
-		if ok {
-			WriteOutputs(command, len(values), values, outputPath)
+		opts := store.ScanOptions{Reverse: command.Type == RSCAN_COMMAND}
+		if command.Value != "" {
+			limit, err := strconv.Atoi(command.Value)
+			if err != nil || limit < 0 {
+				WriteOutput(command, 0, "", outputPath)
+				return errors.New(fmt.Sprintf("Invalid scan limit given: %s", command.Value))
+			}
 
-			log.Infof("Scan command successful given for key: %s, key2: %s. Found %d items.", command.Key,
-				command.KeyTwo, len(values))
-		} else {
+			opts.Limit = limit
+		}
+
+		pairs, _, err := storage.Scan(command.Key, command.KeyTwo, opts)
+		if err != nil {
 			WriteOutput(command, 0, "", outputPath)
+			return err
 		}
 
+		WriteOutputs(command, len(pairs), formatPairs(pairs), outputPath)
+		log.Infof("Scan command successful given for key: %s, key2: %s. Found %d items.", command.Key,
+			command.KeyTwo, len(pairs))
+
 		return nil
 	case GET_COMMAND == command.Type:
 		log.Infof("Get command given for key: %s, value: %s", command.Key,
 			command.Value)
-		value, ok := storage.Get(command.Key)
+		value, ok, err := storage.Get(command.Key)
+		if err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
 		if ok {
 			WriteOutput(command, 1, value, outputPath)
 			log.Infof("Get command successful found value: %s, for key: %s",
@@ -159,6 +289,24 @@ func ProcessCommand(command Command, storage store.Store, outputPath string) err
 			WriteOutput(command, 0, "", outputPath)
 		}
 
+		return nil
+	case MGET_COMMAND == command.Type:
+		log.Infof("Mget command given for %d keys", len(command.Keys))
+		results, err := storage.MultiGet(command.Keys)
+		if err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
+		pairs := make([]store.KeyValue, 0, len(results))
+		for i, result := range results {
+			if result.Found {
+				pairs = append(pairs, store.KeyValue{Key: command.Keys[i], Value: result.Value})
+			}
+		}
+
+		WriteOutputs(command, len(pairs), formatPairs(pairs), outputPath)
+		log.Infof("Mget command successful, found %d of %d keys.", len(pairs), len(command.Keys))
 		return nil
 	case PUT_COMMAND == command.Type:
 		log.Infof("Put command given for key: %s, value: %s", command.Key,
@@ -166,12 +314,74 @@ func ProcessCommand(command Command, storage store.Store, outputPath string) err
 
 		WriteOutput(command, 0, "", outputPath)
 		return storage.Put(command.Key, command.Value)
+	case MERGE_COMMAND == command.Type:
+		log.Infof("Merge command given for key: %s, operand: %s", command.Key,
+			command.Value)
+		if err := storage.Merge(command.Key, command.Value); err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
+		WriteOutput(command, 1, "", outputPath)
+		return nil
+	case CAS_COMMAND == command.Type:
+		log.Infof("Compare and swap command given for key: %s, expected: %s, value: %s", command.Key,
+			command.KeyTwo, command.Value)
+		swapped, err := storage.CompareAndSwap(command.Key, command.KeyTwo, command.Value)
+		return writeConditional(command, swapped, err, outputPath)
+	case PUT_ABSENT_COMMAND == command.Type:
+		log.Infof("Put if absent command given for key: %s, value: %s", command.Key,
+			command.Value)
+		put, err := storage.PutIfAbsent(command.Key, command.Value)
+		return writeConditional(command, put, err, outputPath)
+	case DEL_EQUALS_COMMAND == command.Type:
+		log.Infof("Delete if equals command given for key: %s, expected: %s", command.Key,
+			command.Value)
+		deleted, err := storage.DeleteIfEquals(command.Key, command.Value)
+		return writeConditional(command, deleted, err, outputPath)
+	case PUT_TTL_COMMAND == command.Type:
+		log.Infof("Put with ttl command given for key: %s, ttl: %s, value: %s", command.Key,
+			command.KeyTwo, command.Value)
+		ttl, err := time.ParseDuration(command.KeyTwo)
+		if err == nil {
+			err = storage.PutWithTTL(command.Key, command.Value, ttl)
+		}
+
+		if err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
+		WriteOutput(command, 1, "", outputPath)
+		return nil
+	case FLUSH_COMMAND == command.Type:
+		log.Info("Flush command given.")
+		if err := storage.Flush(); err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
+		WriteOutput(command, 1, "", outputPath)
+		return nil
 	case DEL_COMMAND == command.Type:
 		log.Infof("Del command given for key: %s, value: %s", command.Key,
 			command.Value)
-		storage.Del(command.Key)
+		if err := storage.Del(command.Key); err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
+
 		WriteOutput(command, 1, "", outputPath)
+		return nil
+	case DELRANGE_COMMAND == command.Type:
+		log.Infof("Delete range command given for key: %s, key2: %s", command.Key,
+			command.KeyTwo)
+		if err := storage.DeleteRange(command.Key, command.KeyTwo); err != nil {
+			WriteOutput(command, 0, "", outputPath)
+			return err
+		}
 
+		WriteOutput(command, 1, "", outputPath)
 		return nil
 	}
 
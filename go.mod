@@ -1,9 +1,11 @@
 module github.com/shimanekb/project2-B
 
-go 1.15
+go 1.18
 
 require (
 	github.com/elliotchance/orderedmap v1.4.0
 	github.com/hashicorp/golang-lru v0.5.4
 	github.com/sirupsen/logrus v1.7.0
 )
+
+require golang.org/x/sys v0.0.0-20191026070338-33540a1f6037 // indirect
@@ -0,0 +1,106 @@
+package index
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+)
+
+const (
+	BLOOM_RECORD     string = "bloom"
+	MIN_BLOOM_BITS   int    = 64
+	MAX_BLOOM_HASHES int    = 30
+)
+
+// BloomFilter answers whether an sstable may hold a key so lookups for
+// absent keys can skip reading a block.
+type BloomFilter struct {
+	bits   []byte
+	hashes int
+}
+
+func bloomHashes(key string) (h1 uint32, h2 uint32) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return uint32(sum), uint32(sum >> 32)
+}
+
+func NewBloomFilter(keys []string, bitsPerKey int) *BloomFilter {
+	nbits := len(keys) * bitsPerKey
+	if nbits < MIN_BLOOM_BITS {
+		nbits = MIN_BLOOM_BITS
+	}
+
+	// ln(2) * bits per key gives the lowest false positive rate
+	hashes := int(float64(bitsPerKey) * 0.69)
+	if hashes < 1 {
+		hashes = 1
+	}
+
+	if hashes > MAX_BLOOM_HASHES {
+		hashes = MAX_BLOOM_HASHES
+	}
+
+	filter := &BloomFilter{make([]byte, (nbits+7)/8), hashes}
+	for _, key := range keys {
+		filter.add(key)
+	}
+
+	return filter
+}
+
+func (f *BloomFilter) add(key string) {
+	nbits := uint32(len(f.bits) * 8)
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % nbits
+		f.bits[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+func (f *BloomFilter) MayContain(key string) bool {
+	nbits := uint32(len(f.bits) * 8)
+	if nbits == 0 {
+		return true
+	}
+
+	h1, h2 := bloomHashes(key)
+	for i := 0; i < f.hashes; i++ {
+		bit := (h1 + uint32(i)*h2) % nbits
+		if f.bits[bit/8]&(1<<(bit%8)) == 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f *BloomFilter) record() []string {
+	return []string{BLOOM_RECORD, strconv.Itoa(f.hashes),
+		base64.StdEncoding.EncodeToString(f.bits)}
+}
+
+func parseBloomFilter(record []string) (*BloomFilter, error) {
+	if len(record) != 3 || record[0] != BLOOM_RECORD {
+		return nil, errors.New(fmt.Sprintf("Malformed bloom filter record of %d fields", len(record)))
+	}
+
+	hashes, err := strconv.Atoi(record[1])
+	if err != nil {
+		return nil, err
+	}
+
+	if hashes < 1 || hashes > MAX_BLOOM_HASHES {
+		return nil, errors.New(fmt.Sprintf("Bloom filter has %d hashes", hashes))
+	}
+
+	bits, err := base64.StdEncoding.DecodeString(record[2])
+	if err != nil {
+		return nil, err
+	}
+
+	return &BloomFilter{bits, hashes}, nil
+}
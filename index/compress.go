@@ -0,0 +1,62 @@
+package index
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+const COMPRESSED_BLOCK_RECORD string = "z"
+
+// compressBlock packs a block record into a two field record holding the
+// flate compressed csv line, base64 encoded so the file stays line based.
+func compressBlock(record []string) ([]string, error) {
+	var line bytes.Buffer
+	w := csv.NewWriter(&line)
+	w.Write(record)
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, err
+	}
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = fw.Write(line.Bytes()); err != nil {
+		return nil, err
+	}
+
+	if err = fw.Close(); err != nil {
+		return nil, err
+	}
+
+	return []string{COMPRESSED_BLOCK_RECORD,
+		base64.StdEncoding.EncodeToString(compressed.Bytes())}, nil
+}
+
+func decompressBlock(record []string) ([]string, error) {
+	if len(record) != 2 || record[0] != COMPRESSED_BLOCK_RECORD {
+		return nil, errors.New(fmt.Sprintf("Malformed compressed block of %d fields", len(record)))
+	}
+
+	compressed, err := base64.StdEncoding.DecodeString(record[1])
+	if err != nil {
+		return nil, err
+	}
+
+	fr := flate.NewReader(bytes.NewReader(compressed))
+	defer fr.Close()
+	line, err := ioutil.ReadAll(fr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newRecordReader(bytes.NewReader(line)).Read()
+}
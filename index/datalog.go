@@ -1,15 +1,21 @@
 package index
 
 import (
+	"bytes"
 	"encoding/csv"
-	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
 	"os"
 	"strconv"
+	"sync"
 )
 
+// appendMu keeps appends to data logs whole, as a flush and a compaction
+// may add values to the same value log at once, each through its own
+// LocalDataLog.
+var appendMu sync.Mutex
+
 type LocalDataLogReader struct {
 	filePath      string
 	currentOffset int64
@@ -18,6 +24,7 @@ type LocalDataLogReader struct {
 type DataLog interface {
 	ReadLogItem(offset int64) (logItem *LogItem, err error)
 	AddLogItem(logItem LogItem) (offset int64, err error)
+	FilePath() string
 }
 
 type LogItem struct {
@@ -49,21 +56,33 @@ func NewLogItem(key string, value string, offset int64) LogItem {
 }
 
 type LocalDataLog struct {
+	fs             FS
 	flushThreshold int
 	filePath       string
 	buffer         []LogItem
+	syncWrites     bool
 }
 
 func NewLocalDataLog(filePath string) DataLog {
+	return NewSyncedLocalDataLog(OSFS{}, filePath, false)
+}
+
+// NewSyncedLocalDataLog creates a data log on fs that fsyncs after every
+// added item when syncWrites is set.
+func NewSyncedLocalDataLog(fs FS, filePath string, syncWrites bool) DataLog {
 	buffer := make([]LogItem, 0, 10)
-	dataLog := LocalDataLog{10, filePath, buffer}
+	dataLog := LocalDataLog{fs, 10, filePath, buffer, syncWrites}
 	return &dataLog
 }
 
+func (l *LocalDataLog) FilePath() string {
+	return l.filePath
+}
+
 func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
-	storeFile, err := os.OpenFile(l.filePath, os.O_RDONLY, 0644)
+	storeFile, err := l.fs.OpenFile(l.filePath, os.O_RDONLY, 0644)
 
-	if _, err := os.Stat(l.filePath); os.IsNotExist(err) {
+	if _, err := l.fs.Stat(l.filePath); os.IsNotExist(err) {
 		return nil, io.EOF
 	}
 
@@ -86,12 +105,17 @@ func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
 		return nil, err
 	}
 
-	reader := csv.NewReader(storeFile)
+	reader := newRecordReader(storeFile)
 	record, err := reader.Read()
 
 	if err != nil {
 		log.Error(fmt.Sprintf("Unable to read csv record in data log file at %s", l.filePath), err)
-		return nil, err
+		return nil, readError(l.filePath, err)
+	}
+
+	if len(record) != 3 {
+		return nil, corruptionError(l.filePath, "malformed data log record of %d fields at offset %d",
+			len(record), offset)
 	}
 
 	key := record[0]
@@ -100,7 +124,12 @@ func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
 	size, parseError := strconv.ParseInt(s, 10, 64)
 
 	if parseError != nil {
-		return nil, errors.New(fmt.Sprintf("Could not convert size to int for offset %d", offset))
+		return nil, corruptionError(l.filePath, "could not convert size to int for offset %d", offset)
+	}
+
+	if size != int64(len([]byte(value))) {
+		return nil, corruptionError(l.filePath, "data log record at offset %d holds %d bytes, not %d",
+			offset, len([]byte(value)), size)
 	}
 
 	li := NewLogItem(key, value, offset)
@@ -110,21 +139,37 @@ func (l *LocalDataLog) ReadLogItem(offset int64) (logItem *LogItem, err error) {
 
 func (l *LocalDataLog) AddLogItem(logItem LogItem) (offset int64, err error) {
 	log.Infof("Adding log item to %s.", l.filePath)
-	file, err := os.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	appendMu.Lock()
+	defer appendMu.Unlock()
+
+	file, err := l.fs.OpenFile(l.filePath, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
-		log.Errorf("Could not open data log file %s", l.filePath, err)
+		log.Errorf("Could not open data log file %s. %v", l.filePath, err)
 		return 0, err
 	}
 
 	defer file.Close()
 
-	length, write_err := file.WriteString(fmt.Sprintf("%s,%s,%d\n", logItem.Key(), logItem.Value(), logItem.Size()))
+	// values may hold any bytes so the record is csv quoted where needed
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write([]string{logItem.Key(), logItem.Value(), fmt.Sprintf("%d", logItem.Size())})
+	writer.Flush()
+
+	length, write_err := file.Write(buf.Bytes())
 
 	if write_err != nil {
-		log.Errorf("Could not write log item to data log file %s", l.filePath, err)
+		log.Errorf("Could not write log item to data log file %s. %v", l.filePath, write_err)
 		return 0, write_err
 	}
 
+	if l.syncWrites {
+		if syncErr := file.Sync(); syncErr != nil {
+			log.Errorf("Could not sync data log file %s. %v", l.filePath, syncErr)
+			return 0, syncErr
+		}
+	}
+
 	fi, statErr := file.Stat()
 	if statErr != nil {
 		log.Error("Could not get current file size to calculate new offset.", err)
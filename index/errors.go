@@ -0,0 +1,46 @@
+package index
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrCorruption matches, with errors.Is, every error for a file that holds
+// something other than what was written to it.
+var ErrCorruption = errors.New("corruption")
+
+// CorruptionError describes damage found in the file at Path.
+type CorruptionError struct {
+	Path string
+	Err  error
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("Corrupt %s: %v", e.Path, e.Err)
+}
+
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorruption
+}
+
+func (e *CorruptionError) Unwrap() error {
+	return e.Err
+}
+
+func corruptionError(path string, format string, args ...interface{}) error {
+	return &CorruptionError{path, errors.New(fmt.Sprintf(format, args...))}
+}
+
+// readError classifies an error from reading a csv record of the file at
+// path. Records that do not parse, or are missing where one was expected,
+// are corruption while anything else is an I/O error returned as is.
+func readError(path string, err error) error {
+	var parseErr *csv.ParseError
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.As(err, &parseErr) {
+		return &CorruptionError{path, err}
+	}
+
+	return err
+}
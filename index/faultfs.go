@@ -0,0 +1,417 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrCrashed is returned by every operation on a FaultFS once it has
+	// crashed.
+	ErrCrashed = errors.New("filesystem crashed")
+	// ErrInjected is the default error of an injected fault.
+	ErrInjected = errors.New("injected fault")
+	// ErrNoSpace is the error of a full disk.
+	ErrNoSpace = &os.PathError{Op: "write", Path: "", Err: syscall.ENOSPC}
+)
+
+// FaultOp is a filesystem operation a fault can be injected into.
+type FaultOp int
+
+const (
+	FaultCreate FaultOp = iota
+	FaultWrite
+	FaultSync
+	FaultRename
+	FaultRemove
+	FaultSyncDir
+)
+
+var faultOpNames = []string{"create", "write", "sync", "rename", "remove", "sync dir"}
+
+func (o FaultOp) String() string {
+	if int(o) < len(faultOpNames) {
+		return faultOpNames[o]
+	}
+
+	return fmt.Sprintf("FaultOp(%d)", int(o))
+}
+
+// Fault makes matching operations of a FaultFS fail.
+type Fault struct {
+	Op FaultOp
+	// Name, when set, limits the fault to paths containing it.
+	Name string
+	// Err is returned by the failing operation, ErrInjected when nil.
+	Err error
+	// Torn makes a failing write apply the first half of its data.
+	Torn bool
+	// Sticky keeps the fault in place after it first fires.
+	Sticky bool
+}
+
+type faultInode struct {
+	// durable is the content as of the last sync, nil if never synced.
+	durable []byte
+}
+
+// FaultFS is an in-memory FS that tracks what would survive a power loss.
+// File contents are durable once the file is synced and names once their
+// directory is synced, directories themselves as soon as they are made.
+// Crash drops everything else. Faults can be injected into single
+// operations, and the filesystem can be made to crash after a given number
+// of operations.
+type FaultFS struct {
+	mu    sync.Mutex
+	inner *MemFS
+	// inodes maps each live file to its inode.
+	inodes map[string]*faultInode
+	// durableDirs holds the names of each directory as of its last sync.
+	durableDirs map[string]map[string]*faultInode
+	dirs        map[string]bool
+	faults      []Fault
+	ops         int
+	crashAfter  int
+	crashed     bool
+}
+
+func NewFaultFS() *FaultFS {
+	return &FaultFS{
+		inner:       NewMemFS(),
+		inodes:      make(map[string]*faultInode),
+		durableDirs: make(map[string]map[string]*faultInode),
+		dirs:        make(map[string]bool),
+		crashAfter:  -1,
+	}
+}
+
+// Inject adds a fault for the next matching operation.
+func (f *FaultFS) Inject(fault Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fault.Err == nil {
+		fault.Err = ErrInjected
+	}
+
+	f.faults = append(f.faults, fault)
+}
+
+func (f *FaultFS) ClearFaults() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.faults = nil
+}
+
+// CrashAfter makes the filesystem crash once ops more operations that
+// change it have run, so those operations and every later one fail.
+func (f *FaultFS) CrashAfter(ops int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crashAfter = f.ops + ops
+}
+
+// Ops is the number of operations that changed the filesystem so far.
+func (f *FaultFS) Ops() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.ops
+}
+
+func (f *FaultFS) Crashed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.crashed
+}
+
+// Crash simulates a power loss. Every later operation on f fails, and the
+// returned filesystem holds only what had been made durable.
+func (f *FaultFS) Crash() *FaultFS {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.crashed = true
+	after := NewFaultFS()
+	for dir := range f.dirs {
+		after.inner.MkdirAll(dir, os.ModePerm)
+		after.dirs[dir] = true
+	}
+
+	for dir, entries := range f.durableDirs {
+		after.durableDirs[dir] = make(map[string]*faultInode)
+		for name, inode := range entries {
+			path := filepath.Join(dir, name)
+			data := append([]byte{}, inode.durable...)
+			file, err := after.inner.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+			if err != nil {
+				continue
+			}
+
+			file.Write(data)
+			file.Close()
+			recovered := &faultInode{data}
+			after.inodes[path] = recovered
+			after.durableDirs[dir][name] = recovered
+		}
+	}
+
+	return after
+}
+
+// begin is called with mu held before each operation, counting those that
+// change the filesystem, and returns the fault the operation hits if any.
+func (f *FaultFS) begin(op FaultOp, name string, mutates bool) (*Fault, error) {
+	if f.crashed {
+		return nil, ErrCrashed
+	}
+
+	if !mutates {
+		return nil, nil
+	}
+
+	if f.crashAfter >= 0 && f.ops >= f.crashAfter {
+		f.crashed = true
+		return nil, ErrCrashed
+	}
+
+	f.ops += 1
+	for i, fault := range f.faults {
+		if fault.Op != op || !strings.Contains(name, fault.Name) {
+			continue
+		}
+
+		if !fault.Sticky {
+			f.faults = append(f.faults[:i], f.faults[i+1:]...)
+		}
+
+		return &fault, fault.Err
+	}
+
+	return nil, nil
+}
+
+func (f *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = filepath.Clean(name)
+	_, exists := f.inodes[name]
+	creates := flag&os.O_CREATE != 0 && !exists
+	mutates := creates || flag&os.O_TRUNC != 0
+	if _, err := f.begin(FaultCreate, name, mutates); err != nil {
+		return nil, err
+	}
+
+	file, err := f.inner.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	if creates {
+		f.inodes[name] = &faultInode{}
+	}
+
+	return &faultFile{fs: f, File: file, name: name, inode: f.inodes[name]}, nil
+}
+
+func (f *FaultFS) Stat(name string) (os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(FaultCreate, name, false); err != nil {
+		return nil, err
+	}
+
+	return f.inner.Stat(name)
+}
+
+func (f *FaultFS) Rename(oldpath string, newpath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	oldpath = filepath.Clean(oldpath)
+	newpath = filepath.Clean(newpath)
+	if _, err := f.begin(FaultRename, oldpath+" "+newpath, true); err != nil {
+		return err
+	}
+
+	if err := f.inner.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+
+	f.inodes[newpath] = f.inodes[oldpath]
+	delete(f.inodes, oldpath)
+	return nil
+}
+
+func (f *FaultFS) Remove(name string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, err := f.begin(FaultRemove, name, true); err != nil {
+		return err
+	}
+
+	if err := f.inner.Remove(name); err != nil {
+		return err
+	}
+
+	if _, ok := f.inodes[name]; ok {
+		delete(f.inodes, name)
+	} else {
+		delete(f.dirs, name)
+	}
+
+	return nil
+}
+
+func (f *FaultFS) MkdirAll(path string, perm os.FileMode) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path = filepath.Clean(path)
+	if _, err := f.begin(FaultCreate, path, !f.dirs[path]); err != nil {
+		return err
+	}
+
+	if err := f.inner.MkdirAll(path, perm); err != nil {
+		return err
+	}
+
+	for p := path; p != filepath.Dir(p); p = filepath.Dir(p) {
+		f.dirs[p] = true
+	}
+
+	return nil
+}
+
+func (f *FaultFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, err := f.begin(FaultCreate, dirname, false); err != nil {
+		return nil, err
+	}
+
+	return f.inner.ReadDir(dirname)
+}
+
+func (f *FaultFS) SyncDir(dir string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	dir = filepath.Clean(dir)
+	if _, err := f.begin(FaultSyncDir, dir, true); err != nil {
+		return err
+	}
+
+	if err := f.inner.SyncDir(dir); err != nil {
+		return err
+	}
+
+	entries := make(map[string]*faultInode)
+	for path, inode := range f.inodes {
+		if filepath.Dir(path) == dir {
+			entries[filepath.Base(path)] = inode
+		}
+	}
+
+	f.durableDirs[dir] = entries
+	return nil
+}
+
+// Lock creates name like OpenFile would. Locks are not durable, so the
+// filesystem Crash returns starts with none held.
+func (f *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := f.createLockFile(name); err != nil {
+		return nil, err
+	}
+
+	return f.inner.Lock(name)
+}
+
+func (f *FaultFS) RLock(name string) (io.Closer, error) {
+	if err := f.createLockFile(name); err != nil {
+		return nil, err
+	}
+
+	return f.inner.RLock(name)
+}
+
+func (f *FaultFS) createLockFile(name string) error {
+	file, err := f.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// faultFile is an open file of a FaultFS. Reads go straight to the
+// underlying file while writes and syncs can fail.
+type faultFile struct {
+	File
+	fs    *FaultFS
+	name  string
+	inode *faultInode
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.fs.Crashed() {
+		return 0, ErrCrashed
+	}
+
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	fault, err := f.fs.begin(FaultWrite, f.name, true)
+	if err == nil {
+		return f.File.Write(p)
+	}
+
+	if fault != nil && fault.Torn {
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, err
+	}
+
+	return 0, err
+}
+
+func (f *faultFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if _, err := f.fs.begin(FaultSync, f.name, true); err != nil {
+		return err
+	}
+
+	for path, inode := range f.fs.inodes {
+		if inode != f.inode {
+			continue
+		}
+
+		data, err := readFile(f.fs.inner, path)
+		if err != nil {
+			return err
+		}
+
+		inode.durable = data
+	}
+
+	return nil
+}
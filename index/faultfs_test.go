@@ -0,0 +1,138 @@
+package index
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func writeFaultFile(t *testing.T, fs FS, name string, data string, sync bool) {
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if _, err = io.WriteString(f, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if sync {
+		if err = f.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func checkFaultFile(t *testing.T, fs FS, name string, want string, exists bool) {
+	data, err := readFile(fs, name)
+	if !exists {
+		if !os.IsNotExist(err) {
+			t.Fatalf("%s survived the crash holding %q", name, data)
+		}
+
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("%s was lost: %v", name, err)
+	}
+
+	if string(data) != want {
+		t.Fatalf("%s holds %q after the crash, want %q", name, data, want)
+	}
+}
+
+func TestFaultFSCrashKeepsOnlySyncedState(t *testing.T) {
+	fs := NewFaultFS()
+	if err := fs.MkdirAll("/db", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFaultFile(t, fs, "/db/synced", "kept", true)
+	writeFaultFile(t, fs, "/db/unsynced", "lost", false)
+	writeFaultFile(t, fs, "/db/old", "old", true)
+	if err := fs.SyncDir("/db"); err != nil {
+		t.Fatal(err)
+	}
+
+	writeFaultFile(t, fs, "/db/undurable-name", "synced data", true)
+	writeFaultFile(t, fs, "/db/new.tmp", "new", true)
+	if err := fs.Rename("/db/new.tmp", "/db/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	after := fs.Crash()
+	if _, err := fs.Stat("/db/synced"); err != ErrCrashed {
+		t.Fatalf("crashed filesystem returned %v", err)
+	}
+
+	checkFaultFile(t, after, "/db/synced", "kept", true)
+	checkFaultFile(t, after, "/db/unsynced", "", true)
+	checkFaultFile(t, after, "/db/undurable-name", "", false)
+	checkFaultFile(t, after, "/db/old", "old", true)
+	checkFaultFile(t, after, "/db/new.tmp", "", false)
+
+	writeFaultFile(t, after, "/db/new.tmp", "new", true)
+	if err := after.Rename("/db/new.tmp", "/db/old"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := after.SyncDir("/db"); err != nil {
+		t.Fatal(err)
+	}
+
+	again := after.Crash()
+	checkFaultFile(t, again, "/db/old", "new", true)
+	checkFaultFile(t, again, "/db/new.tmp", "", false)
+}
+
+func TestFaultFSInjectedFaults(t *testing.T) {
+	fs := NewFaultFS()
+	fs.MkdirAll("/db", os.ModePerm)
+	f, err := fs.OpenFile("/db/a", os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Inject(Fault{Op: FaultWrite, Name: "/db/a", Err: ErrNoSpace, Torn: true})
+	if n, err := f.Write([]byte("abcd")); err != ErrNoSpace || n != 2 {
+		t.Fatalf("torn write returned %d, %v", n, err)
+	}
+
+	if _, err = f.Write([]byte("ef")); err != nil {
+		t.Fatalf("write after a one off fault returned %v", err)
+	}
+
+	checkFaultFile(t, fs, "/db/a", "abef", true)
+
+	fs.Inject(Fault{Op: FaultRename, Name: "/db/b", Sticky: true})
+	for i := 0; i < 2; i++ {
+		if err = fs.Rename("/db/a", "/db/b"); err != ErrInjected {
+			t.Fatalf("rename %d returned %v", i, err)
+		}
+	}
+
+	fs.ClearFaults()
+	if err = fs.Rename("/db/a", "/db/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Inject(Fault{Op: FaultSync})
+	if err = f.Sync(); err != ErrInjected {
+		t.Fatalf("sync returned %v", err)
+	}
+
+	fs.CrashAfter(1)
+	if _, err = f.Write([]byte("g")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte("h")); err != ErrCrashed {
+		t.Fatalf("write after the crash point returned %v", err)
+	}
+
+	if !fs.Crashed() {
+		t.Fatal("filesystem did not crash")
+	}
+}
@@ -0,0 +1,41 @@
+package index
+
+import (
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+)
+
+// TempFilePath names the temp file filePath is written to before it is
+// renamed into place. It sits beside filePath so the rename never crosses
+// filesystems.
+func TempFilePath(filePath string) string {
+	return filePath + TEMP_FILE_SUFFIX
+}
+
+// replaceFile renames the fully written tmpFilePath over filePath. When sync
+// is set the temp file is fsynced first and the directory after, so a crash
+// leaves either the old or the new file in place, never a partial one.
+func replaceFile(fs FS, tmpFilePath string, filePath string, sync bool) error {
+	if sync {
+		if err := syncFile(fs, tmpFilePath); err != nil {
+			log.Errorf("Unable to sync file %s. %v", tmpFilePath, err)
+			return err
+		}
+	}
+
+	if err := fs.Rename(tmpFilePath, filePath); err != nil {
+		log.Errorf("Could not move %s into place at %s. %v", tmpFilePath, filePath, err)
+		return err
+	}
+
+	if !sync {
+		return nil
+	}
+
+	if err := fs.SyncDir(filepath.Dir(filePath)); err != nil {
+		log.Errorf("Unable to sync directory of %s. %v", filePath, err)
+		return err
+	}
+
+	return nil
+}
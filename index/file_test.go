@@ -0,0 +1,60 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaceFileSurvivesCrash(t *testing.T) {
+	for _, sync := range []bool{false, true} {
+		fs := NewFaultFS()
+		if err := fs.MkdirAll("/db", os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFaultFile(t, fs, "/db/table", "old", true)
+		if err := fs.SyncDir("/db"); err != nil {
+			t.Fatal(err)
+		}
+
+		tmpPath := TempFilePath("/db/table")
+		if filepath.Dir(tmpPath) != "/db" {
+			t.Fatalf("temp file %s is not beside /db/table", tmpPath)
+		}
+
+		writeFaultFile(t, fs, tmpPath, "new", false)
+		if err := replaceFile(fs, tmpPath, "/db/table", sync); err != nil {
+			t.Fatal(err)
+		}
+
+		// unsynced, the rename and the data it moved are lost with the crash
+		after := fs.Crash()
+		if sync {
+			checkFaultFile(t, after, "/db/table", "new", true)
+		} else {
+			checkFaultFile(t, after, "/db/table", "old", true)
+		}
+
+		checkFaultFile(t, after, tmpPath, "", false)
+	}
+}
+
+func TestReplaceFileKeepsOldFileOnFailure(t *testing.T) {
+	for _, op := range []FaultOp{FaultSync, FaultRename} {
+		fs := NewFaultFS()
+		if err := fs.MkdirAll("/db", os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+
+		writeFaultFile(t, fs, "/db/table", "old", true)
+		tmpPath := TempFilePath("/db/table")
+		writeFaultFile(t, fs, tmpPath, "new", false)
+		fs.Inject(Fault{Op: op, Name: tmpPath})
+		if err := replaceFile(fs, tmpPath, "/db/table", true); err == nil {
+			t.Fatalf("replacing a file with a failing %s succeeded", op)
+		}
+
+		checkFaultFile(t, fs, "/db/table", "old", true)
+	}
+}
@@ -0,0 +1,477 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File is an open file of an FS.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+}
+
+// FS is the filesystem tables, value logs and manifests are kept in.
+// Errors follow the os package so os.IsNotExist and os.IsExist work on
+// them.
+type FS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	Rename(oldpath string, newpath string) error
+	Remove(name string) error
+	MkdirAll(path string, perm os.FileMode) error
+	// ReadDir lists the entries of dirname sorted by name.
+	ReadDir(dirname string) ([]os.FileInfo, error)
+	// SyncDir makes renames and new files in dir durable.
+	SyncDir(dir string) error
+	// Lock creates name if needed and holds an exclusive lock on it until
+	// the returned Closer is closed. A lock already held fails with ErrLocked
+	// rather than waiting.
+	Lock(name string) (io.Closer, error)
+	// RLock is Lock for a shared lock, which any number of holders can take
+	// at once.
+	RLock(name string) (io.Closer, error)
+}
+
+// OSFS is the FS of the operating system.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (OSFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFS) Rename(oldpath string, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (OSFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (OSFS) SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+
+	defer d.Close()
+	return d.Sync()
+}
+
+// readFile reads the whole of the file name from fs.
+func readFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+	return ioutil.ReadAll(f)
+}
+
+type memData struct {
+	data    []byte
+	modTime time.Time
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() interface{}   { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+
+	return 0644
+}
+
+// MemFS is an FS held entirely in memory, so the engine can run without
+// touching disk. It is safe for concurrent use.
+type MemFS struct {
+	mu    sync.Mutex
+	files map[string]*memData
+	dirs  map[string]bool
+	locks lockSet
+}
+
+func NewMemFS() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memData),
+		dirs:  map[string]bool{".": true, string(filepath.Separator): true},
+	}
+}
+
+func memPathError(op string, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// memPath cleans name the way the operating system resolves it, where an
+// empty name refers to no file at all.
+func memPath(op string, name string) (string, error) {
+	if name == "" {
+		return "", memPathError(op, name, os.ErrNotExist)
+	}
+
+	return filepath.Clean(name), nil
+}
+
+// parentExists is called with mu held.
+func (m *MemFS) parentExists(name string) bool {
+	return m.dirs[filepath.Dir(name)]
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := memPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.dirs[name] {
+		return nil, memPathError("open", name, errors.New("is a directory"))
+	}
+
+	d, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, memPathError("open", name, os.ErrExist)
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, memPathError("open", name, os.ErrNotExist)
+	case !ok && !m.parentExists(name):
+		return nil, memPathError("open", name, os.ErrNotExist)
+	case !ok:
+		d = &memData{modTime: time.Now()}
+		m.files[name] = d
+	}
+
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if writable && flag&os.O_TRUNC != 0 {
+		d.data = nil
+		d.modTime = time.Now()
+	}
+
+	return &memFile{fs: m, name: name, data: d, flag: flag}, nil
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name, err := memPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.dirs[name] {
+		return memFileInfo{filepath.Base(name), 0, true, time.Time{}}, nil
+	}
+
+	d, ok := m.files[name]
+	if !ok {
+		return nil, memPathError("stat", name, os.ErrNotExist)
+	}
+
+	return memFileInfo{filepath.Base(name), int64(len(d.data)), false, d.modTime}, nil
+}
+
+func (m *MemFS) Rename(oldpath string, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldpath = filepath.Clean(oldpath)
+	newpath = filepath.Clean(newpath)
+	d, ok := m.files[oldpath]
+	switch {
+	case !ok:
+		return memPathError("rename", oldpath, os.ErrNotExist)
+	case m.dirs[newpath]:
+		return memPathError("rename", newpath, errors.New("is a directory"))
+	case !m.parentExists(newpath):
+		return memPathError("rename", newpath, os.ErrNotExist)
+	}
+
+	delete(m.files, oldpath)
+	m.files[newpath] = d
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	name = filepath.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+
+	if !m.dirs[name] {
+		return memPathError("remove", name, os.ErrNotExist)
+	}
+
+	prefix := name + string(filepath.Separator)
+	for f := range m.files {
+		if strings.HasPrefix(f, prefix) {
+			return memPathError("remove", name, errors.New("directory not empty"))
+		}
+	}
+
+	for d := range m.dirs {
+		if strings.HasPrefix(d, prefix) {
+			return memPathError("remove", name, errors.New("directory not empty"))
+		}
+	}
+
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) MkdirAll(path string, perm os.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for p := filepath.Clean(path); !m.dirs[p]; p = filepath.Dir(p) {
+		if _, ok := m.files[p]; ok {
+			return memPathError("mkdir", p, errors.New("not a directory"))
+		}
+
+		m.dirs[p] = true
+	}
+
+	return nil
+}
+
+func (m *MemFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dirname = filepath.Clean(dirname)
+	if !m.dirs[dirname] {
+		return nil, memPathError("open", dirname, os.ErrNotExist)
+	}
+
+	var infos []os.FileInfo
+	for name, d := range m.files {
+		if filepath.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{filepath.Base(name), int64(len(d.data)), false, d.modTime})
+		}
+	}
+
+	for name := range m.dirs {
+		if name != dirname && filepath.Dir(name) == dirname {
+			infos = append(infos, memFileInfo{filepath.Base(name), 0, true, time.Time{}})
+		}
+	}
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (m *MemFS) SyncDir(dir string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.dirs[filepath.Clean(dir)] {
+		return memPathError("sync", dir, os.ErrNotExist)
+	}
+
+	return nil
+}
+
+// Lock locks name against other users of this MemFS.
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	return m.lockFile(name, false)
+}
+
+func (m *MemFS) RLock(name string) (io.Closer, error) {
+	return m.lockFile(name, true)
+}
+
+func (m *MemFS) lockFile(name string, shared bool) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Close()
+	return m.locks.lock(filepath.Clean(name), shared)
+}
+
+// memFile is an open handle on a MemFS file. File contents are shared by
+// every handle and guarded by the filesystem mutex.
+type memFile struct {
+	fs     *MemFS
+	name   string
+	data   *memData
+	offset int64
+	flag   int
+	closed bool
+}
+
+func (f *memFile) check(write bool) error {
+	if f.closed {
+		return memPathError("use", f.name, os.ErrClosed)
+	}
+
+	if write && f.flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return memPathError("write", f.name, os.ErrPermission)
+	}
+
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+
+	if f.offset >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+
+	if off >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+
+	if f.flag&os.O_APPEND != 0 {
+		f.offset = int64(len(f.data.data))
+	}
+
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.data.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.data.data)
+		f.data.data = grown
+	}
+
+	copy(f.data.data[f.offset:], p)
+	f.offset = end
+	f.data.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.data.data))
+	}
+
+	if offset < 0 {
+		return 0, memPathError("seek", f.name, os.ErrInvalid)
+	}
+
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(false); err != nil {
+		return err
+	}
+
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	return f.check(false)
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if err := f.check(false); err != nil {
+		return nil, err
+	}
+
+	return memFileInfo{filepath.Base(f.name), int64(len(f.data.data)), false, f.data.modTime}, nil
+}
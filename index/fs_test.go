@@ -0,0 +1,104 @@
+package index
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMemFSFiles(t *testing.T) {
+	fs := NewMemFS()
+	if _, err := fs.OpenFile("/db/a", os.O_CREATE|os.O_WRONLY, 0644); !os.IsNotExist(err) {
+		t.Fatalf("OpenFile without a parent directory returned %v", err)
+	}
+
+	if err := fs.MkdirAll("/db", os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := fs.OpenFile("/db/a", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	io.WriteString(f, "hello ")
+	f.Seek(0, io.SeekStart)
+	io.WriteString(f, "world")
+	f.Close()
+	if _, err = f.Write([]byte("x")); err == nil {
+		t.Fatal("Write succeeded on a closed file")
+	}
+
+	data, err := readFile(fs, "/db/a")
+	if err != nil || string(data) != "hello world" {
+		t.Fatalf("readFile returned %q, %v", data, err)
+	}
+
+	r, _ := fs.OpenFile("/db/a", os.O_RDONLY, 0)
+	if _, err = r.Write([]byte("x")); err == nil {
+		t.Fatal("Write succeeded on a read only file")
+	}
+
+	buf := make([]byte, 5)
+	if n, err := r.ReadAt(buf, 6); n != 5 || err != nil || string(buf) != "world" {
+		t.Fatalf("ReadAt returned %d %q, %v", n, buf, err)
+	}
+
+	if err = fs.Rename("/db/a", "/db/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = fs.Stat("/db/a"); !os.IsNotExist(err) {
+		t.Fatalf("Stat of renamed file returned %v", err)
+	}
+
+	if stat, err := fs.Stat("/db/b"); err != nil || stat.Size() != 11 {
+		t.Fatalf("Stat returned %v, %v", stat, err)
+	}
+
+	if err = fs.Remove("/db"); err == nil {
+		t.Fatal("Remove deleted a directory that is not empty")
+	}
+
+	entries, err := fs.ReadDir("/db")
+	if err != nil || len(entries) != 1 || entries[0].Name() != "b" {
+		t.Fatalf("ReadDir returned %v, %v", entries, err)
+	}
+
+	if err = fs.Remove("/db/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Remove("/db/b"); !os.IsNotExist(err) {
+		t.Fatalf("second Remove returned %v", err)
+	}
+}
+
+func TestWriteKvItemsMemFS(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(i*11, i)
+	}
+
+	opts := DefaultOptions()
+	opts.FS = NewMemFS()
+	opts.ValueThreshold = 1000
+	opts.SyncPolicy = SyncAlways
+	storage := writeValues(t, values, opts)
+	checkValues(t, storage, values)
+	checkValues(t, openStorage(t, storage.filePath, opts), values)
+
+	if _, err := opts.FS.Stat(valueLogPath(storage.filePath)); err != nil {
+		t.Fatalf("value log was not written to the memory filesystem: %v", err)
+	}
+
+	if _, err := os.Stat(storage.filePath); !os.IsNotExist(err) {
+		t.Fatalf("sstable was written to disk: %v", err)
+	}
+
+	if _, err := ioutil.ReadFile(valueLogPath(storage.filePath)); !os.IsNotExist(err) {
+		t.Fatalf("value log was written to disk: %v", err)
+	}
+}
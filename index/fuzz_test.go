@@ -0,0 +1,284 @@
+package index
+
+import (
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	SEED_STORE_DIR string = "../storage_backup/store_A"
+	FUZZ_DIR       string = "/fuzz"
+	FUZZ_TABLE     string = "/fuzz/000001.sst"
+	FUZZ_LOG       string = "/fuzz/000002.vlog"
+	SEED_BLOCKS    int    = 2
+)
+
+// fuzzFS returns a filesystem holding data in the file name.
+func fuzzFS(t *testing.T, name string, data []byte) *MemFS {
+	fs := NewMemFS()
+	fs.MkdirAll(FUZZ_DIR, os.ModePerm)
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write(data)
+	f.Close()
+	return fs
+}
+
+func csvLine(record []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(record)
+	w.Flush()
+	return buf.String()
+}
+
+// seedTables returns the first blocks and the bloom filter and index lines
+// of each table in the store kept in the repository, so fuzzing starts from
+// real files.
+func seedTables(f *testing.F) (blocks []string, tails []string) {
+	entries, err := ioutil.ReadDir(SEED_STORE_DIR)
+	if err != nil {
+		f.Logf("No seed store at %s. %v", SEED_STORE_DIR, err)
+	}
+
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != TABLE_FILE_SUFFIX {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(SEED_STORE_DIR, entry.Name()))
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		lines := strings.SplitAfter(string(data), "\n")
+		if len(lines) < SEED_BLOCKS+2 {
+			continue
+		}
+
+		blocks = append(blocks, lines[:SEED_BLOCKS]...)
+		tails = append(tails, lines[0]+strings.Join(lines[len(lines)-2:], ""))
+	}
+
+	items := []KeyValueItem{NewKeyValueItem("k,1", "v\"1\"\n"), newTombstoneItem("k2"),
+		newValuePointerItem("k3", ValuePointer{0, 4}), NewExpiringKeyValueItem("k4", "v4", time.Unix(1, 0))}
+	var record []string
+	for _, it := range items {
+		record = append(record, itemFields(it)...)
+	}
+
+	blocks = append(blocks, csvLine(record))
+	record, err = csv.NewReader(strings.NewReader(blocks[0])).Read()
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	compressed, err := compressBlock(record)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	return append(blocks, csvLine(compressed)), tails
+}
+
+func FuzzReadBlock(f *testing.F) {
+	blocks, _ := seedTables(f)
+	for _, block := range blocks {
+		f.Add([]byte(block))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := fuzzFS(t, FUZZ_TABLE, data)
+		block, err := readBlock(fs, FUZZ_TABLE, 0, NewSyncedLocalDataLog(fs, FUZZ_LOG, false))
+		if err != nil {
+			return
+		}
+
+		keys := block.Keys()
+		if len(keys) == 0 || keys[0] != block.BlockKey() {
+			t.Fatalf("block %q decoded with keys %q", block.BlockKey(), keys)
+		}
+
+		for _, key := range keys {
+			block.GetEntry(key)
+		}
+	})
+}
+
+func FuzzLoadIndex(f *testing.F) {
+	_, tails := seedTables(f)
+	for _, tail := range tails {
+		f.Add([]byte(tail))
+	}
+
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := fuzzFS(t, FUZZ_TABLE, data)
+		footer, err := loadIndex(fs, FUZZ_TABLE)
+		if err != nil {
+			return
+		}
+
+		opts := DefaultOptions()
+		opts.FS = fs
+		storage, err := newSsBlockStorage(FUZZ_TABLE, FUZZ_LOG, footer, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ind := footer.index
+		for i := 0; i < len(ind); i += 2 {
+			if block, err := storage.ReadBlock(ind[i]); err == nil {
+				block.Get(ind[i])
+			}
+		}
+
+		if len(ind) > 0 {
+			storage.RangeSearch(ind[0], ind[len(ind)-2])
+		}
+	})
+}
+
+func FuzzReadLogItem(f *testing.F) {
+	blocks, _ := seedTables(f)
+	fs := NewMemFS()
+	fs.MkdirAll(FUZZ_DIR, os.ModePerm)
+	valueLog := NewSyncedLocalDataLog(fs, FUZZ_LOG, false)
+	for _, block := range blocks {
+		record, err := csv.NewReader(strings.NewReader(block)).Read()
+		if err != nil || len(record) < 3 {
+			continue
+		}
+
+		if _, err = valueLog.AddLogItem(NewLogItem(record[1], record[2], 0)); err != nil {
+			f.Fatal(err)
+		}
+	}
+
+	data, err := readFile(fs, FUZZ_LOG)
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(data, int64(0))
+	f.Add(data, int64(len(data)/2))
+	f.Fuzz(func(t *testing.T, data []byte, offset int64) {
+		fs := fuzzFS(t, FUZZ_LOG, data)
+		item, err := NewSyncedLocalDataLog(fs, FUZZ_LOG, false).ReadLogItem(offset)
+		if err == nil && item.Size() != int64(len(item.Value())) {
+			t.Fatalf("log item of %d bytes read with size %d", len(item.Value()), item.Size())
+		}
+	})
+}
+
+func FuzzOpenManifest(f *testing.F) {
+	data, err := ioutil.ReadFile(ManifestPath(SEED_STORE_DIR))
+	if err == nil {
+		f.Add(data)
+	}
+
+	edit := VersionEdit{Format: TABLE_FORMAT, NextFileNumber: 4, LastSequence: 9, ValueLogNumber: 2,
+		Added: []TableMeta{{Level: 0, Number: 3, Size: 10}}, Removed: []int{1}}
+	f.Add([]byte(edit.record() + edit.record()[:20]))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fs := fuzzFS(t, ManifestPath(FUZZ_DIR), data)
+		opts := DefaultOptions()
+		opts.FS = fs
+		m, err := OpenManifest(FUZZ_DIR, opts)
+		if err != nil {
+			return
+		}
+
+		reopened, err := OpenManifest(FUZZ_DIR, opts)
+		if err != nil {
+			t.Fatalf("rewritten manifest could not be replayed: %v", err)
+		}
+
+		if len(reopened.LiveFiles()) != len(m.LiveFiles()) || reopened.LastSequence() != m.LastSequence() {
+			t.Fatalf("rewritten manifest lists %v at %d, want %v at %d", reopened.LiveFiles(),
+				reopened.LastSequence(), m.LiveFiles(), m.LastSequence())
+		}
+	})
+}
+
+func FuzzReadWriteAheadLog(f *testing.F) {
+	b := WalBatch{Sequence: 7, Commands: []FamilyCommand{
+		{"default", Command{Type: PUT_COMMAND, Item: NewKeyValueItem("k1", "v,1\n")}},
+		{"users", Command{Type: MERGE_COMMAND, Item: NewExpiringKeyValueItem("k2", "1", time.Unix(1, 0))}},
+		{"users", NewRangeDeleteCommand("a", "b")},
+	}}
+	record, _ := b.record()
+	f.Add([]byte(record + record[:20]))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		opts := DefaultOptions()
+		opts.FS = fuzzFS(t, WalPath(FUZZ_DIR), data)
+		batches, err := ReadWriteAheadLog(FUZZ_DIR, opts)
+		if err != nil {
+			return
+		}
+
+		var rewritten strings.Builder
+		for _, b := range batches {
+			record, err := b.record()
+			if err != nil {
+				t.Fatalf("batch %d read back could not be written: %v", b.Sequence, err)
+			}
+
+			rewritten.WriteString(record)
+		}
+
+		opts.FS = fuzzFS(t, WalPath(FUZZ_DIR), []byte(rewritten.String()))
+		reread, err := ReadWriteAheadLog(FUZZ_DIR, opts)
+		if err != nil || len(reread) != len(batches) {
+			t.Fatalf("rewritten log read back %d batches, %v, want %d", len(reread), err, len(batches))
+		}
+
+		for i := range batches {
+			if got, want := strings.Join(reread[i].fields(), ","), strings.Join(batches[i].fields(), ","); got != want {
+				t.Fatalf("rewritten batch %d reads as %s, want %s", i, got, want)
+			}
+		}
+	})
+}
+
+func FuzzRecordReader(f *testing.F) {
+	blocks, _ := seedTables(f)
+	for _, block := range blocks {
+		f.Add([]byte(block))
+	}
+
+	f.Add([]byte("\"a\r\nb\",\"\r\",c\r\n\n\"\"\"\",d"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := newRecordReader(bytes.NewReader(data))
+		for {
+			record, err := r.Read()
+			if err != nil {
+				return
+			}
+
+			if len(record) == 1 && record[0] == "" {
+				// a csv.Writer writes a record of one empty field as an
+				// empty line
+				continue
+			}
+
+			var line bytes.Buffer
+			w := csv.NewWriter(&line)
+			w.Write(record)
+			w.Flush()
+			reread, err := newRecordReader(&line).Read()
+			if err != nil || strings.Join(reread, "\x00") != strings.Join(record, "\x00") {
+				t.Fatalf("record %q was rewritten as %q and read back as %q, %v", record, line.String(), reread, err)
+			}
+		}
+	})
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io"
-	"math/rand"
 	"os"
 	"sort"
 )
@@ -51,6 +50,7 @@ func getPartialKey(key string) string {
 }
 
 type LocalIndex struct {
+	fs              FS
 	storageFilePath string
 	indexItems      map[string][]IndexItem
 	localDataLog    DataLog
@@ -77,27 +77,28 @@ func (i *LocalIndex) Save() error {
 	log.Info("Sorted index items by offset.")
 
 	log.Info("Creating temp index file.")
-	fileName := fmt.Sprintf("./index_swap%d.csv", rand.Int())
-	file, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	fileName := TempFilePath(i.storageFilePath)
+	file, err := i.fs.OpenFile(fileName, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Error("Could not create tmp index file.", err)
 		return err
 	}
-	defer file.Close()
 
 	log.Infof("Writing %d records to index.", len(items))
 	for _, item := range items {
-		_, write_err := file.WriteString(fmt.Sprintf("%s,%d,%d\n", item.PartialKey(), item.Offset(), item.Size()))
+		_, write_err := io.WriteString(file, fmt.Sprintf("%s,%d,%d\n", item.PartialKey(), item.Offset(), item.Size()))
 		if write_err != nil {
+			file.Close()
 			return write_err
 		}
 	}
 
-	//Create index file if no exist
-	log.Infof("Swapping tmp index file as replacement.")
-	err = os.Rename(fileName, i.storageFilePath)
+	if err = file.Close(); err != nil {
+		return err
+	}
 
-	return err
+	log.Infof("Swapping tmp index file as replacement.")
+	return replaceFile(i.fs, fileName, i.storageFilePath, true)
 }
 
 func (i *LocalIndex) Get(key string) (indexItems []IndexItem, ok bool) {
@@ -120,9 +121,9 @@ func (i *LocalIndex) Put(indexItem IndexItem) {
 }
 
 func (i *LocalIndex) getLastIndex() int64 {
-	storeFile, err := os.OpenFile(i.storageFilePath, os.O_RDONLY, 0644)
+	storeFile, err := i.fs.OpenFile(i.storageFilePath, os.O_RDONLY, 0644)
 
-	if _, er := os.Stat(i.storageFilePath); os.IsNotExist(er) {
+	if _, er := i.fs.Stat(i.storageFilePath); os.IsNotExist(er) {
 		return 0
 	}
 
@@ -135,7 +136,7 @@ func (i *LocalIndex) getLastIndex() int64 {
 
 	stat, err := storeFile.Stat()
 	if err != nil {
-		log.Errorf("Unable to seek to offset in index file at %s", i.storageFilePath, err)
+		log.Errorf("Unable to seek to offset in index file at %s. %v", i.storageFilePath, err)
 		return 0
 	}
 
@@ -198,8 +199,13 @@ func (i *LocalIndex) Load() error {
 }
 
 func NewLocalIndex(storageFilePath string, dataLog DataLog) Index {
+	return NewFSLocalIndex(OSFS{}, storageFilePath, dataLog)
+}
+
+// NewFSLocalIndex creates an index saved to storageFilePath on fs.
+func NewFSLocalIndex(fs FS, storageFilePath string, dataLog DataLog) Index {
 	indexItems := make(map[string][]IndexItem)
-	localIndex := LocalIndex{storageFilePath, indexItems, dataLog}
+	localIndex := LocalIndex{fs, storageFilePath, indexItems, dataLog}
 
 	return &localIndex
 }
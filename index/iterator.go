@@ -0,0 +1,144 @@
+package index
+
+import (
+	"sort"
+	"strconv"
+)
+
+// TableIterator walks the entries of an sstable in key order, tombstones
+// included, holding only the block it is positioned in.
+type TableIterator struct {
+	table *SsBlockStorage
+	// block is the number of the current block in the index, and entries
+	// and pos the items of that block and the one iterated over.
+	block   int
+	entries []KeyValueItem
+	pos     int
+	err     error
+}
+
+// NewIterator returns an iterator over the table, positioned at no entry.
+func (s *SsBlockStorage) NewIterator() *TableIterator {
+	return &TableIterator{table: s, block: -1}
+}
+
+func (it *TableIterator) blocks() int {
+	return len(it.table.index) / 2
+}
+
+// load positions the iterator in block number n at pos, where a negative
+// pos counts back from the end of the block.
+func (it *TableIterator) load(n int, pos int) {
+	it.block, it.entries = -1, nil
+	if it.err != nil || n < 0 || n >= it.blocks() {
+		return
+	}
+
+	offset, err := strconv.ParseInt(it.table.index[2*n+1], 10, 64)
+	if err != nil {
+		it.err = &CorruptionError{it.table.filePath, err}
+		return
+	}
+
+	block, err := it.table.blockAt(offset)
+	if err != nil {
+		it.err = err
+		return
+	}
+
+	it.block, it.entries = n, block.entries()
+	if pos < 0 {
+		pos += len(it.entries)
+	}
+
+	it.pos = pos
+	it.settle()
+}
+
+// settle moves past either end of the current block into the next or
+// previous one.
+func (it *TableIterator) settle() {
+	switch {
+	case it.block < 0:
+	case it.pos >= len(it.entries):
+		it.load(it.block+1, 0)
+	case it.pos < 0:
+		it.load(it.block-1, -1)
+	}
+}
+
+func (it *TableIterator) Valid() bool {
+	return it.err == nil && it.block >= 0
+}
+
+func (it *TableIterator) SeekToFirst() {
+	it.load(0, 0)
+}
+
+func (it *TableIterator) SeekToLast() {
+	it.load(it.blocks()-1, -1)
+}
+
+// Seek moves to the first entry at or after key.
+func (it *TableIterator) Seek(key string) {
+	n := sort.Search(it.blocks(), func(i int) bool { return it.table.index[2*i] > key }) - 1
+	if n < 0 {
+		n = 0
+	}
+
+	it.load(n, 0)
+	if it.Valid() && it.block == n {
+		it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].Key() >= key })
+		it.settle()
+	}
+}
+
+func (it *TableIterator) Next() {
+	if it.Valid() {
+		it.pos += 1
+		it.settle()
+	}
+}
+
+func (it *TableIterator) Prev() {
+	if it.Valid() {
+		it.pos -= 1
+		it.settle()
+	}
+}
+
+func (it *TableIterator) Key() string {
+	return it.entries[it.pos].Key()
+}
+
+// Deleted reports whether the current entry is a tombstone.
+func (it *TableIterator) Deleted() bool {
+	return it.entries[it.pos].Deleted()
+}
+
+// ExpiresAt returns when the current entry expires, or zero if it never
+// does.
+func (it *TableIterator) ExpiresAt() int64 {
+	return it.entries[it.pos].ExpiresAt()
+}
+
+// Operand reports whether the current entry holds merge operands.
+func (it *TableIterator) Operand() bool {
+	return it.entries[it.pos].Operand()
+}
+
+// Value reads the value of the current entry, from the value log if it was
+// moved there.
+func (it *TableIterator) Value() (string, error) {
+	return readValue(it.table.valueLog, it.entries[it.pos])
+}
+
+// RangeTombstones returns the range tombstones of the table, which hide
+// entries of older tables.
+func (it *TableIterator) RangeTombstones() RangeTombstones {
+	return it.table.rangeTombstones
+}
+
+func (it *TableIterator) Err() error {
+	return it.err
+}
@@ -0,0 +1,266 @@
+package index
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	TOMBSTONE_SUFFIX string = "d"
+	TEMP_FILE_SUFFIX string = ".tmp"
+)
+
+func (s *SsBlockStorage) FileSize() int64 {
+	stat, err := s.opts.FileSystem().Stat(s.filePath)
+	if err != nil {
+		return 0
+	}
+
+	return stat.Size()
+}
+
+// OpenTable opens the L0 table at path, sharing the value log of this base
+// sstable.
+func (s *SsBlockStorage) OpenTable(path string) (BlockStorage, error) {
+	footer, err := loadIndex(s.opts.FileSystem(), path)
+	if err != nil {
+		log.Errorf("Could not load sstable index. %v", err)
+		return nil, err
+	}
+
+	return newSsBlockStorage(path, s.valueLogPath, footer, s.opts)
+}
+
+// FlushTable writes commands into a new L0 table at path sharing the value
+// log of this base sstable. Deletes and range deletes are kept as tombstones
+// so they still hide older values of their keys until compaction merges the
+// table into the base, and merge operands are kept to be folded onto those
+// values.
+func (s *SsBlockStorage) FlushTable(path string, commands []Command) (BlockStorage, error) {
+	log.Infof("Flushing %d commands into L0 table %s.", len(commands), path)
+	items := make([]KeyValueItem, 0, len(commands))
+	var tombstones RangeTombstones
+	writeCommandsAmount := 0
+	for _, cmd := range commands {
+		if cmd.Type == DELRANGE_COMMAND {
+			tombstones = append(tombstones, RangeTombstone{cmd.Item.Key(), cmd.Item.Value()})
+		} else if cmd.Type == DEL_COMMAND {
+			tombstone := cmd.Item
+			tombstone.kind = tombstoneItem
+			tombstone.value = ""
+			items = append(items, tombstone)
+		} else if cmd.Type == MERGE_COMMAND {
+			operands := cmd.Item
+			operands.kind = operandItem
+			items = append(items, operands)
+		} else {
+			writeCommandsAmount += 1
+			items = append(items, cmd.Item)
+		}
+	}
+
+	log.Infof("Number of new write commands is %d", writeCommandsAmount)
+	err := separateValues(s.valueLog, items, s.opts.ValueThreshold)
+	if err != nil {
+		log.Errorf("Unable to move values into value log for %s.", path)
+		return nil, err
+	}
+
+	err = syncValueLog(s.valueLogPath, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFilePath := TempFilePath(path)
+	footer, err := writeTable(tmpFilePath, items, tombstones, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = replaceFile(s.opts.FileSystem(), tmpFilePath, path, s.opts.syncFiles()); err != nil {
+		log.Errorf("Could not move flushed table into place at %s.", path)
+		return nil, err
+	}
+
+	return newSsBlockStorage(path, s.valueLogPath, footer, s.opts)
+}
+
+// Compaction merges L0 tables into the base sstable. The merged table is
+// written aside by Compact and only moved into place once installed, so
+// readers can keep using the old tables until then.
+type Compaction struct {
+	base           *SsBlockStorage
+	tables         []BlockStorage
+	filePath       string
+	tmpFilePath    string
+	footer         tableFooter
+	liveValueBytes int64
+}
+
+// Compact merges tables, given newest first, with this base sstable into a
+// new base at filePath. Tombstones, range tombstones and expired values are
+// dropped since nothing older than the base remains to hide, and merge
+// operands are folded onto the values below them, so the base only holds
+// values.
+func (s *SsBlockStorage) Compact(tables []BlockStorage, filePath string) (*Compaction, error) {
+	log.Infof("Compacting %d L0 tables and %s into %s.", len(tables), s.filePath, filePath)
+	itemMap := make(map[string]KeyValueItem)
+	stored, err := tableItems(s)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.opts.Now()
+	for _, it := range stored {
+		if !it.Deleted() && !Expired(it.ExpiresAt(), now) {
+			itemMap[it.Key()] = it
+		}
+	}
+
+	for i := len(tables) - 1; i >= 0; i-- {
+		table, ok := tables[i].(*SsBlockStorage)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot compact table of type %T", tables[i]))
+		}
+
+		items, err := tableItems(table)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range table.rangeTombstones {
+			deleteRange(itemMap, t)
+		}
+
+		for _, it := range items {
+			if it.Deleted() || Expired(it.ExpiresAt(), now) {
+				delete(itemMap, it.Key())
+			} else if it.Operand() {
+				err = foldOperands(s.valueLog, s.opts, itemMap, it.Key(), it.Value())
+				if err != nil {
+					log.Errorf("Could not merge operands of %s. %v", it.Key(), err)
+					return nil, err
+				}
+			} else {
+				itemMap[it.Key()] = it
+			}
+		}
+	}
+
+	items := make([]KeyValueItem, 0, len(itemMap))
+	for _, it := range itemMap {
+		items = append(items, it)
+	}
+
+	// values folded from merge operands are written inline
+	err = separateValues(s.valueLog, items, s.opts.ValueThreshold)
+	if err != nil {
+		log.Errorf("Unable to move values into value log for %s.", filePath)
+		return nil, err
+	}
+
+	err = syncValueLog(s.valueLogPath, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpFilePath := TempFilePath(filePath)
+	footer, err := writeTable(tmpFilePath, items, nil, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Compaction{s, tables, filePath, tmpFilePath, footer, liveValueBytes(items)}, nil
+}
+
+// Install moves the merged table into place. The old base and compacted L0
+// tables are left for the caller to remove once the new table is recorded.
+func (c *Compaction) Install() (BlockStorage, error) {
+	log.Infof("Moving compacted data file into place at %s.", c.filePath)
+	err := replaceFile(c.base.opts.FileSystem(), c.tmpFilePath, c.filePath, c.base.opts.syncFiles())
+	if err != nil {
+		log.Error("Could not move compacted data file into place.")
+		return nil, err
+	}
+
+	storage, err := newSsBlockStorage(c.filePath, c.base.valueLogPath, c.footer, c.base.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.liveValueBytes = c.liveValueBytes
+	return storage, nil
+}
+
+// RangeSearchTables scans tables, given newest first, returning the items of
+// keys between key1 and key2 in key order, holding their values. The newest
+// entry of each key wins, with merge operands folded onto the older entries
+// below them, and deleted keys are left out, as are keys covered by range
+// tombstones of newer tables. The scan stops with the error of ctx once it
+// is done.
+func RangeSearchTables(ctx context.Context, tables []BlockStorage, key1 string, key2 string) (items []KeyValueItem, err error) {
+	mergers := make(map[string]*Merger)
+	var newer RangeTombstones
+	for _, t := range tables {
+		table, ok := t.(*SsBlockStorage)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Cannot scan table of type %T", t))
+		}
+
+		found, err := table.rangeItems(ctx, key1, key2)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, it := range found {
+			m, ok := mergers[it.Key()]
+			if !ok {
+				m = NewMerger(table.opts, it.Key())
+				mergers[it.Key()] = m
+				if newer.Covers(it.Key()) {
+					m.Add(Entry{Deleted: true, Found: true})
+				}
+			}
+
+			if m.Done() {
+				continue
+			}
+
+			if err = ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			value, err := readValue(table.valueLog, it)
+			if err != nil {
+				return nil, err
+			}
+
+			m.Add(Entry{Value: value, Deleted: it.Deleted(), Operand: it.Operand(), ExpiresAt: it.ExpiresAt(),
+				Found: true})
+		}
+
+		for key, m := range mergers {
+			if table.rangeTombstones.Covers(key) {
+				m.Add(Entry{Deleted: true, Found: true})
+			}
+		}
+
+		newer = append(newer, table.rangeTombstones...)
+	}
+
+	for key, m := range mergers {
+		value, found, err := m.Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			items = append(items, NewKeyValueItem(key, value))
+		}
+	}
+
+	sortKeyValueItemsByKey(items)
+	return items, nil
+}
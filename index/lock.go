@@ -0,0 +1,62 @@
+package index
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// ErrLocked is the error, wrapped in an *os.PathError, for locking a file
+// another store already holds the lock on.
+var ErrLocked = errors.New("locked by another store")
+
+// lockSet tracks the files locked within this process, holding -1 for an
+// exclusive lock and the number of holders for a shared one.
+type lockSet struct {
+	mu   sync.Mutex
+	held map[string]int
+}
+
+func (s *lockSet) lock(name string, shared bool) (io.Closer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	holders := s.held[name]
+	if holders < 0 || (holders > 0 && !shared) {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: ErrLocked}
+	}
+
+	if s.held == nil {
+		s.held = make(map[string]int)
+	}
+
+	if shared {
+		s.held[name] = holders + 1
+	} else {
+		s.held[name] = -1
+	}
+
+	return &heldLock{set: s, name: name}, nil
+}
+
+type heldLock struct {
+	set  *lockSet
+	name string
+	once sync.Once
+}
+
+func (l *heldLock) Close() error {
+	l.once.Do(func() {
+		l.set.mu.Lock()
+		defer l.set.mu.Unlock()
+
+		if l.set.held[l.name] > 1 {
+			l.set.held[l.name] -= 1
+		} else {
+			delete(l.set.held, l.name)
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,37 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package index
+
+import (
+	"io"
+	"os"
+	"syscall"
+)
+
+// Lock takes a flock on name, which the operating system releases when the
+// file is closed or the process exits.
+func (OSFS) Lock(name string) (io.Closer, error) {
+	return flockFile(name, syscall.LOCK_EX)
+}
+
+func (OSFS) RLock(name string) (io.Closer, error) {
+	return flockFile(name, syscall.LOCK_SH)
+}
+
+func flockFile(name string, how int) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			err = ErrLocked
+		}
+
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+
+	return f, nil
+}
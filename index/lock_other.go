@@ -0,0 +1,36 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package index
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+var processLocks lockSet
+
+// Lock keeps stores within this process from sharing name. Without flock
+// it does not guard against other processes.
+func (OSFS) Lock(name string) (io.Closer, error) {
+	return lockProcessFile(name, false)
+}
+
+func (OSFS) RLock(name string) (io.Closer, error) {
+	return lockProcessFile(name, true)
+}
+
+func lockProcessFile(name string, shared bool) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	f.Close()
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return processLocks.lock(abs, shared)
+}
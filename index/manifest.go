@@ -0,0 +1,458 @@
+package index
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	MANIFEST_FILE      string = "MANIFEST"
+	LOCK_FILE          string = "LOCK"
+	READ_LOCK_FILE     string = "READ_LOCK"
+	TABLE_FILE_SUFFIX  string = ".sst"
+	EDIT_RECORD        string = "edit"
+	EDIT_FORMAT        string = "format"
+	EDIT_NEXT_FILE     string = "next_file"
+	EDIT_LAST_SEQUENCE string = "last_sequence"
+	EDIT_VALUE_LOG     string = "value_log"
+	EDIT_ADD_TABLE     string = "add"
+	EDIT_REMOVE_TABLE  string = "remove"
+	EDIT_CHECKSUM      string = "crc"
+)
+
+// TABLE_FORMAT is the format of the tables a store is written in. Format 2
+// tables hold full keys in key order, where stores without a format kept
+// only a hash of each key.
+const TABLE_FORMAT int = 2
+
+// TableFileName names the sstable with the given file number in dir.
+func TableFileName(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", number, TABLE_FILE_SUFFIX))
+}
+
+// ValueLogFileName names the value log with the given file number in dir.
+func ValueLogFileName(dir string, number int) string {
+	return filepath.Join(dir, fmt.Sprintf("%06d%s", number, VALUE_LOG_SUFFIX))
+}
+
+// ManifestPath names the manifest of the store kept in dir.
+func ManifestPath(dir string) string {
+	return filepath.Join(dir, MANIFEST_FILE)
+}
+
+// LockFileName names the file a store kept in dir is locked through.
+func LockFileName(dir string) string {
+	return filepath.Join(dir, LOCK_FILE)
+}
+
+// ReadLockFileName names the file read only stores of dir share a lock on.
+func ReadLockFileName(dir string) string {
+	return filepath.Join(dir, READ_LOCK_FILE)
+}
+
+// ParseFileName returns the file number of a table or value log file name.
+func ParseFileName(name string) (number int, suffix string, ok bool) {
+	ext := filepath.Ext(name)
+	if ext != TABLE_FILE_SUFFIX && ext != VALUE_LOG_SUFFIX {
+		return 0, "", false
+	}
+
+	number, err := strconv.Atoi(strings.TrimSuffix(name, ext))
+	if err != nil || number <= 0 {
+		return 0, "", false
+	}
+
+	return number, ext, true
+}
+
+// TableMeta describes a live sstable. Level 0 tables are flushed memtables,
+// level 1 holds the single base table they are compacted into.
+type TableMeta struct {
+	Level  int
+	Number int
+	Size   int64
+}
+
+// VersionEdit is one atomic change to the set of live files. Zero fields
+// are left unchanged.
+type VersionEdit struct {
+	Format         int
+	NextFileNumber int
+	LastSequence   uint64
+	ValueLogNumber int
+	Added          []TableMeta
+	Removed        []int
+}
+
+func (e VersionEdit) fields() []string {
+	fields := []string{EDIT_RECORD}
+	if e.Format > 0 {
+		fields = append(fields, EDIT_FORMAT, strconv.Itoa(e.Format))
+	}
+
+	if e.NextFileNumber > 0 {
+		fields = append(fields, EDIT_NEXT_FILE, strconv.Itoa(e.NextFileNumber))
+	}
+
+	if e.LastSequence > 0 {
+		fields = append(fields, EDIT_LAST_SEQUENCE, strconv.FormatUint(e.LastSequence, 10))
+	}
+
+	if e.ValueLogNumber > 0 {
+		fields = append(fields, EDIT_VALUE_LOG, strconv.Itoa(e.ValueLogNumber))
+	}
+
+	for _, t := range e.Added {
+		fields = append(fields, EDIT_ADD_TABLE, strconv.Itoa(t.Level), strconv.Itoa(t.Number),
+			strconv.FormatInt(t.Size, 10))
+	}
+
+	for _, number := range e.Removed {
+		fields = append(fields, EDIT_REMOVE_TABLE, strconv.Itoa(number))
+	}
+
+	return fields
+}
+
+func editChecksum(fields []string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(strings.Join(fields, ","))))
+}
+
+// record encodes the edit as a single csv line ending in a checksum, so an
+// edit torn by a crash is detected and ignored as a whole.
+func (e VersionEdit) record() string {
+	fields := e.fields()
+	fields = append(fields, EDIT_CHECKSUM, editChecksum(fields))
+	return strings.Join(fields, ",") + "\n"
+}
+
+func parseEditInts(args []string) ([]int64, error) {
+	values := make([]int64, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		values[i] = v
+	}
+
+	return values, nil
+}
+
+func parseVersionEdit(record []string) (edit VersionEdit, err error) {
+	n := len(record)
+	if n < 3 || record[0] != EDIT_RECORD || record[n-2] != EDIT_CHECKSUM {
+		return edit, errors.New(fmt.Sprintf("Malformed manifest record %v", record))
+	}
+
+	if editChecksum(record[:n-2]) != record[n-1] {
+		return edit, errors.New(fmt.Sprintf("Manifest record checksum mismatch %v", record))
+	}
+
+	fields := record[1 : n-2]
+	for len(fields) > 0 {
+		arity := 0
+		switch fields[0] {
+		case EDIT_FORMAT, EDIT_NEXT_FILE, EDIT_LAST_SEQUENCE, EDIT_VALUE_LOG, EDIT_REMOVE_TABLE:
+			arity = 1
+		case EDIT_ADD_TABLE:
+			arity = 3
+		default:
+			return edit, errors.New(fmt.Sprintf("Unknown manifest field %s", fields[0]))
+		}
+
+		if len(fields) < arity+1 {
+			return edit, errors.New(fmt.Sprintf("Truncated manifest field %s", fields[0]))
+		}
+
+		args, err := parseEditInts(fields[1 : arity+1])
+		if err != nil {
+			return edit, errors.New(fmt.Sprintf("Bad manifest field %s: %v", fields[0], err))
+		}
+
+		switch fields[0] {
+		case EDIT_FORMAT:
+			edit.Format = int(args[0])
+		case EDIT_NEXT_FILE:
+			edit.NextFileNumber = int(args[0])
+		case EDIT_LAST_SEQUENCE:
+			edit.LastSequence = uint64(args[0])
+		case EDIT_VALUE_LOG:
+			edit.ValueLogNumber = int(args[0])
+		case EDIT_REMOVE_TABLE:
+			edit.Removed = append(edit.Removed, int(args[0]))
+		case EDIT_ADD_TABLE:
+			edit.Added = append(edit.Added, TableMeta{int(args[0]), int(args[1]), args[2]})
+		}
+
+		fields = fields[arity+1:]
+	}
+
+	return edit, nil
+}
+
+// Manifest is the log of version edits describing which tables and value
+// log make up a store. Replaying it rebuilds the current version, so files
+// written by a flush or compaction only become part of the store once their
+// edit is appended.
+type Manifest struct {
+	fs             FS
+	dir            string
+	format         int
+	nextFileNumber int
+	lastSequence   uint64
+	valueLogNumber int
+	tables         map[int]TableMeta
+	syncWrites     bool
+}
+
+func (m *Manifest) apply(edit VersionEdit) {
+	if edit.Format > 0 {
+		m.format = edit.Format
+	}
+
+	if edit.NextFileNumber > m.nextFileNumber {
+		m.nextFileNumber = edit.NextFileNumber
+	}
+
+	if edit.LastSequence > m.lastSequence {
+		m.lastSequence = edit.LastSequence
+	}
+
+	if edit.ValueLogNumber > 0 {
+		m.valueLogNumber = edit.ValueLogNumber
+	}
+
+	for _, number := range edit.Removed {
+		delete(m.tables, number)
+	}
+
+	for _, t := range edit.Added {
+		m.tables[t.Number] = t
+		if t.Number >= m.nextFileNumber {
+			m.nextFileNumber = t.Number + 1
+		}
+	}
+
+	if m.valueLogNumber >= m.nextFileNumber {
+		m.nextFileNumber = m.valueLogNumber + 1
+	}
+}
+
+// snapshot is a single edit recreating the current version.
+func (m *Manifest) snapshot() VersionEdit {
+	edit := VersionEdit{
+		Format:         m.format,
+		NextFileNumber: m.nextFileNumber,
+		LastSequence:   m.lastSequence,
+		ValueLogNumber: m.valueLogNumber,
+	}
+
+	edit.Added = append(m.Tables(0), m.Tables(1)...)
+	return edit
+}
+
+// replay applies every complete edit in the manifest at path. A damaged
+// final edit is what a crash mid-append leaves behind and is skipped, while
+// damage before it means the manifest cannot be trusted.
+func (m *Manifest) replay(path string) error {
+	data, err := readFile(m.fs, path)
+	if err != nil {
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	edits := 0
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		var edit VersionEdit
+		if err == nil {
+			edit, err = parseVersionEdit(record)
+		}
+
+		last := i == len(lines)-1 || (i == len(lines)-2 && lines[i+1] == "")
+		if err != nil && last {
+			log.Warnf("Ignoring incomplete final manifest edit in %s. %v", path, err)
+			break
+		}
+
+		if err != nil {
+			return corruptionError(path, "manifest edit %d: %v", edits+1, err)
+		}
+
+		m.apply(edit)
+		edits += 1
+	}
+
+	log.Infof("Replayed %d manifest edits from %s.", edits, path)
+	return nil
+}
+
+// rewrite replaces the manifest with a single snapshot edit, written aside
+// and renamed into place so a crash leaves either the old or new manifest.
+func (m *Manifest) rewrite() error {
+	path := ManifestPath(m.dir)
+	tmpPath := TempFilePath(path)
+	f, err := m.fs.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	w.WriteString(m.snapshot().record())
+	err = w.Flush()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		m.fs.Remove(tmpPath)
+		return err
+	}
+
+	return replaceFile(m.fs, tmpPath, path, m.syncWrites)
+}
+
+func newManifest(dir string, opts Options) *Manifest {
+	return &Manifest{
+		fs:             opts.FileSystem(),
+		dir:            dir,
+		nextFileNumber: 1,
+		tables:         make(map[int]TableMeta),
+		syncWrites:     opts.SyncPolicy >= SyncFlush,
+	}
+}
+
+// OpenManifest replays the manifest of the store in dir, creating an empty
+// one in the current table format if there is none, and compacts it down to
+// a single snapshot edit.
+func OpenManifest(dir string, opts Options) (*Manifest, error) {
+	m := newManifest(dir, opts)
+	path := ManifestPath(dir)
+	err := m.replay(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if os.IsNotExist(err) {
+		log.Infof("No manifest at %s, starting an empty store.", path)
+		m.format = TABLE_FORMAT
+	}
+
+	if err = m.rewrite(); err != nil {
+		log.Errorf("Could not write manifest %s. %v", path, err)
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// ReadManifest replays the manifest of the store in dir without writing to
+// it, for opening the store read only. A missing manifest is an error.
+func ReadManifest(dir string, opts Options) (*Manifest, error) {
+	m := newManifest(dir, opts)
+	if err := m.replay(ManifestPath(dir)); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// LogAndApply appends edit to the manifest and applies it to the current
+// version once it is written.
+func (m *Manifest) LogAndApply(edit VersionEdit) error {
+	if edit.NextFileNumber < m.nextFileNumber {
+		edit.NextFileNumber = m.nextFileNumber
+	}
+
+	path := ManifestPath(m.dir)
+	f, err := m.fs.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+	if _, err = io.WriteString(f, edit.record()); err != nil {
+		log.Errorf("Could not append to manifest %s. %v", path, err)
+		return err
+	}
+
+	if m.syncWrites {
+		if err = f.Sync(); err != nil {
+			log.Errorf("Could not sync manifest %s. %v", path, err)
+			return err
+		}
+	}
+
+	m.apply(edit)
+	return nil
+}
+
+// NewFileNumber reserves the next file number. It is recorded in the
+// manifest by the next edit.
+func (m *Manifest) NewFileNumber() int {
+	number := m.nextFileNumber
+	m.nextFileNumber += 1
+	return number
+}
+
+// Format is the table format of the store, zero for stores from before
+// formats were recorded.
+func (m *Manifest) Format() int {
+	return m.format
+}
+
+func (m *Manifest) NextFileNumber() int {
+	return m.nextFileNumber
+}
+
+func (m *Manifest) LastSequence() uint64 {
+	return m.lastSequence
+}
+
+func (m *Manifest) ValueLogNumber() int {
+	return m.valueLogNumber
+}
+
+// Tables returns the live tables of level, oldest first.
+func (m *Manifest) Tables(level int) []TableMeta {
+	var tables []TableMeta
+	for _, t := range m.tables {
+		if t.Level == level {
+			tables = append(tables, t)
+		}
+	}
+
+	sort.Slice(tables, func(i, j int) bool { return tables[i].Number < tables[j].Number })
+	return tables
+}
+
+// LiveFiles returns the names of the files in dir the current version
+// refers to.
+func (m *Manifest) LiveFiles() map[string]bool {
+	live := map[string]bool{MANIFEST_FILE: true}
+	for number := range m.tables {
+		live[filepath.Base(TableFileName(m.dir, number))] = true
+	}
+
+	if m.valueLogNumber > 0 {
+		live[filepath.Base(ValueLogFileName(m.dir, m.valueLogNumber))] = true
+	}
+
+	return live
+}
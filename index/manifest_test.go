@@ -0,0 +1,132 @@
+package index
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const MANIFEST_TEST_DIR string = "/db/manifest"
+
+func manifestOptions(t *testing.T) (*FaultFS, Options) {
+	fs := NewFaultFS()
+	if err := fs.MkdirAll(MANIFEST_TEST_DIR, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := DefaultOptions()
+	opts.FS = fs
+	return fs, opts
+}
+
+// logEdits records a flush into a fresh manifest followed by a compaction
+// of the flushed table into base table 3, and returns the manifest.
+func logEdits(t *testing.T, opts Options) *Manifest {
+	m, err := OpenManifest(MANIFEST_TEST_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	table, valueLog := m.NewFileNumber(), m.NewFileNumber()
+	edits := []VersionEdit{
+		{ValueLogNumber: valueLog, LastSequence: 5, Added: []TableMeta{{Level: 0, Number: table, Size: 10}}},
+		{Added: []TableMeta{{Level: 1, Number: m.NewFileNumber(), Size: 20}}, Removed: []int{table}},
+	}
+
+	for _, edit := range edits {
+		if err = m.LogAndApply(edit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return m
+}
+
+func checkManifest(t *testing.T, m *Manifest) {
+	if m.Format() != TABLE_FORMAT || m.LastSequence() != 5 || m.ValueLogNumber() != 2 || m.NextFileNumber() != 4 {
+		t.Fatalf("manifest holds format %d, sequence %d, value log %d and next file %d, want %d, 5, 2 and 4",
+			m.Format(), m.LastSequence(), m.ValueLogNumber(), m.NextFileNumber(), TABLE_FORMAT)
+	}
+
+	if len(m.Tables(0)) != 0 || !reflect.DeepEqual(m.Tables(1), []TableMeta{{Level: 1, Number: 3, Size: 20}}) {
+		t.Fatalf("manifest lists L0 tables %v and base %v", m.Tables(0), m.Tables(1))
+	}
+}
+
+func TestManifestReplaysEdits(t *testing.T) {
+	fs, opts := manifestOptions(t)
+	checkManifest(t, logEdits(t, opts))
+	replayed, err := ReadManifest(MANIFEST_TEST_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkManifest(t, replayed)
+	want := map[string]bool{MANIFEST_FILE: true, "000002.vlog": true, "000003.sst": true}
+	if live := replayed.LiveFiles(); !reflect.DeepEqual(live, want) {
+		t.Fatalf("manifest lists live files %v, want %v", live, want)
+	}
+
+	// opening snapshots the manifest, which replays to the same version
+	if _, err = OpenManifest(MANIFEST_TEST_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := readFile(fs, ManifestPath(MANIFEST_TEST_DIR))
+	if err != nil || strings.Count(string(data), "\n") != 1 {
+		t.Fatalf("opened manifest holds %q, %v, want a single edit", data, err)
+	}
+
+	if replayed, err = ReadManifest(MANIFEST_TEST_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	checkManifest(t, replayed)
+}
+
+func TestManifestSkipsTornFinalEdit(t *testing.T) {
+	fs, opts := manifestOptions(t)
+	m := logEdits(t, opts)
+	fs.Inject(Fault{Op: FaultWrite, Name: MANIFEST_FILE, Torn: true})
+	edit := VersionEdit{LastSequence: 9, Added: []TableMeta{{Level: 0, Number: m.NewFileNumber(), Size: 30}}}
+	if err := m.LogAndApply(edit); err == nil {
+		t.Fatal("torn manifest append did not fail")
+	}
+
+	if m.LastSequence() != 5 || len(m.Tables(0)) != 0 {
+		t.Fatal("manifest applied an edit it could not write")
+	}
+
+	data, err := readFile(fs, ManifestPath(MANIFEST_TEST_DIR))
+	if err != nil || strings.HasSuffix(string(data), "\n") {
+		t.Fatalf("manifest holds %q, %v, want a torn final edit", data, err)
+	}
+
+	replayed, err := ReadManifest(MANIFEST_TEST_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkManifest(t, replayed)
+	after := fs.Crash()
+	opts.FS = after
+	if replayed, err = ReadManifest(MANIFEST_TEST_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	checkManifest(t, replayed)
+
+	// an edit damaged before the last cannot be skipped
+	data, err = readFile(after, ManifestPath(MANIFEST_TEST_DIR))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	damaged := strings.Replace(string(data), "add", "abd", 1)
+	writeFaultFile(t, after, ManifestPath(MANIFEST_TEST_DIR), damaged+edit.record(), true)
+	if _, err = ReadManifest(MANIFEST_TEST_DIR, opts); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("manifest damaged before its last edit replayed with %v", err)
+	}
+}
@@ -0,0 +1,256 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MERGE_COMMAND string = "merge"
+	MERGE_SUFFIX  string = "m"
+)
+
+// ErrNoMergeOperator is returned by merges, and by reads of keys with merge
+// operands, when the options name no merge operator.
+var ErrNoMergeOperator = errors.New("no merge operator")
+
+// MergeOperator folds the operands written by merges onto the value of a
+// key, so updates such as adding to a counter need no read before the write.
+type MergeOperator interface {
+	// Name identifies the operator in the registry.
+	Name() string
+	// FullMerge applies operands, oldest first, to the existing value of
+	// key, which is absent if exists is false.
+	FullMerge(key string, existing string, exists bool, operands []string) (string, error)
+}
+
+var (
+	mergeOperatorsMu sync.Mutex
+	mergeOperators   = make(map[string]MergeOperator)
+)
+
+// RegisterMergeOperator makes op available to options by its name,
+// replacing any operator registered under the same name.
+func RegisterMergeOperator(op MergeOperator) {
+	mergeOperatorsMu.Lock()
+	defer mergeOperatorsMu.Unlock()
+
+	mergeOperators[op.Name()] = op
+}
+
+// LookupMergeOperator returns the merge operator registered as name.
+func LookupMergeOperator(name string) (MergeOperator, bool) {
+	mergeOperatorsMu.Lock()
+	defer mergeOperatorsMu.Unlock()
+
+	op, ok := mergeOperators[name]
+	return op, ok
+}
+
+func init() {
+	RegisterMergeOperator(Int64AddOperator{})
+	RegisterMergeOperator(StringAppendOperator{","})
+}
+
+// Int64AddOperator adds decimal integer operands to a decimal integer value,
+// taking a missing value as zero.
+type Int64AddOperator struct{}
+
+func (Int64AddOperator) Name() string {
+	return "int64add"
+}
+
+func (Int64AddOperator) FullMerge(key string, existing string, exists bool, operands []string) (string, error) {
+	var sum int64
+	if exists {
+		n, err := strconv.ParseInt(existing, 10, 64)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Value %q of %s is not an integer", existing, key))
+		}
+
+		sum = n
+	}
+
+	for _, operand := range operands {
+		n, err := strconv.ParseInt(operand, 10, 64)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("Operand %q for %s is not an integer", operand, key))
+		}
+
+		sum += n
+	}
+
+	return strconv.FormatInt(sum, 10), nil
+}
+
+// StringAppendOperator appends operands to a value, separated by Delimiter.
+type StringAppendOperator struct {
+	Delimiter string
+}
+
+func (StringAppendOperator) Name() string {
+	return "stringappend"
+}
+
+func (o StringAppendOperator) FullMerge(key string, existing string, exists bool, operands []string) (string, error) {
+	parts := operands
+	if exists {
+		parts = append([]string{existing}, operands...)
+	}
+
+	return strings.Join(parts, o.Delimiter), nil
+}
+
+// encodeOperand writes operand prefixed by its length, so operands of a key
+// are kept together by concatenating them.
+func encodeOperand(operand string) string {
+	return fmt.Sprintf("%d:%s", len(operand), operand)
+}
+
+func decodeOperands(s string) ([]string, error) {
+	var operands []string
+	for s != "" {
+		i := strings.IndexByte(s, ':')
+		if i < 0 {
+			return nil, errors.New(fmt.Sprintf("Malformed merge operands %q", s))
+		}
+
+		n, err := strconv.Atoi(s[:i])
+		if err != nil || n < 0 || n > len(s)-i-1 {
+			return nil, errors.New(fmt.Sprintf("Bad merge operand length %q", s[:i]))
+		}
+
+		operands = append(operands, s[i+1:i+1+n])
+		s = s[i+1+n:]
+	}
+
+	return operands, nil
+}
+
+// NewMergeCommand returns the memtable command recording operand for key
+// over older, the entry the memtable already holds for key. Operands over a
+// value or a delete are folded into a put at once, while operands over
+// nothing are kept to be folded onto the entries of the tables, once the
+// operator has taken them on their own.
+func NewMergeCommand(opts Options, key string, operand string, older Entry) (Command, error) {
+	op := opts.mergeOperator()
+	if op == nil {
+		return Command{}, ErrNoMergeOperator
+	}
+
+	if !older.Found || older.Operand {
+		if _, err := op.FullMerge(key, "", false, []string{operand}); err != nil {
+			return Command{}, err
+		}
+
+		item := NewKeyValueItem(key, older.Value+encodeOperand(operand))
+		return Command{Type: MERGE_COMMAND, Item: item}, nil
+	}
+
+	m := NewMerger(opts, key)
+	m.Add(Entry{Value: encodeOperand(operand), Operand: true, Found: true})
+	m.Add(older)
+	value, _, err := m.Result()
+	return Command{Type: PUT_COMMAND, Item: NewKeyValueItem(key, value)}, err
+}
+
+// Merger works out the value of a key from its entries, given to Add newest
+// first, folding the merge operands of the newest entries onto the first
+// value or delete below them. Values expired when the Merger was made count
+// as deletes.
+type Merger struct {
+	op  MergeOperator
+	key string
+	// now is the time values are expired by.
+	now time.Time
+	// operands are those found so far, oldest first.
+	operands []string
+	done     bool
+	value    string
+	exists   bool
+	err      error
+}
+
+func NewMerger(opts Options, key string) *Merger {
+	return &Merger{op: opts.mergeOperator(), key: key, now: opts.Now()}
+}
+
+// Add takes the next older entry of the key and reports whether the value
+// is settled, so older entries no longer matter.
+func (m *Merger) Add(e Entry) bool {
+	if m.done || !e.Found {
+		return m.done
+	}
+
+	if Expired(e.ExpiresAt, m.now) {
+		m.done, m.value, m.exists = true, "", false
+		return true
+	}
+
+	if !e.Operand {
+		m.done, m.value, m.exists = true, e.Value, !e.Deleted
+		return true
+	}
+
+	operands, err := decodeOperands(e.Value)
+	if err != nil {
+		m.done, m.err = true, err
+		return true
+	}
+
+	m.operands = append(operands, m.operands...)
+	return false
+}
+
+// Done reports whether the value is settled.
+func (m *Merger) Done() bool {
+	return m.done
+}
+
+// Result returns the value of the key, folding any operands found onto the
+// value below them. Operands over nothing are folded onto a missing value.
+func (m *Merger) Result() (value string, found bool, err error) {
+	if m.err != nil || len(m.operands) == 0 {
+		return m.value, m.exists, m.err
+	}
+
+	if m.op == nil {
+		return "", false, ErrNoMergeOperator
+	}
+
+	value, err = m.op.FullMerge(m.key, m.value, m.exists, m.operands)
+	if err != nil {
+		return "", false, err
+	}
+
+	return value, true, nil
+}
+
+// foldOperands folds the encoded operands of key onto the item items holds
+// for it, leaving a plain item in its place. Operands the operator fails to
+// fold fail the compaction, as the item cannot hold both them and the value
+// below them.
+func foldOperands(valueLog DataLog, opts Options, items map[string]KeyValueItem, key string, operands string) error {
+	m := NewMerger(opts, key)
+	m.Add(Entry{Value: operands, Operand: true, Found: true})
+	if old, ok := items[key]; ok {
+		value, err := readValue(valueLog, old)
+		if err != nil {
+			return err
+		}
+
+		m.Add(Entry{Value: value, ExpiresAt: old.ExpiresAt(), Found: true})
+	}
+
+	value, _, err := m.Result()
+	if err != nil {
+		return errors.New(fmt.Sprintf("Could not fold merge operands of %s. %v", key, err))
+	}
+
+	items[key] = NewKeyValueItem(key, value)
+	return nil
+}
@@ -0,0 +1,82 @@
+package index
+
+import (
+	"context"
+	"sync"
+)
+
+// MULTI_GET_READERS is the most blocks a MultiGet reads at once.
+const MULTI_GET_READERS int = 8
+
+// Entry is what a table or memtable holds for a key.
+type Entry struct {
+	Value   string
+	Deleted bool
+	// Operand marks Value as merge operands to fold onto older entries.
+	Operand bool
+	// ExpiresAt is when a value expires in nanoseconds since the epoch, or
+	// zero if it never does. An expired value reads as deleted.
+	ExpiresAt int64
+	Found     bool
+}
+
+// MultiGet looks keys up, returning their entries in the order of keys.
+// Each block that can hold any of the keys is read once, with up to
+// MULTI_GET_READERS blocks read in parallel.
+func (s *SsBlockStorage) MultiGet(ctx context.Context, keys []string) ([]Entry, error) {
+	entries := make([]Entry, len(keys))
+	// groups holds the positions in keys of the keys each block can hold
+	groups := make(map[int64][]int)
+	offsets := make([]int64, 0)
+	for i, key := range keys {
+		if len(s.index) == 0 || key < s.index[0] || (s.filter != nil && !s.filter.MayContain(key)) {
+			continue
+		}
+
+		offset := searchIndex(s.index, key)
+		if _, ok := groups[offset]; !ok {
+			offsets = append(offsets, offset)
+		}
+
+		groups[offset] = append(groups[offset], i)
+	}
+
+	errs := make([]error, len(offsets))
+	readers := make(chan struct{}, MULTI_GET_READERS)
+	var wg sync.WaitGroup
+	for n, offset := range offsets {
+		wg.Add(1)
+		go func(n int, offset int64) {
+			defer wg.Done()
+			readers <- struct{}{}
+			defer func() { <-readers }()
+
+			if errs[n] = ctx.Err(); errs[n] != nil {
+				return
+			}
+
+			block, err := s.blockAt(offset)
+			if err != nil {
+				errs[n] = err
+				return
+			}
+
+			for _, i := range groups[offset] {
+				entries[i], err = block.GetEntry(keys[i])
+				if err != nil {
+					errs[n] = err
+					return
+				}
+			}
+		}(n, offset)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
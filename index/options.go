@@ -0,0 +1,309 @@
+package index
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_STORAGE_DIR      string = "storage"
+	DEFAULT_MEMTABLE_BYTES   int64  = 16 << 20
+	DEFAULT_BLOCK_CACHE_SIZE int    = 256
+	DEFAULT_BLOOM_BITS       int    = 10
+	DEFAULT_PENDING_FLUSHES  int    = 2
+	DEFAULT_L0_COMPACTION    int    = 4
+	DEFAULT_L0_SLOWDOWN      int    = 8
+	DEFAULT_L0_STOP          int    = 12
+	DEFAULT_SOFT_PENDING     int64  = 64 << 20
+	DEFAULT_HARD_PENDING     int64  = 256 << 20
+	DEFAULT_SLOWDOWN_MICROS  int64  = 1000
+	DEFAULT_MAX_WAL_BYTES    int64  = 64 << 20
+)
+
+type CompressionType int
+
+const (
+	NoCompression CompressionType = iota
+	FlateCompression
+)
+
+var compressionNames = []string{"none", "flate"}
+
+func (c CompressionType) String() string {
+	if int(c) < len(compressionNames) {
+		return compressionNames[c]
+	}
+
+	return fmt.Sprintf("CompressionType(%d)", int(c))
+}
+
+func (c CompressionType) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+func (c *CompressionType) UnmarshalText(text []byte) error {
+	for i, name := range compressionNames {
+		if strings.EqualFold(string(text), name) {
+			*c = CompressionType(i)
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Unknown compression %q", string(text)))
+}
+
+// SyncPolicy decides when written data is fsynced to disk.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves writes to the operating system, so a crash may lose
+	// or corrupt recently written tables.
+	SyncNone SyncPolicy = iota
+	// SyncFlush syncs each new sstable, the manifest and the value log once
+	// a flush is written, the directory once files are renamed into place,
+	// and the write ahead log of column families after every batch.
+	SyncFlush
+	// SyncAlways also syncs the value log after every appended value.
+	SyncAlways
+)
+
+var syncPolicyNames = []string{"none", "flush", "always"}
+
+func (p SyncPolicy) String() string {
+	if int(p) < len(syncPolicyNames) {
+		return syncPolicyNames[p]
+	}
+
+	return fmt.Sprintf("SyncPolicy(%d)", int(p))
+}
+
+func (p SyncPolicy) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+func (p *SyncPolicy) UnmarshalText(text []byte) error {
+	for i, name := range syncPolicyNames {
+		if strings.EqualFold(string(text), name) {
+			*p = SyncPolicy(i)
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("Unknown sync policy %q", string(text)))
+}
+
+// Options tunes a store and the sstables beneath it.
+type Options struct {
+	// StorageDir is the directory store files are kept in.
+	StorageDir string
+	// FS is the filesystem store files are kept in, nil uses the operating
+	// system's.
+	FS FS `json:"-"`
+	// BlockSizeBytes is the size sstable blocks are filled up to.
+	BlockSizeBytes int64
+	// MemTableBytes is the approximate memory in bytes the memtable may use
+	// before it is flushed into an sstable.
+	MemTableBytes int64
+	// WriteBufferManager, when set, caps memtable memory across every store
+	// sharing it by flushing the store holding the most once it is used up.
+	WriteBufferManager *WriteBufferManager `json:"-"`
+	// WriteBufferSize is the budget in bytes of the write buffer manager
+	// created when none is given, zero leaves memtables uncapped.
+	WriteBufferSize int64
+	// BlockCacheSize is the number of blocks cached per sstable.
+	BlockCacheSize int
+	// BloomBitsPerKey sizes each sstable's bloom filter, zero disables it.
+	BloomBitsPerKey int
+	// PrefixExtractor, when set, adds a bloom filter of key prefixes to each
+	// sstable so prefix scans skip tables without the prefix.
+	PrefixExtractor PrefixExtractor `json:"-"`
+	// PrefixLength extracts prefixes of this many bytes when no
+	// PrefixExtractor is given, zero disables prefix filters.
+	PrefixLength int
+	// MergeOperator folds the operands written by merges onto the values of
+	// their keys.
+	MergeOperator MergeOperator `json:"-"`
+	// MergeOperatorName picks a registered merge operator when no
+	// MergeOperator is given, such as int64add or stringappend.
+	MergeOperatorName string
+	// Clock tells the time entries with a TTL count from and expire by, nil
+	// uses the system clock.
+	Clock Clock `json:"-"`
+	// Compression is applied to each sstable block.
+	Compression CompressionType
+	// SyncPolicy decides when writes are fsynced.
+	SyncPolicy SyncPolicy
+	// ValueThreshold is the value length in bytes above which values are
+	// kept in the value log, zero keeps every value inline.
+	ValueThreshold int64
+	// MaxPendingFlushes is the number of full memtables that may wait for a
+	// background flush before writes stop.
+	MaxPendingFlushes int
+	// PendingFlushesSlowdownTrigger is the number of full memtables waiting
+	// for a background flush at which each write is delayed by
+	// SlowdownDelayMicros. Zero, the default, disables the slowdown.
+	PendingFlushesSlowdownTrigger int
+	// L0CompactionTrigger is the number of L0 tables that starts a
+	// compaction into the base sstable.
+	L0CompactionTrigger int
+	// L0SlowdownWritesTrigger is the number of L0 tables at which each write
+	// is delayed by SlowdownDelayMicros.
+	L0SlowdownWritesTrigger int
+	// L0StopWritesTrigger is the number of L0 tables at which writes stop
+	// until compaction catches up.
+	L0StopWritesTrigger int
+	// SoftPendingCompactionBytes is the size of L0 tables awaiting
+	// compaction at which writes are delayed, zero disables.
+	SoftPendingCompactionBytes int64
+	// HardPendingCompactionBytes is the size of L0 tables awaiting
+	// compaction at which writes stop, zero disables.
+	HardPendingCompactionBytes int64
+	// SlowdownDelayMicros is how long a write is delayed while slowed down.
+	SlowdownDelayMicros int64
+	// MaxWalBytes is the size the write ahead log shared by column families
+	// grows to before every family is flushed and the log started afresh.
+	MaxWalBytes int64
+	// ReadOnly opens stores for reading, alongside the process writing
+	// them if there is one. They never flush, compact or delete files.
+	ReadOnly bool
+}
+
+func DefaultOptions() Options {
+	return Options{
+		StorageDir:                 DEFAULT_STORAGE_DIR,
+		BlockSizeBytes:             BlockSizeBytes,
+		MemTableBytes:              DEFAULT_MEMTABLE_BYTES,
+		BlockCacheSize:             DEFAULT_BLOCK_CACHE_SIZE,
+		BloomBitsPerKey:            DEFAULT_BLOOM_BITS,
+		Compression:                NoCompression,
+		SyncPolicy:                 SyncFlush,
+		ValueThreshold:             DEFAULT_VALUE_THRESHOLD,
+		MaxPendingFlushes:          DEFAULT_PENDING_FLUSHES,
+		L0CompactionTrigger:        DEFAULT_L0_COMPACTION,
+		L0SlowdownWritesTrigger:    DEFAULT_L0_SLOWDOWN,
+		L0StopWritesTrigger:        DEFAULT_L0_STOP,
+		SoftPendingCompactionBytes: DEFAULT_SOFT_PENDING,
+		HardPendingCompactionBytes: DEFAULT_HARD_PENDING,
+		SlowdownDelayMicros:        DEFAULT_SLOWDOWN_MICROS,
+		MaxWalBytes:                DEFAULT_MAX_WAL_BYTES,
+	}
+}
+
+// LoadOptions reads options from a json config file. Settings missing from
+// the file keep their default values.
+func LoadOptions(filePath string) (Options, error) {
+	opts := DefaultOptions()
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return opts, err
+	}
+
+	if err = json.Unmarshal(data, &opts); err != nil {
+		return opts, errors.New(fmt.Sprintf("Could not parse config file %s: %v", filePath, err))
+	}
+
+	return opts, opts.Validate()
+}
+
+// FileSystem returns the filesystem store files are kept in.
+func (o Options) FileSystem() FS {
+	if o.FS == nil {
+		return OSFS{}
+	}
+
+	return o.FS
+}
+
+// Now returns the time of the options' clock.
+func (o Options) Now() time.Time {
+	if o.Clock == nil {
+		return systemClock{}.Now()
+	}
+
+	return o.Clock.Now()
+}
+
+// prefixExtractor returns the extractor prefix filters are built with, or
+// nil if there are none.
+func (o Options) prefixExtractor() PrefixExtractor {
+	if o.PrefixExtractor != nil {
+		return o.PrefixExtractor
+	}
+
+	if o.PrefixLength > 0 {
+		return FixedPrefix(o.PrefixLength)
+	}
+
+	return nil
+}
+
+// mergeOperator returns the operator merge operands are folded with, or nil
+// if there is none.
+func (o Options) mergeOperator() MergeOperator {
+	if o.MergeOperator != nil {
+		return o.MergeOperator
+	}
+
+	op, _ := LookupMergeOperator(o.MergeOperatorName)
+	return op
+}
+
+// syncFiles reports whether new files are fsynced before they are renamed
+// into place.
+func (o Options) syncFiles() bool {
+	return o.SyncPolicy >= SyncFlush
+}
+
+func (o Options) Validate() error {
+	switch {
+	case o.BlockSizeBytes <= 0:
+		return errors.New(fmt.Sprintf("Block size must be positive, got %d", o.BlockSizeBytes))
+	case o.MemTableBytes <= 0:
+		return errors.New(fmt.Sprintf("Memtable bytes must be positive, got %d", o.MemTableBytes))
+	case o.WriteBufferSize < 0:
+		return errors.New(fmt.Sprintf("Write buffer size cannot be negative, got %d", o.WriteBufferSize))
+	case o.BlockCacheSize <= 0:
+		return errors.New(fmt.Sprintf("Block cache size must be positive, got %d", o.BlockCacheSize))
+	case o.BloomBitsPerKey < 0:
+		return errors.New(fmt.Sprintf("Bloom bits per key cannot be negative, got %d", o.BloomBitsPerKey))
+	case o.PrefixLength < 0:
+		return errors.New(fmt.Sprintf("Prefix length cannot be negative, got %d", o.PrefixLength))
+	case o.MergeOperator == nil && o.MergeOperatorName != "" && o.mergeOperator() == nil:
+		return errors.New(fmt.Sprintf("Unknown merge operator %q", o.MergeOperatorName))
+	case o.ValueThreshold < 0:
+		return errors.New(fmt.Sprintf("Value threshold cannot be negative, got %d", o.ValueThreshold))
+	case int(o.Compression) >= len(compressionNames) || o.Compression < 0:
+		return errors.New(fmt.Sprintf("Unknown compression %s", o.Compression))
+	case int(o.SyncPolicy) >= len(syncPolicyNames) || o.SyncPolicy < 0:
+		return errors.New(fmt.Sprintf("Unknown sync policy %s", o.SyncPolicy))
+	case o.MaxPendingFlushes < 1:
+		return errors.New(fmt.Sprintf("Max pending flushes must be at least 1, got %d", o.MaxPendingFlushes))
+	case o.PendingFlushesSlowdownTrigger < 0 || o.PendingFlushesSlowdownTrigger > o.MaxPendingFlushes:
+		return errors.New(fmt.Sprintf("Pending flushes slowdown trigger must be between 0 and %d, got %d",
+			o.MaxPendingFlushes, o.PendingFlushesSlowdownTrigger))
+	case o.L0CompactionTrigger < 1:
+		return errors.New(fmt.Sprintf("L0 compaction trigger must be at least 1, got %d", o.L0CompactionTrigger))
+	case o.L0SlowdownWritesTrigger < o.L0CompactionTrigger:
+		return errors.New(fmt.Sprintf("L0 slowdown trigger %d is below the compaction trigger %d",
+			o.L0SlowdownWritesTrigger, o.L0CompactionTrigger))
+	case o.L0StopWritesTrigger < o.L0SlowdownWritesTrigger:
+		return errors.New(fmt.Sprintf("L0 stop trigger %d is below the slowdown trigger %d",
+			o.L0StopWritesTrigger, o.L0SlowdownWritesTrigger))
+	case o.SoftPendingCompactionBytes < 0 || o.HardPendingCompactionBytes < 0:
+		return errors.New("Pending compaction bytes limits cannot be negative")
+	case o.SoftPendingCompactionBytes > 0 && o.HardPendingCompactionBytes > 0 &&
+		o.HardPendingCompactionBytes < o.SoftPendingCompactionBytes:
+		return errors.New(fmt.Sprintf("Hard pending compaction bytes %d is below the soft limit %d",
+			o.HardPendingCompactionBytes, o.SoftPendingCompactionBytes))
+	case o.SlowdownDelayMicros < 0:
+		return errors.New(fmt.Sprintf("Slowdown delay cannot be negative, got %d", o.SlowdownDelayMicros))
+	case o.MaxWalBytes <= 0:
+		return errors.New(fmt.Sprintf("Max write ahead log bytes must be positive, got %d", o.MaxWalBytes))
+	}
+
+	return nil
+}
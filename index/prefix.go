@@ -0,0 +1,88 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+)
+
+const PREFIX_BLOOM_RECORD string = "prefix_bloom"
+
+// PrefixExtractor maps keys to the prefixes held by the prefix bloom filter
+// of each sstable. Every key starting with a prefix the extractor returns
+// must have that same prefix.
+type PrefixExtractor interface {
+	// Name identifies the extractor, so filters built by another are not
+	// used.
+	Name() string
+	// Prefix returns the prefix of key, or false if key has none.
+	Prefix(key string) (prefix string, ok bool)
+}
+
+// FixedPrefix extracts the first n bytes of keys at least n bytes long.
+type FixedPrefix int
+
+func (p FixedPrefix) Name() string {
+	return fmt.Sprintf("fixed:%d", int(p))
+}
+
+func (p FixedPrefix) Prefix(key string) (string, bool) {
+	if len(key) < int(p) {
+		return "", false
+	}
+
+	return key[:p], true
+}
+
+// PrefixFilter answers whether an sstable may hold keys with a prefix, so
+// prefix scans can skip the table.
+type PrefixFilter struct {
+	// extractor is the name of the extractor the prefixes came from.
+	extractor string
+	*BloomFilter
+}
+
+func NewPrefixFilter(keys []string, extractor PrefixExtractor, bitsPerKey int) *PrefixFilter {
+	prefixes := make([]string, 0)
+	for _, key := range keys {
+		prefix, ok := extractor.Prefix(key)
+		if ok && (len(prefixes) == 0 || prefixes[len(prefixes)-1] != prefix) {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	return &PrefixFilter{extractor.Name(), NewBloomFilter(prefixes, bitsPerKey)}
+}
+
+func (f *PrefixFilter) record() []string {
+	return append([]string{PREFIX_BLOOM_RECORD, f.extractor}, f.BloomFilter.record()[1:]...)
+}
+
+func parsePrefixFilter(record []string) (*PrefixFilter, error) {
+	if len(record) != 4 || record[0] != PREFIX_BLOOM_RECORD {
+		return nil, errors.New(fmt.Sprintf("Malformed prefix bloom filter record of %d fields", len(record)))
+	}
+
+	filter, err := parseBloomFilter([]string{BLOOM_RECORD, record[2], record[3]})
+	if err != nil {
+		return nil, err
+	}
+
+	return &PrefixFilter{record[1], filter}, nil
+}
+
+// MayContainPrefix reports whether the table may hold keys starting with
+// prefix. Only a prefix filter built by the extractor of the table's options
+// can rule a prefix out.
+func (s *SsBlockStorage) MayContainPrefix(prefix string) bool {
+	if len(s.index) == 0 {
+		return false
+	}
+
+	extractor := s.opts.prefixExtractor()
+	if s.prefixFilter == nil || extractor == nil || s.prefixFilter.extractor != extractor.Name() {
+		return true
+	}
+
+	p, ok := extractor.Prefix(prefix)
+	return !ok || s.prefixFilter.MayContain(p)
+}
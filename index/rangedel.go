@@ -0,0 +1,83 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	DELRANGE_COMMAND string = "delrange"
+	RANGE_DEL_RECORD string = "range_del"
+)
+
+// RangeTombstone deletes the keys from Start up to but not including End
+// that were written before it.
+type RangeTombstone struct {
+	Start string
+	End   string
+}
+
+func (t RangeTombstone) Covers(key string) bool {
+	return t.Start <= key && key < t.End
+}
+
+// RangeTombstones are the range deletions of a memtable or sstable. They
+// only hide older entries, never those of the memtable or table holding
+// them, which are always newer.
+type RangeTombstones []RangeTombstone
+
+func (ts RangeTombstones) Covers(key string) bool {
+	for _, t := range ts {
+		if t.Covers(key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewRangeDeleteCommand returns the memtable command that flushes as a range
+// tombstone from start up to end.
+func NewRangeDeleteCommand(start string, end string) Command {
+	return Command{Type: DELRANGE_COMMAND, Item: NewKeyValueItem(start, end)}
+}
+
+func (ts RangeTombstones) record() []string {
+	record := make([]string, 0, 2*len(ts)+1)
+	record = append(record, RANGE_DEL_RECORD)
+	for _, t := range ts {
+		record = append(record, t.Start, t.End)
+	}
+
+	return record
+}
+
+func parseRangeTombstones(record []string) (RangeTombstones, error) {
+	if len(record)%2 != 1 || record[0] != RANGE_DEL_RECORD {
+		return nil, errors.New(fmt.Sprintf("Malformed range tombstone record of %d fields", len(record)))
+	}
+
+	ts := make(RangeTombstones, 0, len(record)/2)
+	for i := 1; i < len(record); i += 2 {
+		if record[i] >= record[i+1] {
+			return nil, errors.New(fmt.Sprintf("Empty range tombstone from %q to %q", record[i], record[i+1]))
+		}
+
+		ts = append(ts, RangeTombstone{record[i], record[i+1]})
+	}
+
+	return ts, nil
+}
+
+func (s *SsBlockStorage) RangeTombstones() RangeTombstones {
+	return s.rangeTombstones
+}
+
+// deleteRange removes the items t covers from items.
+func deleteRange(items map[string]KeyValueItem, t RangeTombstone) {
+	for key := range items {
+		if t.Covers(key) {
+			delete(items, key)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"io"
+)
+
+// recordReader reads the csv records of sstables and value logs as a
+// csv.Writer wrote them. Unlike a csv.Reader it keeps carriage returns in
+// quoted fields, which a csv.Reader drops before a newline, so keys and
+// values holding "\r\n" read back as written. Empty lines are skipped.
+type recordReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func newRecordReader(r io.Reader) *recordReader {
+	return &recordReader{r: bufio.NewReader(r)}
+}
+
+func (rr *recordReader) parseError(start int, err error) error {
+	return &csv.ParseError{StartLine: start, Line: rr.line, Err: err}
+}
+
+// Read returns the next record, or io.EOF once there are none. Malformed
+// quoting is reported as a *csv.ParseError.
+func (rr *recordReader) Read() ([]string, error) {
+	for {
+		c, err := rr.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+
+		if c != '\n' {
+			rr.r.UnreadByte()
+			return rr.readRecord(rr.line + 1)
+		}
+
+		rr.line += 1
+	}
+}
+
+func (rr *recordReader) readRecord(start int) ([]string, error) {
+	var record []string
+	var field bytes.Buffer
+	for {
+		field.Reset()
+		c, err := rr.r.ReadByte()
+		quoted := err == nil && c == '"'
+		if err == nil && !quoted {
+			rr.r.UnreadByte()
+		}
+
+		if quoted {
+			if err = rr.readQuoted(&field, start); err != nil {
+				return nil, err
+			}
+		}
+
+		c, err = rr.readUnquoted(&field, start, quoted)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+
+		record = append(record, field.String())
+		if err == io.EOF || c == '\n' {
+			return record, nil
+		}
+	}
+}
+
+// readQuoted reads a quoted field up to its closing quote.
+func (rr *recordReader) readQuoted(field *bytes.Buffer, start int) error {
+	for {
+		c, err := rr.r.ReadByte()
+		if err != nil {
+			return rr.parseError(start, csv.ErrQuote)
+		}
+
+		if c == '\n' {
+			rr.line += 1
+		}
+
+		if c != '"' {
+			field.WriteByte(c)
+			continue
+		}
+
+		c, err = rr.r.ReadByte()
+		if err != nil || c != '"' {
+			if err == nil {
+				rr.r.UnreadByte()
+			}
+
+			return nil
+		}
+
+		field.WriteByte('"')
+	}
+}
+
+// readUnquoted reads the rest of a field up to the comma or newline ending
+// it, which it returns, or io.EOF at the end of the input. Nothing may
+// follow the closing quote of a quoted field. A carriage return before the
+// newline ending a record is dropped, as csv.Reader does.
+func (rr *recordReader) readUnquoted(field *bytes.Buffer, start int, quoted bool) (byte, error) {
+	trimReturn := func() {
+		if !quoted && bytes.HasSuffix(field.Bytes(), []byte("\r")) {
+			field.Truncate(field.Len() - 1)
+		}
+	}
+
+	for {
+		c, err := rr.r.ReadByte()
+		switch {
+		case err != nil:
+			trimReturn()
+			return 0, err
+		case c == ',':
+			return c, nil
+		case c == '\n':
+			rr.line += 1
+			trimReturn()
+			return c, nil
+		case quoted:
+			return 0, rr.parseError(start, csv.ErrQuote)
+		case c == '"':
+			return 0, rr.parseError(start, csv.ErrBareQuote)
+		}
+
+		field.WriteByte(c)
+	}
+}
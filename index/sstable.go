@@ -1,8 +1,10 @@
 package index
 
 import (
-	"crypto/sha1"
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"github.com/elliotchance/orderedmap"
 	lru "github.com/hashicorp/golang-lru"
@@ -11,14 +13,19 @@ import (
 	"os"
 	"sort"
 	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
-	BlockSizeBytes int64  = 4000
-	KeySizeChar    int    = 8
-	GET_COMMAND    string = "get"
-	PUT_COMMAND    string = "put"
-	DEL_COMMAND    string = "del"
+	BlockSizeBytes     int64  = 4000
+	GET_COMMAND        string = "get"
+	PUT_COMMAND        string = "put"
+	DEL_COMMAND        string = "del"
+	EMPTY_INDEX_RECORD string = "empty"
+	// FOOTER_RECORDS is the most records an sstable keeps after its blocks.
+	FOOTER_RECORDS int = 4
 )
 
 type Command struct {
@@ -26,23 +33,36 @@ type Command struct {
 	Item KeyValueItem
 }
 
-func keyHash(key string) string {
-	h := sha1.New()
-	h.Write([]byte(key))
-	b := h.Sum(nil)
-	hashString := fmt.Sprintf("%x", b)
-	return hashString[0:KeySizeChar]
-}
+type itemKind int
 
-type KeyValueItem struct {
-	key     string
-	keyHash string
-	value   string
-	size    int64
+const (
+	valueItem itemKind = iota
+	pointerItem
+	tombstoneItem
+	operandItem
+)
+
+// itemKindSuffixes mark an item's kind on the size field of its record.
+var itemKindSuffixes = []string{"", VALUE_POINTER_SUFFIX, TOMBSTONE_SUFFIX, MERGE_SUFFIX}
+
+func parseItemKind(sizeField string) (kind itemKind, size string) {
+	for k, suffix := range itemKindSuffixes {
+		if suffix != "" && strings.HasSuffix(sizeField, suffix) {
+			return itemKind(k), strings.TrimSuffix(sizeField, suffix)
+		}
+	}
+
+	return valueItem, sizeField
 }
 
-func (k *KeyValueItem) KeyHash() string {
-	return k.keyHash
+type KeyValueItem struct {
+	key   string
+	value string
+	size  int64
+	kind  itemKind
+	// expiresAt is when the item expires in nanoseconds since the epoch, or
+	// zero if it never does.
+	expiresAt int64
 }
 
 func (k *KeyValueItem) Key() string {
@@ -57,17 +77,40 @@ func (k *KeyValueItem) Size() int64 {
 	return k.size
 }
 
+// Separated reports whether Value holds a pointer into the value log rather
+// than the value itself.
+func (k *KeyValueItem) Separated() bool {
+	return k.kind == pointerItem
+}
+
+// Deleted reports whether the item is a tombstone hiding older values of its
+// key.
+func (k *KeyValueItem) Deleted() bool {
+	return k.kind == tombstoneItem
+}
+
+// Operand reports whether Value holds merge operands to fold onto older
+// values of the key rather than a value.
+func (k *KeyValueItem) Operand() bool {
+	return k.kind == operandItem
+}
+
 func NewKeyValueItem(key string, value string) KeyValueItem {
-	s := KeySizeChar + len([]byte(value))
-	size := int64(s)
-	kh := keyHash(key)
-	return KeyValueItem{key, kh, value, size}
+	size := int64(len([]byte(key)) + len([]byte(value)))
+	return KeyValueItem{key, value, size, valueItem, 0}
+}
+
+func newTombstoneItem(key string) KeyValueItem {
+	kv := NewKeyValueItem(key, "")
+	kv.kind = tombstoneItem
+	return kv
 }
 
 type Block struct {
 	blockKey string
 	items    orderedmap.OrderedMap
 	size     int64
+	valueLog DataLog
 }
 
 func (b *Block) BlockKey() string {
@@ -86,36 +129,52 @@ func (b *Block) Keys() []string {
 	return keys
 }
 
-func (b *Block) GetH(key string) (value string, ok bool) {
-	hk := key
-	v, ok := b.items.Get(hk)
-	var kv KeyValueItem
-	if ok {
-		log.Info("Key found in block")
-		kv, ok = v.(KeyValueItem)
-	}
-
-	if ok {
-		value = kv.Value()
+// entries returns the items of the block in key order.
+func (b *Block) entries() []KeyValueItem {
+	items := make([]KeyValueItem, 0, b.items.Len())
+	for el := b.items.Front(); el != nil; el = el.Next() {
+		if kv, ok := el.Value.(KeyValueItem); ok {
+			items = append(items, kv)
+		}
 	}
 
-	return value, ok
+	return items
 }
 
-func (b *Block) Get(key string) (value string, ok bool) {
-	hk := keyHash(key)
-	v, ok := b.items.Get(hk)
-	var kv KeyValueItem
+func (b *Block) item(key string) (kv KeyValueItem, ok bool) {
+	v, ok := b.items.Get(key)
 	if ok {
 		log.Info("Key found in block")
 		kv, ok = v.(KeyValueItem)
 	}
 
-	if ok {
-		value = kv.Value()
+	return kv, ok
+}
+
+// GetEntry looks up key in the block, reporting a tombstone for the key
+// as deleted rather than missing and merge operands as they are stored.
+func (b *Block) GetEntry(key string) (e Entry, err error) {
+	kv, ok := b.item(key)
+	if !ok {
+		return e, nil
+	}
+
+	if kv.Deleted() || kv.Operand() {
+		return Entry{Value: kv.Value(), Deleted: kv.Deleted(), Operand: kv.Operand(), Found: true}, nil
+	}
+
+	value, err := readValue(b.valueLog, kv)
+	if err != nil {
+		log.Errorf("Could not read value for %s from value log. %v", key, err)
+		return e, err
 	}
 
-	return value, ok
+	return Entry{Value: value, ExpiresAt: kv.ExpiresAt(), Found: true}, nil
+}
+
+func (b *Block) Get(key string) (value string, ok bool, err error) {
+	e, err := b.GetEntry(key)
+	return e.Value, e.Found && !e.Deleted, err
 }
 
 func (b *Block) Size() int64 {
@@ -123,37 +182,64 @@ func (b *Block) Size() int64 {
 }
 
 func NewBlock(blockKey string, items orderedmap.OrderedMap) Block {
-	return Block{blockKey, items, BlockSizeBytes}
+	return Block{blockKey, items, BlockSizeBytes, nil}
 }
 
 type BlockStorage interface {
 	ReadBlock(key string) (block *Block, err error)
 	WriteKvItems(commands []Command) (BlockStorage, error)
 	RangeSearch(key1 string, key2 string) (values []string, err error)
+	CollectValueLog(filePath string, valueLogPath string) (BlockStorage, error)
+	ValueLogGarbageRatio() float64
+	FlushTable(filePath string, commands []Command) (BlockStorage, error)
+	OpenTable(filePath string) (BlockStorage, error)
+	Compact(tables []BlockStorage, filePath string) (*Compaction, error)
+	FileSize() int64
+	NewIterator() *TableIterator
+	MayContainPrefix(prefix string) bool
+	RangeTombstones() RangeTombstones
+	MultiGet(ctx context.Context, keys []string) ([]Entry, error)
 }
 
 type SsBlockStorage struct {
-	filePath   string
-	index      []string
-	blockCache lru.ARCCache
+	filePath     string
+	index        []string
+	filter       *BloomFilter
+	prefixFilter *PrefixFilter
+	// rangeTombstones hide older entries of the keys they cover.
+	rangeTombstones RangeTombstones
+	blockCache      *lru.ARCCache
+	valueLog        DataLog
+	valueLogPath    string
+	opts            Options
+	liveValueBytes  int64
 }
 
-func newSsBlockStorage(filepath string, index []string) BlockStorage {
-	cacheSize := 3 * BlockSizeBytes
-	var cache *lru.ARCCache
-	cache, err := lru.NewARC(int(cacheSize))
+// tableFooter holds the records an sstable keeps after its blocks.
+type tableFooter struct {
+	index           []string
+	filter          *BloomFilter
+	prefixFilter    *PrefixFilter
+	rangeTombstones RangeTombstones
+}
 
+func newSsBlockStorage(filepath string, vlogPath string, footer tableFooter, opts Options) (*SsBlockStorage, error) {
+	var cache *lru.ARCCache
+	cache, err := lru.NewARC(opts.BlockCacheSize)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	return &SsBlockStorage{filepath, index, *cache}
+	valueLog := NewSyncedLocalDataLog(opts.FileSystem(), vlogPath, opts.SyncPolicy == SyncAlways)
+	return &SsBlockStorage{filepath, footer.index, footer.filter, footer.prefixFilter, footer.rangeTombstones,
+		cache, valueLog, vlogPath, opts, -1}, nil
 }
 
+// searchIndex returns the offset of the last block starting at or before
+// key, the only block that can hold it.
 func searchIndex(index []string, key string) (offset int64) {
-	h := keyHash(key)
-	for i, key := range index {
-		if i%2 == 0 && key > h {
+	for i, firstKey := range index {
+		if i%2 == 0 && firstKey > key {
 			break
 		}
 
@@ -166,10 +252,11 @@ func searchIndex(index []string, key string) (offset int64) {
 	return offset
 }
 
-func readBlock(filePath string, offset int64) (block *Block, err error) {
-	csvfile, err := os.Open(filePath)
+func readBlock(fs FS, filePath string, offset int64, valueLog DataLog) (block *Block, err error) {
+	csvfile, err := fs.OpenFile(filePath, os.O_RDONLY, 0)
 	if err != nil {
-		log.Fatal("Could not open csvfile", err)
+		log.Errorf("Could not open csvfile %s. %v", filePath, err)
+		return nil, err
 	}
 
 	defer csvfile.Close()
@@ -180,167 +267,320 @@ func readBlock(filePath string, offset int64) (block *Block, err error) {
 	}
 
 	log.Info("Reading block line that holds index.")
-	r := csv.NewReader(csvfile)
+	r := newRecordReader(csvfile)
 	record, err := r.Read()
 	if err != nil {
-		return nil, err
+		return nil, readError(filePath, err)
 	}
 	log.Info("Record is read from block offset.")
 
-	var blockKey string
-	var om *orderedmap.OrderedMap = orderedmap.NewOrderedMap()
-	for i, _ := range record {
-		if i == 0 {
-			blockKey = record[i+1]
+	if len(record) > 0 && record[0] == COMPRESSED_BLOCK_RECORD {
+		record, err = decompressBlock(record)
+		if err != nil {
+			return nil, corruptionError(filePath, "block at offset %d does not decompress: %v", offset, err)
 		}
+	}
 
-		if i == 0 || i%3 == 0 {
-			size, err := strconv.ParseInt(record[i], 10, 64)
-			if err != nil {
-				return nil, err
-			}
+	om, err := parseBlockRecord(record)
+	if err != nil {
+		return nil, corruptionError(filePath, "block at offset %d: %v", offset, err)
+	}
+
+	block = &Block{record[1], *om, BlockSizeBytes, valueLog}
+	return block, nil
+}
+
+// parseBlockRecord decodes the size, key and value triplets of a block,
+// which must hold at least one item with keys in increasing order.
+func parseBlockRecord(record []string) (*orderedmap.OrderedMap, error) {
+	if len(record) == 0 || len(record)%3 != 0 {
+		return nil, errors.New(fmt.Sprintf("Malformed block of %d fields", len(record)))
+	}
+
+	om := orderedmap.NewOrderedMap()
+	for i := 0; i < len(record); i += 3 {
+		sizeField, expiresAt, err := parseExpiry(record[i])
+		if err != nil {
+			return nil, err
+		}
+
+		kind, sizeField := parseItemKind(sizeField)
+		size, err := strconv.ParseInt(sizeField, 10, 64)
+		if err != nil || size < 0 {
+			return nil, errors.New(fmt.Sprintf("Bad item size %q", record[i]))
+		}
 
-			key := record[i+1]
-			log.Infof("Reading in kv item %s", key)
-			value := record[i+2]
-			kv := KeyValueItem{"", key, value, size}
-			om.Set(key, kv)
+		key := record[i+1]
+		if i > 0 && key <= record[i-2] {
+			return nil, errors.New(fmt.Sprintf("Block key %q out of order", key))
 		}
+
+		log.Infof("Reading in kv item %s", key)
+		value := record[i+2]
+		kv := KeyValueItem{key, value, size, kind, expiresAt}
+		om.Set(key, kv)
 	}
 
-	block = &Block{blockKey, *om, BlockSizeBytes}
-	return block, nil
+	return om, nil
 }
 
 func (s *SsBlockStorage) ReadBlock(key string) (block *Block, err error) {
-	log.Infof("Reading block that contains key %s, hash is %s", key, keyHash(key))
+	log.Infof("Reading block that contains key %s", key)
+	if len(s.index) == 0 || key < s.index[0] || (s.filter != nil && !s.filter.MayContain(key)) {
+		log.Infof("Sstable cannot hold key %s, skipping block read.", key)
+		empty := NewBlock("", *orderedmap.NewOrderedMap())
+		empty.valueLog = s.valueLog
+		return &empty, nil
+	}
+
 	offset := searchIndex(s.index, key)
 
 	log.Infof("Found block index is %d", offset)
+	return s.blockAt(offset)
+}
 
+// blockAt returns the block at offset, from the block cache if it is there.
+func (s *SsBlockStorage) blockAt(offset int64) (block *Block, err error) {
 	b, ok := s.blockCache.Get(offset)
 	if ok {
 		log.Info("Block found in block cache.")
 		block, _ = b.(*Block)
 		return block, err
 	}
-	return readBlock(s.filePath, offset)
+
+	block, err = readBlock(s.opts.FileSystem(), s.filePath, offset, s.valueLog)
+	if err == nil {
+		s.blockCache.Add(offset, block)
+	}
+
+	return block, err
 }
 
-func searchIndexRange(index []string, key1 string, key2 string) (offsets []int64) {
-	h1 := keyHash(key1)
-	h2 := keyHash(key2)
-	if h2 > h1 {
-		tmp := h1
-		h1 = h2
-		h2 = tmp
+// KeyRange orders the bounds of a range given either way round.
+func KeyRange(key1 string, key2 string) (low string, high string) {
+	if key2 < key1 {
+		return key2, key1
 	}
 
+	return key1, key2
+}
+
+// searchIndexRange returns the offsets of the blocks that can hold keys
+// between key1 and key2 inclusive. A block holds the keys from its first
+// key up to the first key of the next block.
+func searchIndexRange(index []string, key1 string, key2 string) (offsets []int64) {
+	low, high := KeyRange(key1, key2)
 	var offset int64
-	for i, key := range index {
+	for i, firstKey := range index {
 		if i%2 != 0 {
 			continue
 		}
 
-		if key >= h1 || key <= h2 {
-			offI := i + 1
-			offset, _ = strconv.ParseInt(index[offI], 10, 64)
-			offsets = append(offsets, offset)
+		if firstKey > high {
+			break
+		}
+
+		if i+2 < len(index) && index[i+2] <= low {
+			continue
 		}
+
+		offset, _ = strconv.ParseInt(index[i+1], 10, 64)
+		offsets = append(offsets, offset)
 	}
 
 	return offsets
-
 }
+
 func (s *SsBlockStorage) RangeSearch(key1 string, key2 string) (values []string, err error) {
+	items, err := s.rangeItems(context.Background(), key1, key2)
+	if err != nil {
+		return values, err
+	}
+
+	for _, it := range items {
+		if it.Deleted() {
+			continue
+		}
+
+		value, err := readValue(s.valueLog, it)
+		if err != nil {
+			return values, err
+		}
+
+		log.Infof("Scan value is %s", value)
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+// rangeItems returns the items of the blocks holding keys between key1 and
+// key2, giving up between blocks once ctx is done.
+func (s *SsBlockStorage) rangeItems(ctx context.Context, key1 string, key2 string) (items []KeyValueItem, err error) {
 	log.Infof("Searching index for blocks that contain keys between %s and %s.", key1, key2)
 	offsets := searchIndexRange(s.index, key1, key2)
 	log.Infof("Found %d blocks that contain keys between %s and %s", len(offsets), key1, key2)
 	for _, offs := range offsets {
-		log.Infof("Reading in block.")
-		block, err := readBlock(s.filePath, offs)
-		if err != nil {
-			return values, err
+		if err = ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		h1 := keyHash(key1)
-		h2 := keyHash(key2)
-		if h2 > h1 {
-			log.Info("Keys hash cause out of order search, adjusting.")
-			tmp := h1
-			h1 = h2
-			h2 = tmp
+		log.Infof("Reading in block.")
+		block, err := readBlock(s.opts.FileSystem(), s.filePath, offs, s.valueLog)
+		if err != nil {
+			return items, err
 		}
 
+		low, high := KeyRange(key1, key2)
 		log.Infof("Checking if key from read blocks falls inclusively between keys %s and %s", key1, key2)
 		for _, key := range block.Keys() {
-			if key >= h1 || key <= h2 {
-				value, _ := block.GetH(key)
-				log.Infof("Scan value is %s", value)
-
-				values = append(values, value)
+			if key >= low && key <= high {
+				it, _ := block.item(key)
+				items = append(items, it)
 			}
 		}
-		log.Infof("Checked keys inbetween %s and %s, current list of values is %d", key1, key2, len(values))
+		log.Infof("Checked keys inbetween %s and %s, current list of items is %d", key1, key2, len(items))
 	}
 
-	return values, nil
+	return items, nil
 }
 
-func loadIndex(filePath string) []string {
+// loadIndex reads the footer from the last lines of the sstable at
+// filePath. An empty file has an empty index.
+func loadIndex(fs FS, filePath string) (tableFooter, error) {
 	log.Infof("Loading index from %s", filePath)
-	ind := make([]string, 0, 0)
-	csvfile, err := os.Open(filePath)
+	csvfile, err := fs.OpenFile(filePath, os.O_RDONLY, 0)
 	if err != nil {
-		log.Fatal("Could not open csvfile", err)
+		log.Errorf("Could not open csvfile %s. %v", filePath, err)
+		return tableFooter{}, err
 	}
 	defer csvfile.Close()
-	log.Info("Reading second line that holds index.")
-	r := csv.NewReader(csvfile)
-	r.FieldsPerRecord = -1
-	var rec []string
+	log.Info("Reading last lines that hold the footer.")
+	r := newRecordReader(csvfile)
+	// tail holds the last FOOTER_RECORDS records read
+	var tail [][]string
 	for {
 		record, err := r.Read()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			log.Fatal(err)
+			return tableFooter{}, readError(filePath, err)
 		}
 
-		rec = record
+		tail = append(tail, record)
+		if len(tail) > FOOTER_RECORDS {
+			tail = tail[1:]
+		}
 	}
 
-	log.Info("Second line retrieved, parsing index.")
-	for i, key := range rec {
-		if i%2 == 0 {
-			offI := i + 1
-			offset := rec[offI]
-			log.Infof("Adding key %s and offset %s to index.", key, offset)
-			ind = append(ind, key)
-			ind = append(ind, offset)
+	// the index is last, after the bloom filter, the prefix filter and the
+	// range tombstones of those the table has
+	var footer tableFooter
+	var rec []string
+	n := len(tail) - 1
+	if n >= 0 {
+		rec = tail[n]
+	}
+
+	previous := func(name string) []string {
+		if n > 0 && len(tail[n-1]) > 0 && tail[n-1][0] == name {
+			n -= 1
+			return tail[n]
+		}
+
+		return nil
+	}
+
+	if prev := previous(BLOOM_RECORD); prev != nil {
+		footer.filter, err = parseBloomFilter(prev)
+		if err != nil {
+			log.Errorf("Ignoring unreadable bloom filter in %s. %v", filePath, err)
+			footer.filter = nil
+		}
+	}
+
+	if prev := previous(PREFIX_BLOOM_RECORD); prev != nil {
+		footer.prefixFilter, err = parsePrefixFilter(prev)
+		if err != nil {
+			log.Errorf("Ignoring unreadable prefix bloom filter in %s. %v", filePath, err)
+			footer.prefixFilter = nil
+		}
+	}
+
+	if prev := previous(RANGE_DEL_RECORD); prev != nil {
+		footer.rangeTombstones, err = parseRangeTombstones(prev)
+		if err != nil {
+			return tableFooter{}, corruptionError(filePath, "range tombstones: %v", err)
 		}
 	}
 
+	log.Info("Footer retrieved, parsing index.")
+	footer.index, err = parseIndexRecord(rec)
+	if err != nil {
+		return tableFooter{}, corruptionError(filePath, "index: %v", err)
+	}
+
 	log.Info("Index is loaded.")
-	return ind
+	return footer, nil
+}
+
+// parseIndexRecord checks an index record holds pairs of first block keys
+// and block offsets, both increasing.
+func parseIndexRecord(rec []string) ([]string, error) {
+	if len(rec) == 1 && rec[0] == EMPTY_INDEX_RECORD {
+		return []string{}, nil
+	}
+
+	if len(rec)%2 != 0 {
+		return nil, errors.New(fmt.Sprintf("Malformed index of %d fields", len(rec)))
+	}
+
+	ind := make([]string, 0, len(rec))
+	var last int64 = -1
+	for i := 0; i < len(rec); i += 2 {
+		key := rec[i]
+		offset, err := strconv.ParseInt(rec[i+1], 10, 64)
+		if err != nil || offset <= last {
+			return nil, errors.New(fmt.Sprintf("Bad offset %q for block %q", rec[i+1], key))
+		}
+
+		if i > 0 && key <= rec[i-2] {
+			return nil, errors.New(fmt.Sprintf("Index key %q out of order", key))
+		}
+
+		log.Infof("Adding key %s and offset %d to index.", key, offset)
+		ind = append(ind, key, rec[i+1])
+		last = offset
+	}
+
+	return ind, nil
+}
+
+// NewSsBlockStorage opens the sstable at filePath. Values longer than
+// opts.ValueThreshold bytes are kept in a value log beside the sstable.
+func NewSsBlockStorage(filePath string, opts Options) (BlockStorage, error) {
+	opts.FileSystem().Remove(TempFilePath(filePath))
+	return NewSsTable(filePath, valueLogPath(filePath), opts)
 }
 
-func NewSsBlockStorage(filePath string) BlockStorage {
-	ind := make([]string, 0, 0)
-	_, err := os.Stat(filePath)
+// NewSsTable opens the sstable at filePath whose separated values are kept
+// in the value log at vlogPath. A missing table is opened empty.
+func NewSsTable(filePath string, vlogPath string, opts Options) (BlockStorage, error) {
+	footer := tableFooter{index: make([]string, 0, 0)}
+	_, err := opts.FileSystem().Stat(filePath)
 	if err == nil {
 		log.Info("Existing data file detected loading in index.")
-		ind = loadIndex(filePath)
+		footer, err = loadIndex(opts.FileSystem(), filePath)
+		if err != nil {
+			log.Errorf("Could not load sstable index. %v", err)
+			return nil, err
+		}
 	} else {
 		log.Info("No data file detected using empty index.")
 	}
 
-	cacheSize := 3 * BlockSizeBytes
-	var cache *lru.ARCCache
-	cache, _ = lru.NewARC(int(cacheSize))
-
-	return &SsBlockStorage{filePath, ind, *cache}
+	return newSsBlockStorage(filePath, vlogPath, footer, opts)
 }
 
 type By func(i1, i2 *KeyValueItem) bool
@@ -370,56 +610,101 @@ func (k *KeyValueItemSorter) Less(i, j int) bool {
 	return k.by(&k.items[i], &k.items[j])
 }
 
-func sortKeyValueItemsByHash(items []KeyValueItem) {
-	hsh := func(i1, i2 *KeyValueItem) bool {
-		return i1.keyHash < i2.keyHash
+func sortKeyValueItemsByKey(items []KeyValueItem) {
+	key := func(i1, i2 *KeyValueItem) bool {
+		return i1.key < i2.key
 	}
 
-	By(hsh).Sort(items)
+	By(key).Sort(items)
 }
 
 func keyValueItemsOrderedMap(items []KeyValueItem) *orderedmap.OrderedMap {
 	m := orderedmap.NewOrderedMap()
 	for _, it := range items {
-		log.Infof("Adding kv item with key %s to ordered hash", it.KeyHash())
-		m.Set(it.KeyHash(), it)
+		log.Infof("Adding kv item with key %s to ordered hash", it.Key())
+		m.Set(it.Key(), it)
 	}
 
 	return m
 }
 
-// items are assumed ordered
-func createBlock(items []KeyValueItem, startingIndex int) (block Block, nextIndex int) {
-	var currentSizeBytes int64 = 0
+func itemFields(it KeyValueItem) []string {
+	sizeField := fmt.Sprintf("%d%s", it.Size(), itemKindSuffixes[it.kind])
+	if it.expiresAt != 0 {
+		sizeField += fmt.Sprintf("%s%d", EXPIRY_SEPARATOR, it.expiresAt)
+	}
+
+	return []string{sizeField, it.Key(), it.Value()}
+}
+
+// encodedFieldSize is the number of bytes a csv writer uses for field,
+// including any quoting it has to add.
+func encodedFieldSize(field string) int64 {
+	size := int64(len(field))
+	if field == "" {
+		return size
+	}
+
+	r, _ := utf8.DecodeRuneInString(field)
+	if field == `\.` || strings.ContainsAny(field, ",\"\r\n") || unicode.IsSpace(r) {
+		size += 2 + int64(strings.Count(field, "\""))
+	}
+
+	return size
+}
+
+// encodedItemSize is the exact number of bytes an item takes up in a block
+// line, not counting the comma separating it from the item before it.
+func encodedItemSize(it KeyValueItem) int64 {
+	fields := itemFields(it)
+	size := int64(len(fields) - 1)
+	for _, field := range fields {
+		size += encodedFieldSize(field)
+	}
+
+	return size
+}
+
+// items are assumed ordered. A block always takes at least one item, so an
+// item that cannot fit within blockSize is written alone in its own
+// oversized block rather than stalling the writer.
+func createBlock(items []KeyValueItem, startingIndex int, blockSize int64) (block Block, nextIndex int) {
+	// one is for newline
+	var currentSizeBytes int64 = 1
 	endIndex := startingIndex
 	log.Infof("Calculating indexes from items of length %d, to create block.", len(items))
-	first := true
 
-	// minus one is for newline
-	for endIndex < len(items) && currentSizeBytes+items[endIndex].Size() <= BlockSizeBytes-1 {
-		it := items[endIndex]
-		meta := 3
-		if first {
-			meta = 2
-			first = false
+	for endIndex < len(items) {
+		size := encodedItemSize(items[endIndex])
+		if endIndex > startingIndex {
+			// separating comma
+			size += 1
+			if currentSizeBytes+size > blockSize {
+				break
+			}
 		}
 
-		currentSizeBytes += (it.Size() + int64(meta))
+		currentSizeBytes += size
 		endIndex += 1
 	}
 
+	if currentSizeBytes > blockSize {
+		log.Infof("Item %s needs an oversized block of %d bytes.", items[startingIndex].Key(), currentSizeBytes)
+	}
+
 	log.Info("Calculated indexes to create block.")
 	log.Info("Creating ordered map for block.")
 	m := keyValueItemsOrderedMap(items[startingIndex:endIndex])
 	log.Info("Created ordered map for block.")
-	block = NewBlock(items[startingIndex].keyHash, *m)
+	block = NewBlock(items[startingIndex].key, *m)
+	block.size = blockSize
 	nextIndex = endIndex
 
 	return block, endIndex
 }
 
-func getLastIndex(filepath string) (offset int64, err error) {
-	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+func getLastIndex(fs FS, filepath string) (offset int64, err error) {
+	f, err := fs.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return -1, err
 	}
@@ -430,39 +715,38 @@ func getLastIndex(filepath string) (offset int64, err error) {
 	return offset, err
 }
 
-func writeBlock(filepath string, block Block) (offset int64, err error) {
-	offset, err = getLastIndex(filepath)
+func writeBlock(fs FS, filepath string, block Block, compression CompressionType) (offset int64, err error) {
+	offset, err = getLastIndex(fs, filepath)
 	if err != nil {
 		return -1, err
 	}
 
-	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	f, err := fs.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return -1, err
 	}
 	defer f.Close()
 
 	//writeNumber := block.items.Len()
-	firstRecord := true
+	record := make([]string, 0, 3*block.items.Len())
 	for _, k := range block.Keys() {
 		i, _ := block.items.Get(k)
 		it, _ := i.(KeyValueItem)
+		record = append(record, itemFields(it)...)
+	}
 
-		var s string
-		if firstRecord {
-			s = fmt.Sprintf("%d,%s,%s", it.Size(), it.KeyHash(), it.Value())
-			firstRecord = false
-		} else {
-			s = fmt.Sprintf(",%d,%s,%s", it.Size(), it.KeyHash(), it.Value())
-		}
-		_, werr := f.WriteString(s)
-		if werr != nil {
-			return -1, werr
+	if compression == FlateCompression {
+		record, err = compressBlock(record)
+		if err != nil {
+			return -1, err
 		}
 	}
 
-	_, werr := f.WriteString("\n")
-	if werr != nil {
+	// values may hold commas, quotes or newlines so the block is csv quoted
+	w := csv.NewWriter(f)
+	w.Write(record)
+	w.Flush()
+	if werr := w.Error(); werr != nil {
 		return -1, werr
 	}
 
@@ -470,27 +754,56 @@ func writeBlock(filepath string, block Block) (offset int64, err error) {
 	return offset, nil
 }
 
-func writeIndex(filepath string, index []string) error {
-	f, err := os.OpenFile(filepath, os.O_APPEND|os.O_WRONLY, 0644)
+// writeFilter appends the record of a bloom filter to the sstable at
+// filepath.
+func writeFilter(fs FS, filepath string, record []string) error {
+	f, err := fs.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 
 	defer f.Close()
 
-	indexString := ""
-	firstItem := true
-	for _, indexItem := range index {
-		if firstItem {
-			indexString = fmt.Sprintf("%s%s", indexString, indexItem)
-			firstItem = false
-		} else {
-			indexString = fmt.Sprintf("%s,%s", indexString, indexItem)
-		}
+	w := csv.NewWriter(f)
+	w.Write(record)
+	w.Flush()
+	return w.Error()
+}
+
+func syncFile(fs FS, filepath string) error {
+	f, err := fs.OpenFile(filepath, os.O_RDWR, 0644)
+	if err != nil {
+		return err
 	}
 
-	_, err = f.WriteString(indexString)
+	defer f.Close()
+	return f.Sync()
+}
+
+func writeIndex(fs FS, filepath string, index []string) error {
+	f, err := fs.OpenFile(filepath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
 
+	defer f.Close()
+
+	// keys may hold commas, quotes or newlines so the index is csv quoted,
+	// and as the last line of the table it has no trailing newline
+	var line bytes.Buffer
+	w := csv.NewWriter(&line)
+	if len(index) == 0 {
+		// an empty record would be skipped when the table is read
+		index = []string{EMPTY_INDEX_RECORD}
+	}
+
+	w.Write(index)
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return err
+	}
+
+	_, err = f.Write(bytes.TrimSuffix(line.Bytes(), []byte("\n")))
 	return err
 }
 
@@ -506,18 +819,18 @@ func getIndexOffsets(index []string) (offsets []int64) {
 	return offsets
 }
 
-func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
-	log.Info("Collecting items to write to new sstable.")
+// tableItems reads every item of the sstable as stored, leaving values in
+// the value log and tombstones in place.
+func tableItems(s *SsBlockStorage) ([]KeyValueItem, error) {
 	var items []KeyValueItem
-	itemMap := make(map[string]KeyValueItem)
 	offsets := getIndexOffsets(s.index)
 
 	log.Info("reading blocks for collection")
 	var blocks []Block
 	for _, offset := range offsets {
-		block, err := readBlock(s.filePath, offset)
+		block, err := readBlock(s.opts.FileSystem(), s.filePath, offset, s.valueLog)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
 
 		blocks = append(blocks, *block)
@@ -528,26 +841,51 @@ func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
 	log.Info("Collecting key value items from blocks.")
 	for _, block := range blocks {
 		for _, k := range block.Keys() {
-			key := k
-			value, _ := block.GetH(key)
-			it := NewKeyValueItem(key, value)
-			it.keyHash = key
-			it.key = ""
-			itemMap[key] = it
+			it, _ := block.item(k)
+			items = append(items, it)
 		}
 	}
 
 	log.Info("Collected key value items from blocks.")
+	return items, nil
+}
+
+func collectItemsToWrite(s *SsBlockStorage, commands []Command) ([]KeyValueItem, error) {
+	log.Info("Collecting items to write to new sstable.")
+	var items []KeyValueItem
+	itemMap := make(map[string]KeyValueItem)
+	stored, err := tableItems(s)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.opts.Now()
+	for _, it := range stored {
+		if !it.Deleted() && !Expired(it.ExpiresAt(), now) {
+			itemMap[it.Key()] = it
+		}
+	}
 
 	log.Info("Pruning commands due to delete tombstones")
 	writeCommandsAmount := 0
 	for _, cmd := range commands {
 		if cmd.Type == DEL_COMMAND {
-			log.Infof("Delete command found for key %s, removing from items to write.", cmd.Item.keyHash)
-			delete(itemMap, cmd.Item.KeyHash())
+			log.Infof("Delete command found for key %s, removing from items to write.", cmd.Item.Key())
+			delete(itemMap, cmd.Item.Key())
+		} else if Expired(cmd.Item.ExpiresAt(), now) {
+			log.Infof("Value of key %s has expired, removing from items to write.", cmd.Item.Key())
+			delete(itemMap, cmd.Item.Key())
+		} else if cmd.Type == DELRANGE_COMMAND {
+			deleteRange(itemMap, RangeTombstone{cmd.Item.Key(), cmd.Item.Value()})
+		} else if cmd.Type == MERGE_COMMAND {
+			err = foldOperands(s.valueLog, s.opts, itemMap, cmd.Item.Key(), cmd.Item.Value())
+			if err != nil {
+				log.Errorf("Could not merge operands of %s. %v", cmd.Item.Key(), err)
+				return nil, err
+			}
 		} else {
 			writeCommandsAmount += 1
-			itemMap[cmd.Item.KeyHash()] = cmd.Item
+			itemMap[cmd.Item.Key()] = cmd.Item
 		}
 	}
 
@@ -559,51 +897,132 @@ func collectItemsToWrite(s SsBlockStorage, commands []Command) []KeyValueItem {
 	}
 
 	log.Info("Collected items to write to new sstable.")
-	return items
+	return items, nil
 }
 
-func (s *SsBlockStorage) WriteKvItems(commands []Command) (BlockStorage, error) {
+// writeTable writes items as a complete sstable into the temporary file at
+// tmpFilePath, followed by its range tombstones, and returns its footer.
+func writeTable(tmpFilePath string, items []KeyValueItem, tombstones RangeTombstones, opts Options) (footer tableFooter, err error) {
 	log.Info("Sorting key value items for write.")
-
-	items := collectItemsToWrite(*s, commands)
-	sortKeyValueItemsByHash(items)
+	sortKeyValueItemsByKey(items)
 	log.Info("Key value items sorted for write.")
 	startingIndex := 0
+	fs := opts.FileSystem()
 
 	log.Info("Removing old sstable file if exists.")
-	tmpFilePath := "./temp_data.txt"
+	fs.Remove(tmpFilePath)
 
 	log.Infof("Number of total writes is %d", len(items))
 	index := make([]string, 0, 100000)
 	for startingIndex < len(items) {
-		block, nextIndex := createBlock(items, startingIndex)
+		block, nextIndex := createBlock(items, startingIndex, opts.BlockSizeBytes)
 		startingIndex = nextIndex
 		log.Infof("Created block %s, next index of items are %d", block.BlockKey(), startingIndex)
-		off, err := writeBlock(tmpFilePath, block)
+		off, err := writeBlock(fs, tmpFilePath, block, opts.Compression)
 		index = append(index, block.BlockKey())
 		index = append(index, fmt.Sprintf("%d", off))
 		if err != nil {
 			log.Errorf("Unable to write block %s", block.BlockKey())
-			return nil, err
+			return tableFooter{}, err
 		}
 
 		log.Infof("Block %s is written", block.BlockKey())
 	}
 
-	err := writeIndex(tmpFilePath, index)
+	if len(tombstones) > 0 {
+		err = writeFilter(fs, tmpFilePath, tombstones.record())
+		if err != nil {
+			log.Errorf("Unable to write range tombstones to file %s.", tmpFilePath)
+			return tableFooter{}, err
+		}
+	}
+
+	var filter *BloomFilter
+	var prefixFilter *PrefixFilter
+	if opts.BloomBitsPerKey > 0 {
+		keys := make([]string, 0, len(items))
+		for _, it := range items {
+			keys = append(keys, it.Key())
+		}
+
+		if extractor := opts.prefixExtractor(); extractor != nil {
+			prefixFilter = NewPrefixFilter(keys, extractor, opts.BloomBitsPerKey)
+			err = writeFilter(fs, tmpFilePath, prefixFilter.record())
+			if err != nil {
+				log.Errorf("Unable to write prefix bloom filter to file %s.", tmpFilePath)
+				return tableFooter{}, err
+			}
+		}
+
+		filter = NewBloomFilter(keys, opts.BloomBitsPerKey)
+		err = writeFilter(fs, tmpFilePath, filter.record())
+		if err != nil {
+			log.Errorf("Unable to write bloom filter to file %s.", tmpFilePath)
+			return tableFooter{}, err
+		}
+	}
+
+	err = writeIndex(fs, tmpFilePath, index)
+	if err != nil {
+		log.Errorf("Unable to write index to file %s.", tmpFilePath)
+		return tableFooter{}, err
+	}
+
+	return tableFooter{index, filter, prefixFilter, tombstones}, nil
+}
+
+// syncValueLog makes values appended during a flush durable before the
+// sstable pointing at them replaces the old one.
+func syncValueLog(filePath string, opts Options) error {
+	if opts.SyncPolicy < SyncFlush {
+		return nil
+	}
+
+	err := syncFile(opts.FileSystem(), filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *SsBlockStorage) WriteKvItems(commands []Command) (BlockStorage, error) {
+	items, err := collectItemsToWrite(s, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	err = separateValues(s.valueLog, items, s.opts.ValueThreshold)
+	if err != nil {
+		log.Errorf("Unable to move values into value log for %s.", s.filePath)
+		return nil, err
+	}
+
+	err = syncValueLog(s.valueLogPath, s.opts)
+	if err != nil {
+		log.Errorf("Unable to sync value log for %s.", s.filePath)
+		return nil, err
+	}
+
+	tmpFilePath := TempFilePath(s.filePath)
+	footer, err := writeTable(tmpFilePath, items, nil, s.opts)
 	if err != nil {
-		log.Errorf("Unable to write index to file %s.", s.filePath)
 		return nil, err
 	}
 
 	log.Info("Swapping old data file with new one.")
-	err = os.Rename(tmpFilePath, s.filePath)
+	err = replaceFile(s.opts.FileSystem(), tmpFilePath, s.filePath, s.opts.syncFiles())
 	if err != nil {
-		log.Fatal("Could not swap data files.")
+		log.Error("Could not swap data files.")
 		return nil, err
 	}
 
 	log.Info("Index written to file. Creating new Block storage to return.")
-	var storage BlockStorage = newSsBlockStorage(s.filePath, index)
+	storage, err := newSsBlockStorage(s.filePath, s.valueLogPath, footer, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.liveValueBytes = liveValueBytes(items)
 	return storage, nil
 }
@@ -0,0 +1,740 @@
+package index
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+var valueSizes = []int{0, 1, 16, 1000, 3970, 3980, 3999, 4000, 4001, 10000,
+	1 << 20, 4 << 20}
+
+func sizedValue(size int, seed int) string {
+	var b strings.Builder
+	for b.Len() < size {
+		b.WriteString(fmt.Sprintf("v%d-", seed))
+	}
+
+	return b.String()[:size]
+}
+
+func putCommands(values map[string]string) []Command {
+	commands := make([]Command, 0, len(values))
+	for key, value := range values {
+		commands = append(commands, Command{PUT_COMMAND, NewKeyValueItem(key, value)})
+	}
+
+	return commands
+}
+
+func thresholdOptions(threshold int64) Options {
+	opts := DefaultOptions()
+	opts.ValueThreshold = threshold
+	return opts
+}
+
+func openStorage(t *testing.T, filePath string, opts Options) *SsBlockStorage {
+	storage, err := NewSsBlockStorage(filePath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return storage.(*SsBlockStorage)
+}
+
+func writeValues(t *testing.T, values map[string]string, opts Options) *SsBlockStorage {
+	dir := t.TempDir()
+	if err := opts.FileSystem().MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	storage := openStorage(t, filepath.Join(dir, "store"), opts)
+	written, err := storage.WriteKvItems(putCommands(values))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return written.(*SsBlockStorage)
+}
+
+func checkValues(t *testing.T, storage BlockStorage, values map[string]string) {
+	for key, want := range values {
+		block, err := storage.ReadBlock(key)
+		if err != nil {
+			t.Fatalf("ReadBlock(%s): %v", key, err)
+		}
+
+		got, ok, err := block.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%s): %v", key, err)
+		}
+
+		if !ok {
+			t.Fatalf("Get(%s) not found", key)
+		}
+
+		if got != want {
+			t.Fatalf("Get(%s) returned %d bytes, want %d bytes", key, len(got), len(want))
+		}
+	}
+}
+
+// blockLengths returns the byte length and item count of every block in the
+// sstable.
+func blockLengths(t *testing.T, storage *SsBlockStorage) (lengths []int64, counts []int) {
+	data, err := readFile(storage.opts.FileSystem(), storage.filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offsets := getIndexOffsets(storage.index)
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	indexLength := int64(len(strings.Join(storage.index, ",")))
+	if storage.filter != nil {
+		indexLength += int64(len(strings.Join(storage.filter.record(), ",")) + 1)
+	}
+
+	for i, offset := range offsets {
+		end := int64(len(data)) - indexLength
+		if i+1 < len(offsets) {
+			end = offsets[i+1]
+		}
+
+		block, err := readBlock(storage.opts.FileSystem(), storage.filePath, offset, storage.valueLog)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lengths = append(lengths, end-offset)
+		counts = append(counts, len(block.Keys()))
+	}
+
+	return lengths, counts
+}
+
+func TestWriteKvItemsValueSizes(t *testing.T) {
+	values := make(map[string]string)
+	for i, size := range valueSizes {
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(size, i)
+	}
+
+	storage := writeValues(t, values, thresholdOptions(0))
+	checkValues(t, storage, values)
+
+	reopened := openStorage(t, storage.filePath, thresholdOptions(0))
+	checkValues(t, reopened, values)
+}
+
+func TestValueLogSeparatesAndCollectsValues(t *testing.T) {
+	opts := thresholdOptions(8)
+	long := strings.Repeat("v", 100)
+	values := map[string]string{"a": long + "a", "b": "short", "c": long + "c"}
+	storage := writeValues(t, values, opts)
+	items, err := tableItems(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, it := range items {
+		if it.Separated() != (len(values[it.Key()]) > 8) {
+			t.Fatalf("%s of %d bytes separated is %v", it.Key(), len(values[it.Key()]), it.Separated())
+		}
+	}
+
+	values["a"] = long + "A"
+	delete(values, "c")
+	commands := []Command{
+		{Type: PUT_COMMAND, Item: NewKeyValueItem("a", values["a"])},
+		{Type: DEL_COMMAND, Item: NewKeyValueItem("c", "")},
+	}
+
+	written, err := storage.WriteKvItems(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ratio := written.ValueLogGarbageRatio()
+	reopened := openStorage(t, storage.filePath, opts)
+	if ratio < 0.5 || reopened.ValueLogGarbageRatio() != ratio {
+		t.Fatalf("garbage ratio is %.2f, and %.2f once reopened", ratio, reopened.ValueLogGarbageRatio())
+	}
+
+	if _, err = reopened.CollectValueLog(reopened.filePath, reopened.valueLogPath+"2"); err == nil {
+		t.Fatal("value log was collected in place")
+	}
+
+	dir := filepath.Dir(storage.filePath)
+	collected, err := reopened.CollectValueLog(filepath.Join(dir, "collected"), filepath.Join(dir, "collected.vlog"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkValues(t, collected, values)
+	before, _ := os.Stat(reopened.valueLogPath)
+	after, _ := os.Stat(filepath.Join(dir, "collected.vlog"))
+	if collected.ValueLogGarbageRatio() >= 0.5 || after.Size() >= before.Size() {
+		t.Fatalf("collected value log of %d bytes from %d", after.Size(), before.Size())
+	}
+}
+
+func TestValueLogOfLiveValuesHasNoGarbage(t *testing.T) {
+	opts := thresholdOptions(4)
+	values := map[string]string{"a": "value", "b,\"quoted\"": "with, \"quotes\"\r\n", "c": " spaced"}
+	for i := 0; i < 50; i++ {
+		values[fmt.Sprintf("key%013d", i)] = fmt.Sprintf("val%013d", i)
+	}
+
+	storage := writeValues(t, values, opts)
+	if ratio := storage.ValueLogGarbageRatio(); ratio != 0 {
+		t.Fatalf("value log holding only live values has garbage ratio %.2f", ratio)
+	}
+
+	if ratio := openStorage(t, storage.filePath, opts).ValueLogGarbageRatio(); ratio != 0 {
+		t.Fatalf("reopened value log holding only live values has garbage ratio %.2f", ratio)
+	}
+}
+
+func TestWriteKvItemsBlockLayout(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 300; i++ {
+		size := valueSizes[i%len(valueSizes)]
+		if size > 10000 {
+			size = 16
+		}
+
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(size, i)
+	}
+
+	storage := writeValues(t, values, thresholdOptions(0))
+	lengths, counts := blockLengths(t, storage)
+	total := 0
+	for i, length := range lengths {
+		total += counts[i]
+		if counts[i] > 1 && length > BlockSizeBytes {
+			t.Errorf("block %d holds %d items in %d bytes, over %d", i, counts[i], length, BlockSizeBytes)
+		}
+
+		if counts[i] == 0 {
+			t.Errorf("block %d is empty", i)
+		}
+	}
+
+	if total != len(values) {
+		t.Fatalf("blocks hold %d items, want %d", total, len(values))
+	}
+
+	checkValues(t, storage, values)
+}
+
+func TestWriteKvItemsEncodedSizeIsExact(t *testing.T) {
+	values := map[string]string{
+		"plain":   "value",
+		"empty":   "",
+		"comma":   "a,b,c",
+		"quote":   `say "hi"`,
+		"newline": "line one\nline two\n",
+		"crlf":    "line one\r\nline two\r\n",
+		"return":  "line one\rline two\r",
+		"space":   " leading space",
+		"key\r\n": "crlf key",
+	}
+
+	storage := writeValues(t, values, thresholdOptions(0))
+	checkValues(t, storage, values)
+	checkValues(t, openStorage(t, storage.filePath, thresholdOptions(0)), values)
+	checkValues(t, writeValues(t, values, thresholdOptions(1)), values)
+
+	for key, value := range values {
+		it := NewKeyValueItem(key, value)
+		block := NewBlock(it.Key(), *keyValueItemsOrderedMap([]KeyValueItem{it}))
+		path := filepath.Join(t.TempDir(), key)
+		if _, err := writeBlock(OSFS{}, path, block, NoCompression); err != nil {
+			t.Fatal(err)
+		}
+
+		stat, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := encodedItemSize(it) + 1; stat.Size() != want {
+			t.Errorf("%s block is %d bytes, encoded size predicted %d", key, stat.Size(), want)
+		}
+	}
+}
+
+func TestCreateBlockOversizedItems(t *testing.T) {
+	items := []KeyValueItem{
+		NewKeyValueItem("a", "small"),
+		NewKeyValueItem("b", sizedValue(int(BlockSizeBytes)*3, 1)),
+		NewKeyValueItem("c", "small"),
+		NewKeyValueItem("d", sizedValue(int(BlockSizeBytes), 2)),
+	}
+
+	var blocks []Block
+	for start := 0; start < len(items); {
+		block, next := createBlock(items, start, BlockSizeBytes)
+		if next <= start {
+			t.Fatalf("createBlock made no progress at item %d", start)
+		}
+
+		blocks = append(blocks, block)
+		start = next
+	}
+
+	want := []int{1, 1, 1, 1}
+	if len(blocks) != len(want) {
+		t.Fatalf("got %d blocks, want %d", len(blocks), len(want))
+	}
+
+	for i, block := range blocks {
+		if len(block.Keys()) != want[i] {
+			t.Errorf("block %d has %d items, want %d", i, len(block.Keys()), want[i])
+		}
+	}
+}
+
+func TestWriteKvItemsSeparatedValueSizes(t *testing.T) {
+	values := make(map[string]string)
+	for i, size := range valueSizes {
+		values["key"+strconv.Itoa(i)] = sizedValue(size, i)
+	}
+
+	storage := writeValues(t, values, thresholdOptions(DEFAULT_VALUE_THRESHOLD))
+	checkValues(t, storage, values)
+
+	lengths, counts := blockLengths(t, storage)
+	for i, length := range lengths {
+		if length > BlockSizeBytes {
+			t.Errorf("block %d with %d items is %d bytes despite value log", i, counts[i], length)
+		}
+	}
+}
+
+func TestWriteKvItemsOptions(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(i*7, i)
+	}
+
+	opts := DefaultOptions()
+	opts.BlockSizeBytes = 512
+	opts.Compression = FlateCompression
+	opts.SyncPolicy = SyncAlways
+	opts.ValueThreshold = 2000
+	storage := writeValues(t, values, opts)
+	checkValues(t, storage, values)
+
+	reopened := openStorage(t, storage.filePath, opts)
+	if reopened.filter == nil {
+		t.Fatal("bloom filter was not loaded with the index")
+	}
+
+	checkValues(t, reopened, values)
+
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("missing%d", i)
+		block, err := reopened.ReadBlock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok, _ := block.Get(key); ok {
+			t.Fatalf("Get(%s) found a key that was never written", key)
+		}
+	}
+}
+
+func TestRangeSearchTablesStopsOnCancel(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(100, i)
+	}
+
+	storage := writeValues(t, values, thresholdOptions(0))
+	low, high := fmt.Sprintf("key%013d", 0), fmt.Sprintf("key%013d", 99)
+	items, err := RangeSearchTables(context.Background(), []BlockStorage{storage}, low, high)
+	if err != nil || len(items) != len(values) {
+		t.Fatalf("scan returned %d items, %v", len(items), err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = RangeSearchTables(ctx, []BlockStorage{storage}, low, high); err != context.Canceled {
+		t.Fatalf("cancelled scan returned %v", err)
+	}
+}
+
+func TestPrefixFilterSkipsTables(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 200; i++ {
+		values[fmt.Sprintf("tenant%02d/%05d", i%4, i)] = sizedValue(20, i)
+	}
+
+	opts := thresholdOptions(0)
+	opts.PrefixLength = len("tenant00")
+	storage := writeValues(t, values, opts)
+	reopened := openStorage(t, storage.filePath, opts)
+	for _, table := range []*SsBlockStorage{storage, reopened} {
+		if table.prefixFilter == nil {
+			t.Fatal("table has no prefix filter")
+		}
+
+		for _, prefix := range []string{"tenant01", "tenant03/0001", "tenant", ""} {
+			if !table.MayContainPrefix(prefix) {
+				t.Fatalf("table ruled out prefix %q it holds", prefix)
+			}
+		}
+
+		if table.MayContainPrefix("tenant99") || table.MayContainPrefix("tenant99/00001") {
+			t.Fatal("table did not rule out a prefix it does not hold")
+		}
+	}
+
+	opts.PrefixLength = len("tenant0")
+	if other := openStorage(t, storage.filePath, opts); !other.MayContainPrefix("tenant99") {
+		t.Fatal("table used a prefix filter built by another extractor")
+	}
+}
+
+func TestLoadOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	config := `{"BlockSizeBytes": 8192, "Compression": "flate", "SyncPolicy": "flush"}`
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	opts, err := LoadOptions(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := DefaultOptions()
+	want.BlockSizeBytes = 8192
+	want.Compression = FlateCompression
+	want.SyncPolicy = SyncFlush
+	if opts != want {
+		t.Fatalf("LoadOptions returned %+v, want %+v", opts, want)
+	}
+
+	if err = ioutil.WriteFile(path, []byte(`{"BlockSizeBytes": 0}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = LoadOptions(path); err == nil {
+		t.Fatal("LoadOptions accepted a zero block size")
+	}
+}
+
+func TestRangeTombstonesPersistUntilCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := thresholdOptions(0)
+	base := writeValues(t, map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}, opts)
+	tablePath := filepath.Join(dir, "000002.sst")
+	commands := []Command{NewRangeDeleteCommand("b", "d"), {Type: PUT_COMMAND, Item: NewKeyValueItem("c", "5")}}
+	if _, err := base.FlushTable(tablePath, commands); err != nil {
+		t.Fatal(err)
+	}
+
+	onlyPath := filepath.Join(dir, "000003.sst")
+	if _, err := base.FlushTable(onlyPath, []Command{NewRangeDeleteCommand("a", "b")}); err != nil {
+		t.Fatal(err)
+	}
+
+	table, err := base.OpenTable(tablePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	only, err := base.OpenTable(onlyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := RangeTombstones{{"b", "d"}}
+	if got := table.RangeTombstones(); len(got) != 1 || got[0] != want[0] {
+		t.Fatalf("reopened table holds range tombstones %v, want %v", got, want)
+	}
+
+	if got := only.RangeTombstones(); len(got) != 1 || !got.Covers("a") || got.Covers("b") {
+		t.Fatalf("reopened table of range tombstones alone holds %v", got)
+	}
+
+	compaction, err := base.Compact([]BlockStorage{only, table}, filepath.Join(dir, "000004.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := compaction.Install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openStorage(t, filepath.Join(dir, "000004.sst"), opts)
+	for _, storage := range []BlockStorage{merged, reopened} {
+		if len(storage.RangeTombstones()) != 0 {
+			t.Fatal("compaction kept range tombstones in the base table")
+		}
+
+		checkValues(t, storage, map[string]string{"c": "5", "d": "4"})
+		for _, key := range []string{"a", "b"} {
+			block, err := storage.ReadBlock(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, ok, _ := block.Get(key); ok {
+				t.Fatalf("compaction kept %s under a range tombstone", key)
+			}
+		}
+	}
+}
+
+func TestWriteKvItemsAppliesRangeTombstonesInOrder(t *testing.T) {
+	base := writeValues(t, map[string]string{"a": "1", "b": "2", "c": "3"}, thresholdOptions(0))
+	commands := []Command{
+		{Type: PUT_COMMAND, Item: NewKeyValueItem("a", "4")},
+		NewRangeDeleteCommand("a", "c"),
+		{Type: PUT_COMMAND, Item: NewKeyValueItem("b", "5")},
+	}
+
+	written, err := base.WriteKvItems(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkValues(t, written, map[string]string{"b": "5", "c": "3"})
+	block, err := written.ReadBlock("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, _ := block.Get("a"); ok {
+		t.Fatal("put before the range tombstone survived it")
+	}
+}
+
+// readCountingFS counts the opens of one file for reading.
+type readCountingFS struct {
+	FS
+	name  string
+	mu    sync.Mutex
+	reads int
+}
+
+func (fs *readCountingFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if name == fs.name && flag == os.O_RDONLY {
+		fs.mu.Lock()
+		fs.reads += 1
+		fs.mu.Unlock()
+	}
+
+	return fs.FS.OpenFile(name, flag, perm)
+}
+
+func TestMultiGetReadsEachBlockOnce(t *testing.T) {
+	values := make(map[string]string)
+	for i := 0; i < 500; i++ {
+		values[fmt.Sprintf("key%013d", i)] = sizedValue(20, i)
+	}
+
+	opts := thresholdOptions(0)
+	opts.BlockSizeBytes = 512
+	storage := writeValues(t, values, opts)
+	fs := &readCountingFS{FS: opts.FileSystem(), name: storage.filePath}
+	opts.FS = fs
+	reopened := openStorage(t, storage.filePath, opts)
+
+	keys := []string{"missing"}
+	blocks := make(map[int64]bool)
+	for i := 0; i < 500; i += 3 {
+		key := fmt.Sprintf("key%013d", i)
+		keys = append(keys, key)
+		blocks[searchIndex(reopened.index, key)] = true
+	}
+
+	fs.reads = 0
+	entries, err := reopened.MultiGet(context.Background(), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if entries[0].Found {
+		t.Fatal("MultiGet found a key that was never written")
+	}
+
+	for i, key := range keys[1:] {
+		if e := entries[i+1]; !e.Found || e.Deleted || e.Value != values[key] {
+			t.Fatalf("MultiGet(%s) = %+v", key, e)
+		}
+	}
+
+	if len(blocks) < 2 || fs.reads != len(blocks) {
+		t.Fatalf("MultiGet read the table %d times for %d blocks", fs.reads, len(blocks))
+	}
+}
+
+func TestBuiltinMergeOperators(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing string
+		exists   bool
+		operands []string
+		want     string
+		fails    bool
+	}{
+		{"int64add", "", false, []string{"2", "-5"}, "-3", false},
+		{"int64add", "40", true, []string{"1", "1"}, "42", false},
+		{"int64add", "x", true, []string{"1"}, "", true},
+		{"int64add", "1", true, []string{"1.5"}, "", true},
+		{"stringappend", "", false, []string{"a", "b"}, "a,b", false},
+		{"stringappend", "", true, []string{"a"}, ",a", false},
+	}
+
+	for _, test := range tests {
+		op, ok := LookupMergeOperator(test.name)
+		if !ok {
+			t.Fatalf("merge operator %s is not registered", test.name)
+		}
+
+		got, err := op.FullMerge("k", test.existing, test.exists, test.operands)
+		if (err != nil) != test.fails || got != test.want {
+			t.Errorf("%s of %q, %v with %q = %q, %v, want %q", test.name, test.existing, test.exists,
+				test.operands, got, err, test.want)
+		}
+	}
+
+	opts := DefaultOptions()
+	opts.MergeOperatorName = "missing"
+	if opts.Validate() == nil {
+		t.Fatal("options with an unknown merge operator validated")
+	}
+}
+
+func TestMergeOperandsFoldOnCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := thresholdOptions(4)
+	opts.MergeOperatorName = "int64add"
+	base := writeValues(t, map[string]string{"a": "1", "b": "100000", "d": "7"}, opts)
+
+	var commands []Command
+	for _, key := range []string{"a", "b", "c", "d"} {
+		cmd, err := NewMergeCommand(opts, key, "2", Entry{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cmd, err = NewMergeCommand(opts, key, "3", Entry{Value: cmd.Item.Value(), Operand: true, Found: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		commands = append(commands, cmd)
+	}
+
+	commands = append(commands, NewRangeDeleteCommand("d", "e"))
+	tablePath := filepath.Join(dir, "000002.sst")
+	table, err := base.FlushTable(tablePath, commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"a": "6", "b": "100005", "c": "5", "d": "5"}
+	items, err := RangeSearchTables(context.Background(), []BlockStorage{table, base}, "a", "z")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, it := range items {
+		if want[it.Key()] != it.Value() {
+			t.Fatalf("range search folded %s to %q, want %q", it.Key(), it.Value(), want[it.Key()])
+		}
+	}
+
+	if len(items) != len(want) {
+		t.Fatalf("range search returned %d items, want %d", len(items), len(want))
+	}
+
+	compaction, err := base.Compact([]BlockStorage{table}, filepath.Join(dir, "000003.sst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := compaction.Install()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkValues(t, merged, want)
+	reopened, err := NewSsTable(filepath.Join(dir, "000003.sst"), base.valueLogPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkValues(t, reopened, want)
+	if items, err = tableItems(merged.(*SsBlockStorage)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, it := range items {
+		if separated := int64(len(want[it.Key()])) > opts.ValueThreshold; it.Separated() != separated {
+			t.Fatalf("folded value of %s is separated %v, want %v", it.Key(), it.Separated(), separated)
+		}
+	}
+}
+
+func TestExpiringItemsKeepTheirExpiry(t *testing.T) {
+	dir := t.TempDir()
+	opts := thresholdOptions(4)
+	clock := NewManualClock(time.Unix(1700000000, 0))
+	opts.Clock = clock
+	storage := openStorage(t, filepath.Join(dir, "store"), opts)
+	expiresAt := clock.Now().Add(time.Minute)
+	commands := []Command{
+		{Type: PUT_COMMAND, Item: NewExpiringKeyValueItem("a", "1", expiresAt)},
+		{Type: PUT_COMMAND, Item: NewExpiringKeyValueItem("b", "separated", expiresAt)},
+		{Type: PUT_COMMAND, Item: NewKeyValueItem("c", "3")},
+	}
+
+	if _, err := storage.WriteKvItems(commands); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened := openStorage(t, filepath.Join(dir, "store"), opts)
+	for _, key := range []string{"a", "b"} {
+		block, err := reopened.ReadBlock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := block.GetEntry(key)
+		if err != nil || !e.Found || e.ExpiresAt != expiresAt.UnixNano() {
+			t.Fatalf("%s read back as %+v, %v, want it to expire at %d", key, e, err, expiresAt.UnixNano())
+		}
+	}
+
+	clock.Advance(time.Minute)
+	rewritten, err := reopened.WriteKvItems(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := tableItems(rewritten.(*SsBlockStorage))
+	if err != nil || len(items) != 1 || items[0].Key() != "c" {
+		t.Fatalf("rewrite after expiry kept %d items, %v, want only c", len(items), err)
+	}
+}
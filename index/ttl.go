@@ -0,0 +1,86 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EXPIRY_SEPARATOR comes between the size field of an item and the time it
+// expires, for items that do.
+const EXPIRY_SEPARATOR string = "@"
+
+// Clock tells the time entries with a TTL count from and expire by.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// ManualClock is a Clock that only moves when told to, so tests can expire
+// entries when they choose.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// Advance moves the clock on by d.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// Expired reports whether an entry expiring at expiresAt, in nanoseconds
+// since the epoch, has expired by now. Zero never expires.
+func Expired(expiresAt int64, now time.Time) bool {
+	return expiresAt != 0 && expiresAt <= now.UnixNano()
+}
+
+// NewExpiringKeyValueItem returns an item that reads as deleted from
+// expiresAt on.
+func NewExpiringKeyValueItem(key string, value string, expiresAt time.Time) KeyValueItem {
+	kv := NewKeyValueItem(key, value)
+	kv.expiresAt = expiresAt.UnixNano()
+	return kv
+}
+
+// ExpiresAt returns when the item expires in nanoseconds since the epoch,
+// or zero if it never does.
+func (k *KeyValueItem) ExpiresAt() int64 {
+	return k.expiresAt
+}
+
+// parseExpiry splits the time an item expires off its size field.
+func parseExpiry(sizeField string) (size string, expiresAt int64, err error) {
+	i := strings.Index(sizeField, EXPIRY_SEPARATOR)
+	if i < 0 {
+		return sizeField, 0, nil
+	}
+
+	expiresAt, err = strconv.ParseInt(sizeField[i+1:], 10, 64)
+	if err != nil || expiresAt <= 0 {
+		return "", 0, errors.New(fmt.Sprintf("Bad expiry %q", sizeField[i+1:]))
+	}
+
+	return sizeField[:i], expiresAt, nil
+}
@@ -0,0 +1,248 @@
+package index
+
+import (
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	DEFAULT_VALUE_THRESHOLD int64  = 1024
+	VALUE_LOG_SUFFIX        string = ".vlog"
+	VALUE_POINTER_SUFFIX    string = "p"
+)
+
+// ValuePointer locates a value that was moved out of an sstable block and
+// into the value log. Length is the size of the whole log record, with its
+// key and csv framing, so the records a table points at add up to the log
+// bytes it keeps live. Tables written before counted only the value bytes,
+// which overstates their garbage until it is collected.
+type ValuePointer struct {
+	Offset int64
+	Length int64
+}
+
+// logRecordSize is the number of bytes a log item takes up in the value
+// log, as AddLogItem writes it.
+func logRecordSize(it LogItem) int64 {
+	size := strconv.FormatInt(it.Size(), 10)
+	return encodedFieldSize(it.Key()) + encodedFieldSize(it.Value()) + int64(len(size)) + 3
+}
+
+func (p ValuePointer) String() string {
+	return fmt.Sprintf("%d:%d", p.Offset, p.Length)
+}
+
+func parseValuePointer(s string) (pointer ValuePointer, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return pointer, errors.New(fmt.Sprintf("Malformed value pointer %q", s))
+	}
+
+	pointer.Offset, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return pointer, err
+	}
+
+	pointer.Length, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return pointer, err
+	}
+
+	if pointer.Offset < 0 || pointer.Length < 0 {
+		return pointer, errors.New(fmt.Sprintf("Malformed value pointer %q", s))
+	}
+
+	return pointer, nil
+}
+
+func newValuePointerItem(key string, pointer ValuePointer) KeyValueItem {
+	value := pointer.String()
+	size := int64(len([]byte(key)) + len([]byte(value)))
+	return KeyValueItem{key, value, size, pointerItem, 0}
+}
+
+func valueLogPath(filePath string) string {
+	return filePath + VALUE_LOG_SUFFIX
+}
+
+func readValue(valueLog DataLog, item KeyValueItem) (value string, err error) {
+	if !item.Separated() {
+		return item.Value(), nil
+	}
+
+	pointer, err := parseValuePointer(item.Value())
+	if err != nil {
+		return "", &CorruptionError{valueLog.FilePath(), err}
+	}
+
+	logItem, err := valueLog.ReadLogItem(pointer.Offset)
+	if err == io.EOF {
+		return "", corruptionError(valueLog.FilePath(), "value of %s at %d is past the end", item.Key(),
+			pointer.Offset)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if logItem.Key() != item.Key() {
+		return "", corruptionError(valueLog.FilePath(), "value log entry at %d belongs to %s not %s",
+			pointer.Offset, logItem.Key(), item.Key())
+	}
+
+	return logItem.Value(), nil
+}
+
+// separateValues moves every inline value larger than threshold into the
+// value log, leaving a pointer behind. Items that are already pointers are
+// left untouched so compaction never rewrites value bytes.
+func separateValues(valueLog DataLog, items []KeyValueItem, threshold int64) error {
+	if threshold <= 0 {
+		return nil
+	}
+
+	moved := 0
+	for i, it := range items {
+		if it.Separated() || it.Operand() || int64(len([]byte(it.Value()))) <= threshold {
+			continue
+		}
+
+		logItem := NewLogItem(it.Key(), it.Value(), 0)
+		offset, err := valueLog.AddLogItem(logItem)
+		if err != nil {
+			return err
+		}
+
+		items[i] = newValuePointerItem(it.Key(), ValuePointer{offset, logRecordSize(logItem)})
+		items[i].expiresAt = it.expiresAt
+		moved += 1
+	}
+
+	log.Infof("Moved %d values into value log.", moved)
+	return nil
+}
+
+func liveValueBytes(items []KeyValueItem) int64 {
+	var live int64
+	for _, it := range items {
+		if !it.Separated() {
+			continue
+		}
+
+		pointer, err := parseValuePointer(it.Value())
+		if err == nil {
+			live += pointer.Length
+		}
+	}
+
+	return live
+}
+
+// ValueLogGarbageRatio is the share of the value log taken up by values the
+// sstable no longer points at. A table opened from disk counts the values it
+// points at the first time it is asked, reading all of its blocks.
+func (s *SsBlockStorage) ValueLogGarbageRatio() float64 {
+	stat, err := s.opts.FileSystem().Stat(s.valueLogPath)
+	if err != nil || stat.Size() == 0 {
+		return 0
+	}
+
+	if s.liveValueBytes < 0 {
+		items, err := tableItems(s)
+		if err != nil {
+			log.Errorf("Could not count live values of %s. %v", s.filePath, err)
+			return 0
+		}
+
+		s.liveValueBytes = liveValueBytes(items)
+	}
+
+	garbage := stat.Size() - s.liveValueBytes
+	if garbage < 0 {
+		return 0
+	}
+
+	return float64(garbage) / float64(stat.Size())
+}
+
+// CollectValueLog copies every value still referenced by the sstable into a
+// fresh value log at vlogPath and rewrites the sstable at filePath with the
+// relocated pointers. The old table and log are left for the caller to
+// remove once nothing refers to them, so both paths must be new: the log is
+// moved into place before the table pointing into it, and until the caller
+// records the new table a crash leaves the old pair as it was.
+func (s *SsBlockStorage) CollectValueLog(filePath string, vlogPath string) (BlockStorage, error) {
+	if filePath == s.filePath || vlogPath == s.valueLogPath {
+		return nil, errors.New(fmt.Sprintf("Cannot collect value log of %s in place", s.filePath))
+	}
+
+	log.Infof("Collecting garbage in value log for %s into %s.", s.filePath, vlogPath)
+	items, err := collectItemsToWrite(s, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	fs := s.opts.FileSystem()
+	tmpLogPath := TempFilePath(vlogPath)
+	fs.Remove(tmpLogPath)
+	newLog := NewSyncedLocalDataLog(fs, tmpLogPath, s.opts.SyncPolicy == SyncAlways)
+
+	relocated := 0
+	for i, it := range items {
+		if !it.Separated() {
+			continue
+		}
+
+		value, err := readValue(s.valueLog, it)
+		if err != nil {
+			log.Errorf("Could not read live value for %s from value log.", it.Key())
+			return nil, err
+		}
+
+		logItem := NewLogItem(it.Key(), value, 0)
+		offset, err := newLog.AddLogItem(logItem)
+		if err != nil {
+			return nil, err
+		}
+
+		items[i] = newValuePointerItem(it.Key(), ValuePointer{offset, logRecordSize(logItem)})
+		items[i].expiresAt = it.expiresAt
+		relocated += 1
+	}
+
+	log.Infof("Relocated %d live values into new value log.", relocated)
+	if err = syncValueLog(tmpLogPath, s.opts); err != nil {
+		return nil, err
+	}
+
+	tmpFilePath := TempFilePath(filePath)
+	footer, err := writeTable(tmpFilePath, items, s.rangeTombstones, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if relocated == 0 {
+		fs.Remove(tmpLogPath)
+	} else if err = replaceFile(fs, tmpLogPath, vlogPath, s.opts.syncFiles()); err != nil {
+		log.Error("Could not move new value log into place.")
+		return nil, err
+	}
+
+	if err = replaceFile(fs, tmpFilePath, filePath, s.opts.syncFiles()); err != nil {
+		log.Error("Could not move rewritten data file into place.")
+		return nil, err
+	}
+
+	log.Infof("Collected garbage in value log for %s.", s.filePath)
+	storage, err := newSsBlockStorage(filePath, vlogPath, footer, s.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	storage.liveValueBytes = liveValueBytes(items)
+	return storage, nil
+}
@@ -0,0 +1,246 @@
+package index
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	WAL_FILE     string = "WAL"
+	WAL_RECORD   string = "batch"
+	WAL_CHECKSUM string = "crc"
+	// WAL_WRITE_FIELDS is the number of fields each write of a batch takes:
+	// its family, command type, key, value and expiry.
+	WAL_WRITE_FIELDS int = 5
+)
+
+// WalPath names the write ahead log shared by the column families of the
+// store kept in dir.
+func WalPath(dir string) string {
+	return filepath.Join(dir, WAL_FILE)
+}
+
+// FamilyCommand is a write to the column family named Family. Merge
+// commands hold their operand as is, not yet folded onto a memtable entry.
+type FamilyCommand struct {
+	Family string
+	Command
+}
+
+// WalBatch is the writes of one batch, logged as a single record so a crash
+// keeps either all of them or none.
+type WalBatch struct {
+	Sequence uint64
+	Commands []FamilyCommand
+}
+
+func (b WalBatch) fields() []string {
+	fields := make([]string, 0, 2+WAL_WRITE_FIELDS*len(b.Commands))
+	fields = append(fields, WAL_RECORD, strconv.FormatUint(b.Sequence, 10))
+	for _, cmd := range b.Commands {
+		fields = append(fields, cmd.Family, cmd.Type, strconv.Quote(cmd.Item.Key()),
+			strconv.Quote(cmd.Item.Value()), strconv.FormatInt(cmd.Item.ExpiresAt(), 10))
+	}
+
+	return fields
+}
+
+func walChecksum(fields []string) string {
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(strings.Join(fields, ","))))
+}
+
+// record encodes the batch as a single csv line ending in a checksum. Keys
+// and values are quoted so newlines in them do not split the line.
+func (b WalBatch) record() (string, error) {
+	fields := b.fields()
+	fields = append(fields, WAL_CHECKSUM, walChecksum(fields))
+	var sb strings.Builder
+	w := csv.NewWriter(&sb)
+	if err := w.Write(fields); err != nil {
+		return "", err
+	}
+
+	w.Flush()
+	return sb.String(), w.Error()
+}
+
+func parseWalBatch(record []string) (b WalBatch, err error) {
+	n := len(record)
+	if n < 4 || record[0] != WAL_RECORD || record[n-2] != WAL_CHECKSUM || (n-4)%WAL_WRITE_FIELDS != 0 {
+		return b, errors.New(fmt.Sprintf("Malformed write ahead log record of %d fields", n))
+	}
+
+	if walChecksum(record[:n-2]) != record[n-1] {
+		return b, errors.New(fmt.Sprintf("Write ahead log record checksum mismatch at %s", record[1]))
+	}
+
+	if b.Sequence, err = strconv.ParseUint(record[1], 10, 64); err != nil {
+		return b, errors.New(fmt.Sprintf("Bad write ahead log sequence %q", record[1]))
+	}
+
+	for fields := record[2 : n-2]; len(fields) > 0; fields = fields[WAL_WRITE_FIELDS:] {
+		family, typ := fields[0], fields[1]
+		key, err := strconv.Unquote(fields[2])
+		if err != nil {
+			return b, errors.New(fmt.Sprintf("Bad key %s in write ahead log", fields[2]))
+		}
+
+		value, err := strconv.Unquote(fields[3])
+		if err != nil {
+			return b, errors.New(fmt.Sprintf("Bad value %s in write ahead log", fields[3]))
+		}
+
+		expiresAt, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil || expiresAt < 0 {
+			return b, errors.New(fmt.Sprintf("Bad expiry %q in write ahead log", fields[4]))
+		}
+
+		switch typ {
+		case PUT_COMMAND, DEL_COMMAND, MERGE_COMMAND, DELRANGE_COMMAND:
+		default:
+			return b, errors.New(fmt.Sprintf("Unknown write ahead log command %q", typ))
+		}
+
+		item := NewKeyValueItem(key, value)
+		if expiresAt > 0 {
+			item = NewExpiringKeyValueItem(key, value, time.Unix(0, expiresAt))
+		}
+
+		b.Commands = append(b.Commands, FamilyCommand{family, Command{Type: typ, Item: item}})
+	}
+
+	return b, nil
+}
+
+// ReadWriteAheadLog returns the batches logged in the write ahead log of
+// dir, oldest first, or none if there is no log. A damaged final record is
+// what a crash mid-append leaves behind and is skipped, while damage before
+// it means the log cannot be trusted.
+func ReadWriteAheadLog(dir string, opts Options) ([]WalBatch, error) {
+	path := WalPath(dir)
+	data, err := readFile(opts.FileSystem(), path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	var batches []WalBatch
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+
+		record, err := csv.NewReader(strings.NewReader(line)).Read()
+		var b WalBatch
+		if err == nil && !strings.HasSuffix(line, "\n") {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err == nil {
+			b, err = parseWalBatch(record)
+		}
+
+		last := i == len(lines)-1 || (i == len(lines)-2 && lines[i+1] == "")
+		if err != nil && last {
+			log.Warnf("Ignoring incomplete final batch in %s. %v", path, err)
+			break
+		}
+
+		if err != nil {
+			return nil, corruptionError(path, "write ahead log batch %d: %v", len(batches)+1, err)
+		}
+
+		batches = append(batches, b)
+	}
+
+	log.Infof("Read %d batches from write ahead log %s.", len(batches), path)
+	return batches, nil
+}
+
+// WriteAheadLog appends batches of writes to the column families of a
+// store, so those not yet flushed are replayed after a crash.
+type WriteAheadLog struct {
+	path       string
+	file       File
+	size       int64
+	syncWrites bool
+	// err is the error of a failed append, returned by every later one.
+	err error
+}
+
+// CreateWriteAheadLog starts an empty write ahead log in dir, replacing any
+// log already there.
+func CreateWriteAheadLog(dir string, opts Options) (*WriteAheadLog, error) {
+	fs := opts.FileSystem()
+	path := WalPath(dir)
+	f, err := fs.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.syncFiles() {
+		if err = f.Sync(); err == nil {
+			err = fs.SyncDir(dir)
+		}
+	}
+
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &WriteAheadLog{path: path, file: f, syncWrites: opts.syncFiles()}, nil
+}
+
+// Append logs b, syncing it unless under SyncNone, so a write is durable
+// once it returns. A failed append may leave
+// part of the record behind, so the log takes no more appends after one.
+func (w *WriteAheadLog) Append(b WalBatch) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	record, err := b.record()
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(w.file, record); err != nil {
+		log.Errorf("Could not append to write ahead log %s. %v", w.path, err)
+		w.err = err
+		return err
+	}
+
+	if w.syncWrites {
+		if err = w.file.Sync(); err != nil {
+			log.Errorf("Could not sync write ahead log %s. %v", w.path, err)
+			w.err = err
+			return err
+		}
+	}
+
+	w.size += int64(len(record))
+	return nil
+}
+
+// Size is the number of bytes appended since the log was created.
+func (w *WriteAheadLog) Size() int64 {
+	return w.size
+}
+
+func (w *WriteAheadLog) Close() error {
+	return w.file.Close()
+}
@@ -0,0 +1,128 @@
+package index
+
+import (
+	"sync"
+)
+
+// WriteBufferManager caps the memory used by memtables across every store
+// sharing it. Stores reserve memory as their memtable grows and free it once
+// the memtable is flushed. Once the buffer is used up, the store holding the
+// most memory is the one to flush, so a store writing little does not flush
+// tiny memtables while an idle one holds most of the buffer.
+type WriteBufferManager struct {
+	mu          sync.Mutex
+	bufferSize  int64
+	memoryUsage int64
+	// usage is the memory reserved by each store, by the owner it gave.
+	usage map[interface{}]int64
+	// flushes are the functions stores registered to be asked to flush.
+	flushes map[interface{}]func()
+	// requested holds the stores asked to flush that have not freed memory
+	// since.
+	requested map[interface{}]bool
+}
+
+func NewWriteBufferManager(bufferSize int64) *WriteBufferManager {
+	return &WriteBufferManager{bufferSize: bufferSize, usage: make(map[interface{}]int64),
+		flushes: make(map[interface{}]func()), requested: make(map[interface{}]bool)}
+}
+
+// Register gives the function that asks the store owner to flush its
+// memtable. It is called in its own goroutine, once the buffer is used up
+// and owner holds the most memory while another store reserves more.
+func (w *WriteBufferManager) Register(owner interface{}, flush func()) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.flushes[owner] = flush
+}
+
+// Unregister forgets owner once it is closed and has freed its memory.
+func (w *WriteBufferManager) Unregister(owner interface{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.flushes, owner)
+	delete(w.usage, owner)
+	delete(w.requested, owner)
+}
+
+// largest returns the store holding the most memory. It is called with mu
+// held.
+func (w *WriteBufferManager) largest() (owner interface{}) {
+	most := int64(0)
+	for o, usage := range w.usage {
+		if usage > most {
+			owner, most = o, usage
+		}
+	}
+
+	return owner
+}
+
+func (w *WriteBufferManager) full() bool {
+	return w.bufferSize > 0 && w.memoryUsage >= w.bufferSize
+}
+
+// ReserveMem counts size more bytes of memtable memory against owner. If
+// that uses up the buffer while another store holds more, that store is
+// asked to flush.
+func (w *WriteBufferManager) ReserveMem(owner interface{}, size int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.memoryUsage += size
+	w.usage[owner] += size
+	if !w.full() {
+		return
+	}
+
+	largest := w.largest()
+	flush, ok := w.flushes[largest]
+	if largest == owner || !ok || w.requested[largest] {
+		return
+	}
+
+	w.requested[largest] = true
+	go flush()
+}
+
+// FreeMem returns size bytes of memtable memory owner has flushed.
+func (w *WriteBufferManager) FreeMem(owner interface{}, size int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.memoryUsage -= size
+	if w.memoryUsage < 0 {
+		w.memoryUsage = 0
+	}
+
+	w.usage[owner] -= size
+	if w.usage[owner] <= 0 {
+		delete(w.usage, owner)
+	}
+
+	delete(w.requested, owner)
+}
+
+func (w *WriteBufferManager) MemoryUsage() int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.memoryUsage
+}
+
+// OwnerMemoryUsage is the memory owner has reserved and not yet freed.
+func (w *WriteBufferManager) OwnerMemoryUsage(owner interface{}) int64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.usage[owner]
+}
+
+func (w *WriteBufferManager) BufferSize() int64 {
+	return w.bufferSize
+}
+
+// ShouldFlush reports whether the stores sharing the manager have used up
+// the buffer and owner holds the most memory of them, so flushing its
+// memtable frees the most.
+func (w *WriteBufferManager) ShouldFlush(owner interface{}) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.full() && w.largest() == owner
+}
@@ -3,14 +3,30 @@ package main
 import (
 	"flag"
 	"github.com/shimanekb/project2-B/controller"
+	"github.com/shimanekb/project2-B/index"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 )
 
 func main() {
+	defaults := index.DefaultOptions()
 	var logFlag *bool = flag.Bool("logs", false, "Enable logs")
 	var storeFlag *string = flag.String("store_file", "data_records.txt", "Set name of store file.")
+	var configFlag *string = flag.String("config", "", "Load store options from a json config file.")
+	var storageDirFlag *string = flag.String("storage_dir", defaults.StorageDir, "Set directory store files are kept in.")
+	var blockSizeFlag *int64 = flag.Int64("block_size", defaults.BlockSizeBytes, "Set size in bytes of sstable blocks.")
+	var memTableFlag *int64 = flag.Int64("memtable_bytes", defaults.MemTableBytes, "Set approximate memtable memory in bytes before a flush.")
+	var writeBufferFlag *int64 = flag.Int64("write_buffer_size", defaults.WriteBufferSize, "Set memtable memory cap in bytes shared by all stores, 0 disables.")
+	var blockCacheFlag *int = flag.Int("block_cache_size", defaults.BlockCacheSize, "Set number of blocks cached per sstable.")
+	var bloomFlag *int = flag.Int("bloom_bits", defaults.BloomBitsPerKey, "Set bloom filter bits per key, 0 disables.")
+	var prefixFlag *int = flag.Int("prefix_length", defaults.PrefixLength, "Set length in bytes of key prefixes kept in prefix bloom filters, 0 disables.")
+	var mergeFlag *string = flag.String("merge_operator", defaults.MergeOperatorName, "Set merge operator, int64add or stringappend.")
+	var compressionFlag *string = flag.String("compression", defaults.Compression.String(), "Set block compression, none or flate.")
+	var syncFlag *string = flag.String("sync", defaults.SyncPolicy.String(), "Set sync policy, none, flush or always.")
+	var thresholdFlag *int64 = flag.Int64("value_threshold", defaults.ValueThreshold,
+		"Values larger than this many bytes are kept in a separate value log, 0 disables.")
+	var readOnlyFlag *bool = flag.Bool("read_only", defaults.ReadOnly, "Open an existing store for reading only.")
 	flag.Parse()
 
 	if *logFlag {
@@ -21,6 +37,50 @@ func main() {
 		log.SetOutput(ioutil.Discard)
 	}
 
+	opts := defaults
+	if *configFlag != "" {
+		var err error
+		opts, err = index.LoadOptions(*configFlag)
+		if err != nil {
+			log.Fatalln("Could not load config file.", err)
+		}
+	}
+
+	// flags given on the command line override the config file
+	var flagErr error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "storage_dir":
+			opts.StorageDir = *storageDirFlag
+		case "block_size":
+			opts.BlockSizeBytes = *blockSizeFlag
+		case "memtable_bytes":
+			opts.MemTableBytes = *memTableFlag
+		case "write_buffer_size":
+			opts.WriteBufferSize = *writeBufferFlag
+		case "block_cache_size":
+			opts.BlockCacheSize = *blockCacheFlag
+		case "bloom_bits":
+			opts.BloomBitsPerKey = *bloomFlag
+		case "prefix_length":
+			opts.PrefixLength = *prefixFlag
+		case "merge_operator":
+			opts.MergeOperatorName = *mergeFlag
+		case "compression":
+			flagErr = opts.Compression.UnmarshalText([]byte(*compressionFlag))
+		case "sync":
+			flagErr = opts.SyncPolicy.UnmarshalText([]byte(*syncFlag))
+		case "value_threshold":
+			opts.ValueThreshold = *thresholdFlag
+		case "read_only":
+			opts.ReadOnly = *readOnlyFlag
+		}
+	})
+
+	if flagErr != nil {
+		log.Fatalln("Invalid option flag.", flagErr)
+	}
+
 	var storeFile string = *storeFlag
 
 	args := flag.Args()
@@ -30,5 +90,5 @@ func main() {
 
 	filePath := args[0]
 	outputPath := args[1]
-	controller.ReadCsvCommands(filePath, outputPath, storeFile)
+	controller.ReadCsvCommands(filePath, outputPath, storeFile, opts)
 }
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+)
+
+// needsCompaction reports whether enough L0 tables have built up to merge
+// them into the base sstable.
+func (s *SsStore) needsCompaction() bool {
+	l0 := len(s.tables)
+	if l0 == 0 {
+		return false
+	}
+
+	if l0 >= s.opts.L0CompactionTrigger {
+		return true
+	}
+
+	soft := s.opts.SoftPendingCompactionBytes
+	hard := s.opts.HardPendingCompactionBytes
+	return (soft > 0 && s.pendingCompactionBytes >= soft) ||
+		(hard > 0 && s.pendingCompactionBytes >= hard)
+}
+
+// flushLoop writes full memtables into new L0 tables, oldest first.
+func (s *SsStore) flushLoop() {
+	defer s.background.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for !s.closed && (len(s.immutables) == 0 || s.bgErr != nil) {
+			s.cond.Wait()
+		}
+
+		if s.closed {
+			return
+		}
+
+		mem := s.immutables[0]
+		number := s.manifest.NewFileNumber()
+		base := s.blockStorage
+		s.flushing = true
+		s.mu.Unlock()
+
+		log.Infof("Writing %d items from immutable memcache into L0 table %d.", mem.Size(), number)
+		table, err := base.FlushTable(index.TableFileName(s.dir, number), convertToKeyValueItems(mem))
+
+		s.mu.Lock()
+		s.flushing = false
+		if err == nil {
+			err = s.manifest.LogAndApply(index.VersionEdit{
+				LastSequence: mem.lastSequence,
+				Added:        []index.TableMeta{{Level: 0, Number: number, Size: table.FileSize()}},
+			})
+		}
+
+		if err != nil {
+			log.Errorf("Could not flush items into new ss table. %v", err)
+			s.bgErr = &BackgroundError{err}
+			s.cond.Broadcast()
+			continue
+		}
+
+		s.tables = append([]levelTable{{number, table}}, s.tables...)
+		s.pendingCompactionBytes += table.FileSize()
+		s.immutables = s.immutables[1:]
+		if s.opts.WriteBufferManager != nil {
+			s.opts.WriteBufferManager.FreeMem(s, mem.ApproximateMemoryUsage())
+		}
+
+		s.stats.Flushes += 1
+		log.Infof("Flushed L0 table %d, %d L0 tables pending compaction.", number, len(s.tables))
+		s.cond.Broadcast()
+	}
+}
+
+// compactLoop merges the L0 tables into the base sstable whenever enough of
+// them pile up. Tables flushed while a compaction runs are left for the next
+// one.
+func (s *SsStore) compactLoop() {
+	defer s.background.Done()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for !s.closed && (!s.needsCompaction() || s.bgErr != nil) {
+			s.cond.Wait()
+		}
+
+		if s.closed {
+			return
+		}
+
+		tables := append([]levelTable{}, s.tables...)
+		base := s.blockStorage
+		number := s.manifest.NewFileNumber()
+		s.compacting = true
+		s.mu.Unlock()
+
+		compaction, err := base.Compact(storages(tables), index.TableFileName(s.dir, number))
+
+		s.mu.Lock()
+		var storage index.BlockStorage
+		if err == nil {
+			storage, err = compaction.Install()
+		}
+
+		edit := index.VersionEdit{}
+		obsolete := make([]string, 0, len(tables)+1)
+		for _, table := range tables {
+			edit.Removed = append(edit.Removed, table.number)
+			obsolete = append(obsolete, index.TableFileName(s.dir, table.number))
+		}
+
+		if s.baseNumber > 0 {
+			edit.Removed = append(edit.Removed, s.baseNumber)
+			obsolete = append(obsolete, index.TableFileName(s.dir, s.baseNumber))
+		}
+
+		if err == nil {
+			edit.Added = []index.TableMeta{{Level: 1, Number: number, Size: storage.FileSize()}}
+			err = s.manifest.LogAndApply(edit)
+		}
+
+		s.compacting = false
+		if err != nil {
+			log.Errorf("Could not compact L0 tables. %v", err)
+			s.bgErr = &BackgroundError{err}
+			s.cond.Broadcast()
+			continue
+		}
+
+		s.dropFiles(obsolete...)
+		s.blockStorage = storage
+		s.baseNumber = number
+		s.tables = s.tables[:len(s.tables)-len(tables)]
+		s.pendingCompactionBytes = 0
+		for _, table := range s.tables {
+			s.pendingCompactionBytes += table.FileSize()
+		}
+
+		s.stats.Compactions += 1
+		log.Infof("Compacted %d L0 tables into base table.", len(tables))
+		if len(s.tables) == 0 && !s.flushing {
+			if err = s.collectValueLog(); err != nil {
+				s.bgErr = &BackgroundError{err}
+			}
+		}
+
+		s.cond.Broadcast()
+	}
+}
+
+// collectValueLog relocates live values into a fresh value log once enough
+// of the current one is taken up by overwritten or deleted values. It is
+// only called with mu held while no L0 table or flush refers to the log.
+func (s *SsStore) collectValueLog() error {
+	ratio := s.blockStorage.ValueLogGarbageRatio()
+	if ratio < VALUE_LOG_GC_RATIO {
+		return nil
+	}
+
+	log.Infof("Value log garbage ratio is %.2f, collecting garbage.", ratio)
+	oldLogNumber := s.manifest.ValueLogNumber()
+	number := s.manifest.NewFileNumber()
+	logNumber := s.manifest.NewFileNumber()
+	str, err := s.blockStorage.CollectValueLog(index.TableFileName(s.dir, number),
+		index.ValueLogFileName(s.dir, logNumber))
+	if err == nil {
+		err = s.manifest.LogAndApply(index.VersionEdit{
+			ValueLogNumber: logNumber,
+			Added:          []index.TableMeta{{Level: 1, Number: number, Size: str.FileSize()}},
+			Removed:        []int{s.baseNumber},
+		})
+	}
+
+	if err != nil {
+		log.Errorf("Could not collect value log garbage. %v", err)
+		return err
+	}
+
+	s.dropFiles(index.TableFileName(s.dir, s.baseNumber), index.ValueLogFileName(s.dir, oldLogNumber))
+	s.blockStorage = str
+	s.baseNumber = number
+	return nil
+}
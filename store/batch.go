@@ -0,0 +1,119 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"time"
+)
+
+// WriteBatch collects writes to the column families of a DB, which
+// DB.Write makes as one, so they are logged and become visible together.
+// Writes to the same key take effect in the order they were added.
+type WriteBatch struct {
+	writes []batchWrite
+}
+
+type batchWrite struct {
+	index.FamilyCommand
+	// ttl, when set, is counted from when the batch is written by the clock
+	// of the family.
+	ttl time.Duration
+}
+
+func (b *WriteBatch) add(family string, typ string, item index.KeyValueItem, ttl time.Duration) {
+	cmd := index.FamilyCommand{Family: family, Command: index.Command{Type: typ, Item: item}}
+	b.writes = append(b.writes, batchWrite{cmd, ttl})
+}
+
+func (b *WriteBatch) Put(family string, key string, value string) {
+	b.add(family, PUT_COMMAND, index.NewKeyValueItem(key, value), 0)
+}
+
+// PutWithTTL sets key of family to value until ttl has passed, as
+// Store.PutWithTTL does.
+func (b *WriteBatch) PutWithTTL(family string, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New(fmt.Sprintf("TTL of key %s must be positive, got %s", key, ttl))
+	}
+
+	b.add(family, PUT_COMMAND, index.NewKeyValueItem(key, value), ttl)
+	return nil
+}
+
+func (b *WriteBatch) Del(family string, key string) {
+	b.add(family, DEL_COMMAND, index.NewKeyValueItem(key, ""), 0)
+}
+
+// DeleteRange deletes the keys of family from start up to but not including
+// end. Writing a batch with a range whose end is not after its start fails
+// with ErrInvalidArgument.
+func (b *WriteBatch) DeleteRange(family string, start string, end string) {
+	b.add(family, index.DELRANGE_COMMAND, index.NewKeyValueItem(start, end), 0)
+}
+
+// Merge records operand for key of family, to be folded onto its value by
+// the merge operator of the family's options.
+func (b *WriteBatch) Merge(family string, key string, operand string) {
+	b.add(family, index.MERGE_COMMAND, index.NewKeyValueItem(key, operand), 0)
+}
+
+// Len is the number of writes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.writes)
+}
+
+// batchGet looks key up in the memtable as it will be once the commands
+// prepared so far are added to it.
+func batchGet(cache MemTable, prepared []index.Command, key string) index.Entry {
+	for i := len(prepared) - 1; i >= 0; i-- {
+		cmd := prepared[i]
+		if cmd.Type == index.DELRANGE_COMMAND {
+			t := index.RangeTombstone{Start: cmd.Item.Key(), End: cmd.Item.Value()}
+			if t.Covers(key) {
+				return index.Entry{Deleted: true, Found: true}
+			}
+		} else if cmd.Item.Key() == key {
+			return commandEntry(cmd)
+		}
+	}
+
+	return cacheGet(cache, key)
+}
+
+// prepareBatch is called with mu held to turn the writes of a batch to the
+// store into memtable commands, folding merges onto what the memtable, or
+// an earlier write of the batch, holds for their key. Nothing is added to
+// the memtable, so a merge that fails leaves the store as it was.
+func (s *SsStore) prepareBatch(cmds []index.Command) ([]index.Command, error) {
+	prepared := make([]index.Command, 0, len(cmds))
+	for _, cmd := range cmds {
+		if cmd.Type == index.MERGE_COMMAND {
+			key := cmd.Item.Key()
+			merged, err := index.NewMergeCommand(s.opts, key, cmd.Item.Value(), batchGet(s.cache, prepared, key))
+			if err != nil {
+				return nil, err
+			}
+
+			cmd = merged
+		}
+
+		prepared = append(prepared, cmd)
+	}
+
+	return prepared, nil
+}
+
+// commitBatch is called with mu held to add prepared commands to the
+// memtable as the write numbered sequence.
+func (s *SsStore) commitBatch(sequence uint64, prepared []index.Command) {
+	for _, cmd := range prepared {
+		if cmd.Type != index.DELRANGE_COMMAND {
+			s.addToCache(cmd.Item.Key(), cmd)
+		} else {
+			s.addRangeTombstone(cmd.Item.Key(), cmd.Item.Value())
+		}
+	}
+
+	s.lastSequence = sequence
+}
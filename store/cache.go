@@ -2,8 +2,13 @@ package store
 
 import (
 	lru "github.com/hashicorp/golang-lru"
+	"github.com/shimanekb/project2-B/index"
 )
 
+// MEMTABLE_ENTRY_OVERHEAD approximates the bytes a memtable entry uses beyond
+// its key and value, covering the map slot, command and item headers.
+const MEMTABLE_ENTRY_OVERHEAD int64 = 96
+
 type Cache interface {
 	Get(key string) (value interface{}, ok bool)
 	Add(key string, value interface{})
@@ -12,12 +17,41 @@ type Cache interface {
 	Size() int
 }
 
+// MemTable is a Cache that also tracks roughly how much memory its entries
+// take up, so it can be flushed on a byte budget. It holds range tombstones
+// besides its entries, and counts them in its Size.
+type MemTable interface {
+	Cache
+	ApproximateMemoryUsage() int64
+	// AddRangeTombstone deletes the keys t covers. Entries of those keys
+	// held by the memtable are older than t, so they are removed.
+	AddRangeTombstone(t index.RangeTombstone)
+	RangeTombstones() index.RangeTombstones
+}
+
 type MemTableCache struct {
-	m map[string]interface{}
+	m               map[string]interface{}
+	rangeTombstones index.RangeTombstones
+	memoryUsage     int64
+}
+
+// entryMemoryUsage counts the key once, as the command item shares it.
+func entryMemoryUsage(key string, value interface{}) int64 {
+	size := int64(len(key)) + MEMTABLE_ENTRY_OVERHEAD
+	if cmd, ok := value.(index.Command); ok {
+		size += int64(len(cmd.Item.Value()))
+	}
+
+	return size
 }
 
 func (t *MemTableCache) Add(key string, value interface{}) {
+	if old, ok := t.m[key]; ok {
+		t.memoryUsage -= entryMemoryUsage(key, old)
+	}
+
 	t.m[key] = value
+	t.memoryUsage += entryMemoryUsage(key, value)
 }
 
 func (t *MemTableCache) Get(key string) (value interface{}, ok bool) {
@@ -26,9 +60,28 @@ func (t *MemTableCache) Get(key string) (value interface{}, ok bool) {
 }
 
 func (t *MemTableCache) Remove(key string) {
+	if old, ok := t.m[key]; ok {
+		t.memoryUsage -= entryMemoryUsage(key, old)
+	}
+
 	delete(t.m, key)
 }
 
+func (t *MemTableCache) AddRangeTombstone(rt index.RangeTombstone) {
+	for key := range t.m {
+		if rt.Covers(key) {
+			t.Remove(key)
+		}
+	}
+
+	t.rangeTombstones = append(t.rangeTombstones, rt)
+	t.memoryUsage += int64(len(rt.Start)+len(rt.End)) + MEMTABLE_ENTRY_OVERHEAD
+}
+
+func (t *MemTableCache) RangeTombstones() index.RangeTombstones {
+	return t.rangeTombstones
+}
+
 func (t *MemTableCache) Keys() []string {
 	keys := make([]string, 0, len(t.m))
 	for k := range t.m {
@@ -39,12 +92,16 @@ func (t *MemTableCache) Keys() []string {
 }
 
 func (t *MemTableCache) Size() int {
-	return len(t.m)
+	return len(t.m) + len(t.rangeTombstones)
+}
+
+func (t *MemTableCache) ApproximateMemoryUsage() int64 {
+	return t.memoryUsage
 }
 
-func NewMemTableCache() Cache {
+func NewMemTableCache() MemTable {
 	m := make(map[string]interface{})
-	return &MemTableCache{m}
+	return &MemTableCache{m, nil, 0}
 }
 
 type LruCache struct {
@@ -72,8 +129,8 @@ func (l *LruCache) Size() int {
 	return l.Lru.Len()
 }
 
-func NewLruCache() (Cache, error) {
+func NewLruCache(size int) (Cache, error) {
 	var cache *lru.ARCCache
-	cache, err := lru.NewARC(1000)
+	cache, err := lru.NewARC(size)
 	return &LruCache{cache}, err
 }
@@ -0,0 +1,76 @@
+package store
+
+import (
+	"errors"
+	"github.com/shimanekb/project2-B/index"
+	"path/filepath"
+	"testing"
+)
+
+const CLOSE_STORE_DIR string = "/db/close"
+
+func TestCloseReleasesStore(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	st, err := Open(CLOSE_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Put(crashKey(0), "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = Open(CLOSE_STORE_DIR, opts); !errors.Is(err, ErrLocked) {
+		t.Fatalf("opening an open store returned %v", err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Close(); err != ErrClosed {
+		t.Fatalf("second Close returned %v", err)
+	}
+
+	if err = st.Put(crashKey(1), "lost"); err != ErrClosed {
+		t.Fatalf("Put after Close returned %v", err)
+	}
+
+	if _, _, err = st.Get(crashKey(0)); err != ErrClosed {
+		t.Fatalf("Get after Close returned %v", err)
+	}
+
+	reopened, err := Open(CLOSE_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer reopened.Close()
+	if value, found, err := reopened.Get(crashKey(0)); err != nil || !found || value != "kept" {
+		t.Fatalf("Get after reopening returned %q, %v, %v", value, found, err)
+	}
+}
+
+func TestOpenLocksStoreDirOnDisk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	st, err := Open(dir, index.DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = Open(dir, index.DefaultOptions())
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("opening a locked store returned %v", err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err = Open(dir, index.DefaultOptions())
+	if err != nil {
+		t.Fatalf("could not open store after Close: %v", err)
+	}
+
+	st.Close()
+}
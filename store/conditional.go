@@ -0,0 +1,95 @@
+package store
+
+import (
+	"context"
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+)
+
+// CompareAndSwap sets key to value if it holds expected, reporting whether
+// it did. It fails with ErrNotFound if key is missing.
+func (s *SsStore) CompareAndSwap(key string, expected string, value string) (swapped bool, err error) {
+	return s.CompareAndSwapContext(context.Background(), key, expected, value)
+}
+
+// CompareAndSwapContext is CompareAndSwap that gives up waiting for a
+// stalled write, or reading tables, once ctx is done.
+func (s *SsStore) CompareAndSwapContext(ctx context.Context, key string, expected string, value string) (swapped bool, err error) {
+	cmd := index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(key, value)}
+	return s.writeIf(ctx, cmd, holds(expected))
+}
+
+// PutIfAbsent sets key to value if it is missing, reporting whether it did.
+func (s *SsStore) PutIfAbsent(key string, value string) (put bool, err error) {
+	return s.PutIfAbsentContext(context.Background(), key, value)
+}
+
+// PutIfAbsentContext is PutIfAbsent that gives up waiting for a stalled
+// write, or reading tables, once ctx is done.
+func (s *SsStore) PutIfAbsentContext(ctx context.Context, key string, value string) (put bool, err error) {
+	cmd := index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(key, value)}
+	return s.writeIf(ctx, cmd, absent)
+}
+
+// DeleteIfEquals deletes key if it holds expected, reporting whether it
+// did. It fails with ErrNotFound if key is missing.
+func (s *SsStore) DeleteIfEquals(key string, expected string) (deleted bool, err error) {
+	return s.DeleteIfEqualsContext(context.Background(), key, expected)
+}
+
+// DeleteIfEqualsContext is DeleteIfEquals that gives up waiting for a
+// stalled write, or reading tables, once ctx is done.
+func (s *SsStore) DeleteIfEqualsContext(ctx context.Context, key string, expected string) (deleted bool, err error) {
+	cmd := index.Command{Type: DEL_COMMAND, Item: index.NewKeyValueItem(key, "")}
+	return s.writeIf(ctx, cmd, holds(expected))
+}
+
+// holds is the check of a conditional write that the key holds expected,
+// failing with ErrNotFound if it is missing.
+func holds(expected string) func(current string, found bool) (bool, error) {
+	return func(current string, found bool) (bool, error) {
+		if !found {
+			return false, ErrNotFound
+		}
+
+		return current == expected, nil
+	}
+}
+
+// absent is the check of a conditional write that the key is missing.
+func absent(current string, found bool) (bool, error) {
+	return !found, nil
+}
+
+// writeIf adds cmd to the memtable if check passes on the current value of
+// its key, reporting whether it did. The write lock is held from the check
+// through the write, so no other write to the store comes between them.
+func (s *SsStore) writeIf(ctx context.Context, cmd index.Command, check func(current string, found bool) (bool, error)) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := cmd.Item.Key()
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		log.Errorf("Could not make room for a conditional %s of key %s. %v", cmd.Type, key, err)
+		return false, err
+	}
+
+	current, found, err := s.get(ctx, key)
+	if err != nil {
+		return false, err
+	}
+
+	ok, err := check(current, found)
+	if !ok || err != nil {
+		log.Infof("Condition on key %s not met, skipping %s.", key, cmd.Type)
+		return false, err
+	}
+
+	s.lastSequence += 1
+	s.addToCache(key, cmd)
+	return true, nil
+}
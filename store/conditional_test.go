@@ -0,0 +1,109 @@
+package store
+
+import (
+	"errors"
+	"github.com/shimanekb/project2-B/index"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+const (
+	CAS_WRITERS    int = 8
+	CAS_INCREMENTS int = 50
+)
+
+func TestConditionalWrites(t *testing.T) {
+	st, err := Open(CRASH_STORE_DIR, crashOptions(index.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	key := crashKey(0)
+	if _, err = st.CompareAndSwap(key, "", "a"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("CompareAndSwap of a missing key returned %v", err)
+	}
+
+	if _, err = st.DeleteIfEquals(key, ""); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("DeleteIfEquals of a missing key returned %v", err)
+	}
+
+	steps := []struct {
+		op   func() (bool, error)
+		want bool
+	}{
+		{func() (bool, error) { return st.PutIfAbsent(key, "a") }, true},
+		{func() (bool, error) { return st.PutIfAbsent(key, "b") }, false},
+		{func() (bool, error) { return st.CompareAndSwap(key, "b", "c") }, false},
+		{func() (bool, error) { return st.CompareAndSwap(key, "a", "c") }, true},
+		{func() (bool, error) { return true, st.Flush() }, true},
+		{func() (bool, error) { return st.DeleteIfEquals(key, "a") }, false},
+		{func() (bool, error) { return st.CompareAndSwap(key, "c", "d") }, true},
+		{func() (bool, error) { return true, st.Flush() }, true},
+		{func() (bool, error) { return st.DeleteIfEquals(key, "d") }, true},
+		{func() (bool, error) { return st.PutIfAbsent(key, "e") }, true},
+	}
+
+	for i, step := range steps {
+		if got, err := step.op(); err != nil || got != step.want {
+			t.Fatalf("step %d returned %v, %v, want %v", i, got, err, step.want)
+		}
+	}
+
+	if value, found, err := st.Get(key); err != nil || !found || value != "e" {
+		t.Fatalf("Get(%s) = %q, %v, %v, want e", key, value, found, err)
+	}
+}
+
+func TestCompareAndSwapIsAtomic(t *testing.T) {
+	st, err := Open(CRASH_STORE_DIR, crashOptions(index.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	key := crashKey(0)
+	if err = st.Put(key, "0"); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, CAS_WRITERS)
+	for w := 0; w < CAS_WRITERS; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for done := 0; done < CAS_INCREMENTS; {
+				value, _, err := st.Get(key)
+				if err != nil {
+					errs[w] = err
+					return
+				}
+
+				n, _ := strconv.Atoi(value)
+				swapped, err := st.CompareAndSwap(key, value, strconv.Itoa(n+1))
+				if err != nil {
+					errs[w] = err
+					return
+				}
+
+				if swapped {
+					done += 1
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := strconv.Itoa(CAS_WRITERS * CAS_INCREMENTS)
+	if value, _, err := st.Get(key); err != nil || value != want {
+		t.Fatalf("counter is %q, %v after concurrent increments, want %s", value, err, want)
+	}
+}
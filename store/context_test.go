@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"github.com/shimanekb/project2-B/index"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	CONTEXT_STORE_DIR string        = "/db/context"
+	CONTEXT_TIMEOUT   time.Duration = 20 * time.Millisecond
+)
+
+// gateFS holds up creating tables until its gate is closed, stalling
+// background flushes.
+type gateFS struct {
+	index.FS
+	gate chan struct{}
+}
+
+func (fs gateFS) OpenFile(name string, flag int, perm os.FileMode) (index.File, error) {
+	if flag&os.O_CREATE != 0 && strings.HasSuffix(name, index.TempFilePath(index.TABLE_FILE_SUFFIX)) {
+		<-fs.gate
+	}
+
+	return fs.FS.OpenFile(name, flag, perm)
+}
+
+func TestContextStopsStalledWrites(t *testing.T) {
+	gate := make(chan struct{})
+	opts := crashOptions(gateFS{index.NewMemFS(), gate})
+	opts.MaxPendingFlushes = 1
+	st, err := NewSsStore(CONTEXT_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+	defer cancel()
+	for i := 0; err == nil; i++ {
+		err = st.PutContext(ctx, crashKey(i), strings.Repeat("v", 100))
+	}
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("stalled put returned %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+	defer cancel()
+	if err = st.FlushContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("stalled flush returned %v", err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if err = st.DelContext(ctx, crashKey(0)); err != context.Canceled {
+		t.Fatalf("cancelled del returned %v", err)
+	}
+
+	if _, _, err = st.GetContext(ctx, crashKey(0)); err != context.Canceled {
+		t.Fatalf("cancelled get returned %v", err)
+	}
+
+	if _, _, err = st.ScanContext(ctx, crashKey(0), crashKey(10), ScanOptions{}); err != context.Canceled {
+		t.Fatalf("cancelled scan returned %v", err)
+	}
+
+	close(gate)
+	defer st.Close()
+	if err = st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, found, err := st.Get(crashKey(0)); err != nil || !found || len(value) != 100 {
+		t.Fatalf("Get after the stall returned %.20q, %v, %v", value, found, err)
+	}
+}
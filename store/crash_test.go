@@ -0,0 +1,205 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	CRASH_STORE_DIR  string = "/db/store"
+	CRASH_KEYS       int    = 60
+	CRASH_WRITES     int    = 600
+	CRASH_FLUSH_GAP  int    = 150
+	CRASH_FAULT_SEED int64  = 7
+)
+
+var errFatal = errors.New("log.Fatal called")
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	log.StandardLogger().ExitFunc = func(int) { panic(errFatal) }
+	os.Exit(m.Run())
+}
+
+type modelOp struct {
+	key   string
+	value string
+	del   bool
+}
+
+func crashOptions(fs index.FS) index.Options {
+	opts := index.DefaultOptions()
+	opts.FS = fs
+	opts.BlockSizeBytes = 512
+	opts.MemTableBytes = 3000
+	opts.ValueThreshold = 40
+	opts.L0CompactionTrigger = 2
+	opts.L0SlowdownWritesTrigger = 3
+	opts.L0StopWritesTrigger = 4
+	opts.SlowdownDelayMicros = 0
+	return opts
+}
+
+func crashKey(i int) string {
+	return fmt.Sprintf("key%013d", i)
+}
+
+// crashWorkload writes to a store on fs until it is done or the filesystem
+// crashes, injecting fault once faultAt writes are made. It returns the
+// writes the store took, in sequence order, and how many of them a
+// completed Flush made durable.
+func crashWorkload(fs *index.FaultFS, faultAt int, fault index.Fault) (ops []modelOp, flushed int) {
+	st, err := NewSsStore(CRASH_STORE_DIR, crashOptions(fs))
+	if err != nil {
+		return ops, flushed
+	}
+
+	s := st.(*SsStore)
+	r := rand.New(rand.NewSource(CRASH_FAULT_SEED))
+	for i := 0; i < CRASH_WRITES && !fs.Crashed(); i++ {
+		if i == faultAt {
+			fs.Inject(fault)
+		}
+
+		op := modelOp{key: crashKey(r.Intn(CRASH_KEYS))}
+		if r.Intn(5) == 0 {
+			op.del = true
+			s.Del(op.key)
+		} else {
+			op.value = fmt.Sprintf("%d-%s", i, strings.Repeat("v", r.Intn(80)))
+			s.Put(op.key, op.value)
+		}
+
+		if s.lastSequence > uint64(len(ops)) {
+			ops = append(ops, op)
+		}
+
+		if i%CRASH_FLUSH_GAP == CRASH_FLUSH_GAP-1 && s.Flush() == nil {
+			flushed = len(ops)
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		return ops, flushed
+	}
+
+	return ops, len(ops)
+}
+
+func modelAt(ops []modelOp, seq uint64) map[string]string {
+	model := make(map[string]string)
+	for _, op := range ops[:seq] {
+		if op.del {
+			delete(model, op.key)
+		} else {
+			model[op.key] = op.value
+		}
+	}
+
+	return model
+}
+
+// checkRecovered crashes fs and checks the reopened store holds exactly the
+// writes up to the sequence its manifest recovered, which must cover every
+// flushed write.
+func checkRecovered(t *testing.T, fs *index.FaultFS, ops []modelOp, flushed int, point string) {
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("%s: recovery failed: %v", point, r)
+		}
+	}()
+
+	after := fs.Crash()
+	opts := crashOptions(after)
+	after.MkdirAll(CRASH_STORE_DIR, os.ModePerm)
+	manifest, err := index.OpenManifest(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatalf("%s: could not replay manifest: %v", point, err)
+	}
+
+	seq := manifest.LastSequence()
+	if seq < uint64(flushed) || seq > uint64(len(ops)) {
+		t.Fatalf("%s: recovered sequence %d, want between %d flushed and %d written",
+			point, seq, flushed, len(ops))
+	}
+
+	st, err := NewSsStore(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatalf("%s: could not reopen store: %v", point, err)
+	}
+
+	defer st.Close()
+
+	model := modelAt(ops, seq)
+	for i := 0; i < CRASH_KEYS; i++ {
+		key := crashKey(i)
+		want, wantOk := model[key]
+		got, ok, err := st.Get(key)
+		if err != nil {
+			t.Fatalf("%s: after recovering to sequence %d Get(%s) failed: %v", point, seq, key, err)
+		}
+
+		if ok != wantOk || got != want {
+			t.Fatalf("%s: after recovering to sequence %d Get(%s) = %.20q, %v, want %.20q, %v",
+				point, seq, key, got, ok, want, wantOk)
+		}
+	}
+
+	if err = st.Put(crashKey(0), "after"); err != nil {
+		t.Fatalf("%s: recovered store rejected a write: %v", point, err)
+	}
+
+	if err = st.Flush(); err != nil {
+		t.Fatalf("%s: recovered store could not flush: %v", point, err)
+	}
+
+	if got, _, _ := st.Get(crashKey(0)); got != "after" {
+		t.Fatalf("%s: recovered store lost a new write, got %q", point, got)
+	}
+}
+
+func TestStoreRecoversFromCrashAtEveryIOPoint(t *testing.T) {
+	fs := index.NewFaultFS()
+	ops, flushed := crashWorkload(fs, -1, index.Fault{})
+	if fs.Crashed() || flushed != len(ops) {
+		t.Fatal("workload did not finish without faults")
+	}
+
+	total := fs.Ops()
+	step := total/300 + 1
+	if testing.Short() {
+		step = total/30 + 1
+	}
+
+	checkRecovered(t, fs, ops, flushed, "no crash")
+	for point := 0; point <= total; point += step {
+		fs := index.NewFaultFS()
+		fs.CrashAfter(point)
+		ops, flushed := crashWorkload(fs, -1, index.Fault{})
+		checkRecovered(t, fs, ops, flushed, fmt.Sprintf("crash after %d of %d ops", point, total))
+	}
+}
+
+func TestStoreRecoversFromFailedIO(t *testing.T) {
+	ops := []index.FaultOp{index.FaultCreate, index.FaultWrite, index.FaultSync,
+		index.FaultRename, index.FaultRemove, index.FaultSyncDir}
+	for _, op := range ops {
+		for _, faultAt := range []int{0, 100, 250, 400} {
+			for _, torn := range []bool{false, true} {
+				fs := index.NewFaultFS()
+				fault := index.Fault{Op: op, Err: index.ErrNoSpace, Torn: torn, Sticky: true}
+				writes, flushed := crashWorkload(fs, faultAt, fault)
+				fs.ClearFaults()
+				point := fmt.Sprintf("%s failing from write %d, torn %v", op, faultAt, torn)
+				checkRecovered(t, fs, writes, flushed, point)
+			}
+		}
+	}
+}
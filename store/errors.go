@@ -0,0 +1,79 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+)
+
+var (
+	// ErrNotFound is returned by operations that need the key to exist.
+	// Get reports a missing key through its found result instead.
+	ErrNotFound = errors.New("key not found")
+	// ErrCorruption matches, with errors.Is, errors for damaged store files.
+	ErrCorruption = index.ErrCorruption
+	// ErrClosed is returned by operations on a closed store.
+	ErrClosed = errors.New("store is closed")
+	// ErrBackground matches, with errors.Is, the BackgroundError writes and
+	// flushes return once a background flush or compaction has failed.
+	ErrBackground = errors.New("store stopped after background error")
+	// ErrReadOnly is returned by writes and flushes of a read only store.
+	ErrReadOnly = errors.New("store is read only")
+	// ErrLocked matches, with errors.Is, the error from opening a store that
+	// is already open.
+	ErrLocked = index.ErrLocked
+	// ErrNoMergeOperator is returned by merges, and by reads of keys with
+	// merge operands, when the options name no merge operator.
+	ErrNoMergeOperator = index.ErrNoMergeOperator
+	// ErrUnknownFamily is returned for a column family the DB does not have.
+	ErrUnknownFamily = errors.New("unknown column family")
+	// ErrInvalidArgument is returned by writes given arguments they cannot
+	// take, such as a range that does not end after it starts.
+	ErrInvalidArgument = errors.New("invalid argument")
+	// ErrInvalidCursor is returned by a scan given a cursor no scan returned.
+	ErrInvalidCursor = errors.New("invalid scan cursor")
+	// ErrUnsupportedFormat matches, with errors.Is, the error from opening a
+	// store whose tables are in a format this version cannot read.
+	ErrUnsupportedFormat = errors.New("unsupported store format")
+)
+
+// FormatError is returned by opening a store written in a table format this
+// version cannot read. Format 1 stores kept only a hash of each key, which
+// cannot be turned back into the keys tables now hold, so they have to be
+// rebuilt from their input.
+type FormatError struct {
+	Path   string
+	Format int
+}
+
+func (e *FormatError) Error() string {
+	if e.Format <= 1 {
+		return fmt.Sprintf("Store %s has format 1 tables keeping only a hash of each key, which cannot be "+
+			"converted to format %d; rebuild it from its input", e.Path, index.TABLE_FORMAT)
+	}
+
+	return fmt.Sprintf("Store %s has table format %d, this version reads format %d", e.Path, e.Format, index.TABLE_FORMAT)
+}
+
+func (e *FormatError) Is(target error) bool {
+	return target == ErrUnsupportedFormat
+}
+
+// BackgroundError is returned by every write and flush once a background
+// flush or compaction has failed, since the store cannot make progress
+// without it.
+type BackgroundError struct {
+	Err error
+}
+
+func (e *BackgroundError) Error() string {
+	return fmt.Sprintf("Store stopped after background error: %v", e.Err)
+}
+
+func (e *BackgroundError) Is(target error) bool {
+	return target == ErrBackground
+}
+
+func (e *BackgroundError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,172 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const CORRUPT_STORE_DIR string = "/db/corrupt"
+
+// corruptStore writes keys to a store on a memory filesystem and returns
+// the filesystem along with the manifest of the flushed store.
+func corruptStore(t *testing.T) (*index.MemFS, *index.Manifest) {
+	fs := index.NewMemFS()
+	st, err := NewSsStore(CORRUPT_STORE_DIR, crashOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < CRASH_KEYS; i++ {
+		if err = st.Put(crashKey(i), strings.Repeat("v", 100)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return fs, st.(*SsStore).manifest
+}
+
+func overwriteFile(t *testing.T, fs index.FS, name string, data string) {
+	f, err := fs.OpenFile(name, os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadsReportCorruptValueLog(t *testing.T) {
+	fs, manifest := corruptStore(t)
+	overwriteFile(t, fs, index.ValueLogFileName(CORRUPT_STORE_DIR, manifest.ValueLogNumber()), "")
+
+	st, err := NewSsStore(CORRUPT_STORE_DIR, crashOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	if _, found, err := st.Get(crashKey(0)); !errors.Is(err, ErrCorruption) || found {
+		t.Fatalf("Get over a truncated value log returned %v, %v", found, err)
+	}
+
+	if _, _, err = st.Scan(crashKey(0), crashKey(CRASH_KEYS), ScanOptions{}); !errors.Is(err, ErrCorruption) {
+		t.Fatalf("Scan over a truncated value log returned %v", err)
+	}
+
+	if _, found, err := st.Get("missing"); err != nil || found {
+		t.Fatalf("Get of a missing key returned %v, %v", found, err)
+	}
+}
+
+func TestOpenReportsCorruptTable(t *testing.T) {
+	fs, manifest := corruptStore(t)
+	tables := append(manifest.Tables(0), manifest.Tables(1)...)
+	if len(tables) == 0 {
+		t.Fatal("store flushed no tables")
+	}
+
+	path := index.TableFileName(CORRUPT_STORE_DIR, tables[0].Number)
+	overwriteFile(t, fs, path, "not,a,table")
+
+	_, err := NewSsStore(CORRUPT_STORE_DIR, crashOptions(fs))
+	var corruption *index.CorruptionError
+	if !errors.As(err, &corruption) || corruption.Path != path {
+		t.Fatalf("opening a store with a corrupt table returned %v", err)
+	}
+}
+
+// checkFormatRefused fails unless opening the store at dataPath, for writing
+// and for reading, reports format 1 tables.
+func checkFormatRefused(t *testing.T, fs *index.MemFS, dataPath string) {
+	opts := crashOptions(fs)
+	for _, readOnly := range []bool{false, true} {
+		opts.ReadOnly = readOnly
+		_, err := Open(dataPath, opts)
+		var format *FormatError
+		if !errors.Is(err, ErrUnsupportedFormat) || !errors.As(err, &format) || format.Format > 1 {
+			t.Fatalf("opening a format 1 store with ReadOnly %v returned %v", readOnly, err)
+		}
+	}
+}
+
+func TestOpenRefusesFormat1Stores(t *testing.T) {
+	fs := index.NewMemFS()
+	fs.MkdirAll(CORRUPT_STORE_DIR, os.ModePerm)
+	f, err := fs.OpenFile(index.ManifestPath(CORRUPT_STORE_DIR), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// edits of a store from before formats were recorded, which opening it
+	// would compact into one
+	var manifest string
+	for _, edit := range []string{"edit,next_file,3", "edit,value_log,2"} {
+		manifest += fmt.Sprintf("%s,crc,%08x\n", edit, crc32.ChecksumIEEE([]byte(edit)))
+	}
+
+	f.Write([]byte(manifest))
+	f.Close()
+	checkFormatRefused(t, fs, CORRUPT_STORE_DIR)
+	f, err = fs.OpenFile(index.ManifestPath(CORRUPT_STORE_DIR), os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil || string(data) != manifest {
+		t.Fatalf("refused store has manifest %q, %v, want it untouched", data, err)
+	}
+
+	storeFile := CORRUPT_STORE_DIR + "_file"
+	f, err = fs.OpenFile(storeFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("24,00007930,val0000000059057\n00007930,0"))
+	f.Close()
+	checkFormatRefused(t, fs, storeFile)
+	if stat, err := fs.Stat(storeFile); err != nil || stat.IsDir() {
+		t.Fatalf("refused store file was moved, %v", err)
+	}
+}
+
+func TestBackgroundErrorMatchesItsCause(t *testing.T) {
+	fs := index.NewFaultFS()
+	st, err := Open(CORRUPT_STORE_DIR, crashOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs.Inject(index.Fault{Op: index.FaultCreate, Name: index.TABLE_FILE_SUFFIX, Err: index.ErrNoSpace, Sticky: true})
+	if err = st.Put(crashKey(0), "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = st.Flush()
+	if !errors.Is(err, ErrBackground) || !errors.Is(err, index.ErrNoSpace) || errors.Is(err, ErrClosed) {
+		t.Fatalf("Flush with failing table writes returned %v", err)
+	}
+
+	if err = st.Put(crashKey(1), "v"); !errors.Is(err, ErrBackground) {
+		t.Fatalf("Put after a background error returned %v", err)
+	}
+
+	st.Close()
+	if err = st.Put(crashKey(1), "v"); err != ErrClosed {
+		t.Fatalf("Put after Close returned %v", err)
+	}
+}
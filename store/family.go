@@ -0,0 +1,682 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DEFAULT_FAMILY is the column family every DB has, kept in the store
+// directory itself so a store opened with Open can be opened as a DB.
+const DEFAULT_FAMILY string = "default"
+
+var familyNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// DB is a store directory holding named column families. Each family is a
+// store of its own, with its own memtable, tables and options, kept in a
+// subdirectory named after it. Writes to every family are logged to one
+// write ahead log before they reach the family's memtable, so those not yet
+// flushed are replayed after a crash and a WriteBatch spanning families
+// survives it whole or not at all.
+type DB struct {
+	// mu serializes writes and guards every field below.
+	mu       sync.Mutex
+	dir      string
+	opts     index.Options
+	families map[string]*SsStore
+	wal      *index.WriteAheadLog
+	// sequence numbers the last batch written to any family. A family's
+	// last sequence is that of the last batch that wrote to it.
+	sequence uint64
+	closed   bool
+}
+
+// Family is a column family of a DB. It is a Store whose writes go through
+// the write ahead log of the DB.
+type Family struct {
+	*SsStore
+	db   *DB
+	name string
+}
+
+// OpenDB opens the DB in dir, with its default family tuned by opts, along
+// with every family found in dir and every family named in families, which
+// are created if missing. Families are tuned by their entry in families,
+// or by opts if they have none, and share the filesystem and write buffer
+// manager of opts unless given their own. The write ahead log is synced as
+// opts.SyncPolicy says, and writes a crash left in it are replayed into
+// their families and flushed. With opts.ReadOnly every family is opened
+// read only and the write ahead log is left alone, so only flushed writes
+// are seen.
+func OpenDB(dir string, opts index.Options, families map[string]index.Options) (*DB, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.WriteBufferManager == nil && opts.WriteBufferSize > 0 {
+		opts.WriteBufferManager = index.NewWriteBufferManager(opts.WriteBufferSize)
+	}
+
+	db := &DB{dir: dir, opts: opts, families: make(map[string]*SsStore)}
+	familyOpts := func(name string) index.Options {
+		if o, ok := families[name]; ok {
+			return o
+		}
+
+		return opts
+	}
+
+	if err := db.openFamily(DEFAULT_FAMILY, familyOpts(DEFAULT_FAMILY)); err != nil {
+		return nil, err
+	}
+
+	names, err := db.listFamilies()
+	if err != nil {
+		db.closeFamilies()
+		return nil, err
+	}
+
+	for name := range families {
+		if name != DEFAULT_FAMILY {
+			names[name] = true
+		}
+	}
+
+	for _, name := range sortedNames(names) {
+		if err = db.openFamily(name, familyOpts(name)); err != nil {
+			db.closeFamilies()
+			return nil, err
+		}
+	}
+
+	if opts.ReadOnly {
+		return db, nil
+	}
+
+	if err = db.recover(); err != nil {
+		log.Errorf("Could not recover column families of %s. %v", dir, err)
+		db.closeFamilies()
+		return nil, err
+	}
+
+	log.Infof("Opened %d column families of %s at sequence %d.", len(db.families), dir, db.sequence)
+	return db, nil
+}
+
+func sortedNames(names map[string]bool) []string {
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+
+	sort.Strings(sorted)
+	return sorted
+}
+
+// listFamilies finds the families kept in subdirectories of the DB.
+func (db *DB) listFamilies() (map[string]bool, error) {
+	fs := db.opts.FileSystem()
+	entries, err := fs.ReadDir(db.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]bool)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && name != DEFAULT_FAMILY && familyNamePattern.MatchString(name) &&
+			fileExists(fs, index.ManifestPath(db.familyDir(name))) {
+			names[name] = true
+		}
+	}
+
+	return names, nil
+}
+
+func (db *DB) familyDir(name string) string {
+	if name == DEFAULT_FAMILY {
+		return db.dir
+	}
+
+	return filepath.Join(db.dir, name)
+}
+
+// openFamily is called with mu held, or before the DB is shared, to open
+// family name tuned by opts.
+func (db *DB) openFamily(name string, opts index.Options) error {
+	if !familyNamePattern.MatchString(name) {
+		return errors.New(fmt.Sprintf("Invalid column family name %q", name))
+	}
+
+	if opts.FS == nil {
+		opts.FS = db.opts.FS
+	}
+
+	if opts.WriteBufferManager == nil && opts.WriteBufferSize == 0 {
+		opts.WriteBufferManager = db.opts.WriteBufferManager
+	}
+
+	opts.ReadOnly = db.opts.ReadOnly
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	var s *SsStore
+	var err error
+	if opts.ReadOnly {
+		var st Store
+		if st, err = openReadOnly(db.familyDir(name), opts); err == nil {
+			s = st.(*SsStore)
+		}
+	} else {
+		s, err = open(db.familyDir(name), opts)
+	}
+
+	if err != nil {
+		log.Errorf("Could not open column family %s of %s. %v", name, db.dir, err)
+		return err
+	}
+
+	db.families[name] = s
+	return nil
+}
+
+// closeFamilies closes the families opened so far, the default family and
+// the lock on the DB it holds last.
+func (db *DB) closeFamilies() error {
+	var err error
+	for _, name := range db.familyNames() {
+		if name == DEFAULT_FAMILY {
+			continue
+		}
+
+		if closeErr := db.families[name].Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	if s, ok := db.families[DEFAULT_FAMILY]; ok {
+		if closeErr := s.Close(); err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// recover replays the batches of the write ahead log holding writes their
+// families had not flushed, then flushes every family and starts a new log.
+func (db *DB) recover() error {
+	for _, s := range db.families {
+		if s.lastSequence > db.sequence {
+			db.sequence = s.lastSequence
+		}
+	}
+
+	batches, err := index.ReadWriteAheadLog(db.dir, db.opts)
+	if err != nil {
+		return err
+	}
+
+	replayed := 0
+	for _, b := range batches {
+		if b.Sequence > db.sequence {
+			db.sequence = b.Sequence
+		}
+
+		names, cmds := splitByFamily(b.Commands)
+		for _, name := range names {
+			s, ok := db.families[name]
+			if !ok {
+				return errors.New(fmt.Sprintf("Write ahead log of %s holds writes to unknown column family %s", db.dir, name))
+			}
+
+			if b.Sequence <= s.lastSequence {
+				continue
+			}
+
+			s.mu.Lock()
+			err := s.makeRoomForWrite(context.Background())
+			var prepared []index.Command
+			if err == nil {
+				prepared, err = s.prepareBatch(cmds[name])
+			}
+
+			if err == nil {
+				s.commitBatch(b.Sequence, prepared)
+			}
+
+			s.mu.Unlock()
+			if err != nil {
+				return err
+			}
+
+			replayed += len(cmds[name])
+		}
+	}
+
+	log.Infof("Replayed %d writes of %d logged batches into column families of %s.", replayed, len(batches), db.dir)
+	return db.flush(context.Background())
+}
+
+// splitByFamily groups commands by family, keeping their order, and returns
+// the family names sorted.
+func splitByFamily(commands []index.FamilyCommand) ([]string, map[string][]index.Command) {
+	names := make(map[string]bool)
+	cmds := make(map[string][]index.Command)
+	for _, cmd := range commands {
+		names[cmd.Family] = true
+		cmds[cmd.Family] = append(cmds[cmd.Family], cmd.Command)
+	}
+
+	return sortedNames(names), cmds
+}
+
+// flush is called with mu held to flush every family and start a new write
+// ahead log, as none of the writes in the old one are needed any more.
+func (db *DB) flush(ctx context.Context) error {
+	for _, name := range db.familyNames() {
+		if err := db.families[name].FlushContext(ctx); err != nil {
+			log.Errorf("Could not flush column family %s of %s. %v", name, db.dir, err)
+			return err
+		}
+	}
+
+	if db.wal != nil {
+		db.wal.Close()
+	}
+
+	wal, err := index.CreateWriteAheadLog(db.dir, db.opts)
+	if err != nil {
+		log.Errorf("Could not start write ahead log of %s. %v", db.dir, err)
+		return err
+	}
+
+	db.wal = wal
+	return nil
+}
+
+// Families returns the names of the column families of the DB, sorted.
+func (db *DB) Families() []string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	return db.familyNames()
+}
+
+func (db *DB) familyNames() []string {
+	names := make(map[string]bool)
+	for name := range db.families {
+		names[name] = true
+	}
+
+	return sortedNames(names)
+}
+
+// Family returns the column family name, failing with ErrUnknownFamily if
+// the DB has none by that name.
+func (db *DB) Family(name string) (*Family, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	if _, ok := db.families[name]; !ok {
+		log.Errorf("No column family %s in %s.", name, db.dir)
+		return nil, ErrUnknownFamily
+	}
+
+	return db.family(name), nil
+}
+
+func (db *DB) family(name string) *Family {
+	return &Family{db.families[name], db, name}
+}
+
+// CreateFamily adds the column family name, tuned by opts, to the DB. Its
+// name is made of letters, digits, underscores and dashes.
+func (db *DB) CreateFamily(name string, opts index.Options) (*Family, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch {
+	case db.closed:
+		return nil, ErrClosed
+	case db.opts.ReadOnly:
+		return nil, ErrReadOnly
+	}
+
+	if _, ok := db.families[name]; ok {
+		return nil, errors.New(fmt.Sprintf("Column family %s already exists", name))
+	}
+
+	if err := db.openFamily(name, opts); err != nil {
+		return nil, err
+	}
+
+	log.Infof("Created column family %s of %s.", name, db.dir)
+	return db.family(name), nil
+}
+
+// Write makes the writes of b to their column families as one.
+func (db *DB) Write(b *WriteBatch) error {
+	return db.WriteContext(context.Background(), b)
+}
+
+// WriteContext is Write that gives up waiting for a stalled family once ctx
+// is done, in which case none of the writes of b are made.
+func (db *DB) WriteContext(ctx context.Context, b *WriteBatch) error {
+	_, err := db.write(ctx, b.writes, nil)
+	return err
+}
+
+// write logs writes to the write ahead log as one batch and adds them to
+// the memtables of their families, or does neither if check, when given,
+// fails. Once the log outgrows MaxWalBytes every family is flushed so it
+// can start afresh, and an error flushing them is returned though the
+// write was made.
+func (db *DB) write(ctx context.Context, writes []batchWrite, check func() (bool, error)) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	ok, err := db.writeLocked(ctx, writes, check)
+	if ok && db.wal.Size() >= db.opts.MaxWalBytes {
+		log.Infof("Write ahead log of %s holds %d bytes, flushing column families.", db.dir, db.wal.Size())
+		if err = db.flush(ctx); err != nil {
+			log.Errorf("Could not flush column families of %s. %v", db.dir, err)
+		}
+	}
+
+	return ok, err
+}
+
+// lockFamilies is called with mu held to lock the families names, in name
+// order, once each has room for a write. Room is made in a family holding
+// only its own lock, with mu released, so a family stalled on background
+// work holds up no writes to the others.
+func (db *DB) lockFamilies(ctx context.Context, names []string) error {
+	delayed := make(map[string]bool)
+	for {
+		full := ""
+		for i, name := range names {
+			s := db.families[name]
+			s.mu.Lock()
+			if !s.hasRoom(delayed[name]) {
+				full = name
+				for _, locked := range names[:i+1] {
+					db.families[locked].mu.Unlock()
+				}
+
+				break
+			}
+		}
+
+		if full == "" {
+			return nil
+		}
+
+		s := db.families[full]
+		db.mu.Unlock()
+		s.mu.Lock()
+		err := s.makeRoomForWrite(ctx)
+		s.mu.Unlock()
+		db.mu.Lock()
+		if err != nil {
+			log.Errorf("Could not make room to write to column family %s. %v", full, err)
+			return err
+		}
+
+		if db.closed {
+			return ErrClosed
+		}
+
+		delayed[full] = true
+	}
+}
+
+// writeLocked is called with mu held to make a write. Every family written
+// is locked, in name order, from before check until the write is done, so
+// no other write to them comes between. mu is released while a family
+// written waits for room.
+func (db *DB) writeLocked(ctx context.Context, writes []batchWrite, check func() (bool, error)) (bool, error) {
+	switch {
+	case db.closed:
+		return false, ErrClosed
+	case db.opts.ReadOnly:
+		return false, ErrReadOnly
+	case len(writes) == 0:
+		return true, nil
+	}
+
+	logged := make([]index.FamilyCommand, 0, len(writes))
+	for _, w := range writes {
+		s, ok := db.families[w.Family]
+		if !ok {
+			log.Errorf("No column family %s in %s to write to.", w.Family, db.dir)
+			return false, ErrUnknownFamily
+		}
+
+		if w.Type == index.DELRANGE_COMMAND && w.Item.Key() >= w.Item.Value() {
+			log.Errorf("Range to delete from %s to %s is empty.", w.Item.Key(), w.Item.Value())
+			return false, ErrInvalidArgument
+		}
+
+		if w.ttl > 0 {
+			w.Item = index.NewExpiringKeyValueItem(w.Item.Key(), w.Item.Value(), s.opts.Now().Add(w.ttl))
+		}
+
+		logged = append(logged, w.FamilyCommand)
+	}
+
+	names, cmds := splitByFamily(logged)
+	if err := db.lockFamilies(ctx, names); err != nil {
+		return false, err
+	}
+
+	for _, name := range names {
+		defer db.families[name].mu.Unlock()
+	}
+
+	if check != nil {
+		if ok, err := check(); !ok || err != nil {
+			return false, err
+		}
+	}
+
+	prepared := make(map[string][]index.Command)
+	for _, name := range names {
+		p, err := db.families[name].prepareBatch(cmds[name])
+		if err != nil {
+			log.Errorf("Could not write to column family %s. %v", name, err)
+			return false, err
+		}
+
+		prepared[name] = p
+	}
+
+	sequence := db.sequence + 1
+	if err := db.wal.Append(index.WalBatch{Sequence: sequence, Commands: logged}); err != nil {
+		return false, err
+	}
+
+	db.sequence = sequence
+	for _, name := range names {
+		db.families[name].commitBatch(sequence, prepared[name])
+	}
+
+	return true, nil
+}
+
+// Flush flushes every column family and empties the write ahead log.
+func (db *DB) Flush() error {
+	return db.FlushContext(context.Background())
+}
+
+// FlushContext is Flush that stops waiting once ctx is done.
+func (db *DB) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	switch {
+	case db.closed:
+		return ErrClosed
+	case db.opts.ReadOnly:
+		return ErrReadOnly
+	}
+
+	return db.flush(ctx)
+}
+
+// Close flushes every column family, empties the write ahead log and closes
+// the families. If the flush fails the log is kept, so its writes are
+// replayed when the DB is next opened.
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.closed = true
+	var err error
+	if !db.opts.ReadOnly {
+		err = db.flush(context.Background())
+		db.wal.Close()
+	}
+
+	if closeErr := db.closeFamilies(); err == nil {
+		err = closeErr
+	}
+
+	log.Infof("Closed column families of %s.", db.dir)
+	return err
+}
+
+func (f *Family) Name() string {
+	return f.name
+}
+
+func (f *Family) write(ctx context.Context, typ string, item index.KeyValueItem, ttl time.Duration) error {
+	cmd := index.FamilyCommand{Family: f.name, Command: index.Command{Type: typ, Item: item}}
+	_, err := f.db.write(ctx, []batchWrite{{cmd, ttl}}, nil)
+	return err
+}
+
+// writeIf makes cmd if check passes on the current value of its key, as
+// SsStore.writeIf does.
+func (f *Family) writeIf(ctx context.Context, cmd index.Command, check func(current string, found bool) (bool, error)) (bool, error) {
+	w := batchWrite{FamilyCommand: index.FamilyCommand{Family: f.name, Command: cmd}}
+	return f.db.write(ctx, []batchWrite{w}, func() (bool, error) {
+		current, found, err := f.get(ctx, cmd.Item.Key())
+		if err != nil {
+			return false, err
+		}
+
+		return check(current, found)
+	})
+}
+
+func (f *Family) Put(key string, value string) error {
+	return f.PutContext(context.Background(), key, value)
+}
+
+func (f *Family) PutContext(ctx context.Context, key string, value string) error {
+	return f.write(ctx, PUT_COMMAND, index.NewKeyValueItem(key, value), 0)
+}
+
+func (f *Family) PutWithTTL(key string, value string, ttl time.Duration) error {
+	return f.PutWithTTLContext(context.Background(), key, value, ttl)
+}
+
+func (f *Family) PutWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return errors.New(fmt.Sprintf("TTL of key %s must be positive, got %s", key, ttl))
+	}
+
+	return f.write(ctx, PUT_COMMAND, index.NewKeyValueItem(key, value), ttl)
+}
+
+func (f *Family) Del(key string) error {
+	return f.DelContext(context.Background(), key)
+}
+
+func (f *Family) DelContext(ctx context.Context, key string) error {
+	return f.write(ctx, DEL_COMMAND, index.NewKeyValueItem(key, ""), 0)
+}
+
+func (f *Family) DeleteRange(start string, end string) error {
+	return f.DeleteRangeContext(context.Background(), start, end)
+}
+
+func (f *Family) DeleteRangeContext(ctx context.Context, start string, end string) error {
+	return f.write(ctx, index.DELRANGE_COMMAND, index.NewKeyValueItem(start, end), 0)
+}
+
+func (f *Family) Merge(key string, operand string) error {
+	return f.MergeContext(context.Background(), key, operand)
+}
+
+func (f *Family) MergeContext(ctx context.Context, key string, operand string) error {
+	return f.write(ctx, index.MERGE_COMMAND, index.NewKeyValueItem(key, operand), 0)
+}
+
+func (f *Family) CompareAndSwap(key string, expected string, value string) (swapped bool, err error) {
+	return f.CompareAndSwapContext(context.Background(), key, expected, value)
+}
+
+func (f *Family) CompareAndSwapContext(ctx context.Context, key string, expected string, value string) (swapped bool, err error) {
+	cmd := index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(key, value)}
+	return f.writeIf(ctx, cmd, holds(expected))
+}
+
+func (f *Family) PutIfAbsent(key string, value string) (put bool, err error) {
+	return f.PutIfAbsentContext(context.Background(), key, value)
+}
+
+func (f *Family) PutIfAbsentContext(ctx context.Context, key string, value string) (put bool, err error) {
+	cmd := index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(key, value)}
+	return f.writeIf(ctx, cmd, absent)
+}
+
+func (f *Family) DeleteIfEquals(key string, expected string) (deleted bool, err error) {
+	return f.DeleteIfEqualsContext(context.Background(), key, expected)
+}
+
+func (f *Family) DeleteIfEqualsContext(ctx context.Context, key string, expected string) (deleted bool, err error) {
+	cmd := index.Command{Type: DEL_COMMAND, Item: index.NewKeyValueItem(key, "")}
+	return f.writeIf(ctx, cmd, holds(expected))
+}
+
+// Flush flushes every column family of the DB, as DB.Flush does, since the
+// write ahead log only empties once all of them are flushed.
+func (f *Family) Flush() error {
+	return f.db.Flush()
+}
+
+func (f *Family) FlushContext(ctx context.Context) error {
+	return f.db.FlushContext(ctx)
+}
+
+// Close fails, leaving the family open, as the families of a DB share its
+// write ahead log and are closed together by DB.Close.
+func (f *Family) Close() error {
+	return errors.New(fmt.Sprintf("Column family %s is closed with its DB", f.name))
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	FAMILY_BATCHES    int   = 160
+	FAMILY_KEYS       int   = 30
+	FAMILY_FLUSH_GAP  int   = 50
+	FAMILY_WAL_GAP    int64 = 2000
+	FAMILY_CRASH_SEED int64 = 11
+)
+
+func familyOptions(fs index.FS) (index.Options, map[string]index.Options) {
+	opts := crashOptions(fs)
+	opts.SyncPolicy = index.SyncAlways
+	counters := crashOptions(nil)
+	counters.MergeOperatorName = "int64add"
+	return opts, map[string]index.Options{"users": crashOptions(nil), "counters": counters}
+}
+
+func TestWriteBatchSpansFamilies(t *testing.T) {
+	fs := index.NewMemFS()
+	opts, families := familyOptions(fs)
+	opts.MaxWalBytes = FAMILY_WAL_GAP
+	db, err := OpenDB(CRASH_STORE_DIR, opts, families)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := db.Family("users")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counters, _ := db.Family("counters")
+	want := make([]int, MERGE_COUNTERS)
+	for round := 1; round <= 5; round++ {
+		var b WriteBatch
+		for i := range want {
+			b.Put("users", crashKey(i), fmt.Sprintf("user-%d-%d", round, i))
+			b.Merge("counters", crashKey(i), fmt.Sprint(round))
+			b.Put(DEFAULT_FAMILY, crashKey(i), "default")
+			want[i] += round
+		}
+
+		if err = db.Write(&b); err != nil {
+			t.Fatal(err)
+		}
+
+		checkCounters(t, counters, want)
+		checkRange(t, users, 0, MERGE_COUNTERS, fmt.Sprintf("user-%d", round))
+		if db.wal.Size() >= opts.MaxWalBytes {
+			t.Fatalf("write ahead log grew to %d bytes, past %d", db.wal.Size(), opts.MaxWalBytes)
+		}
+	}
+
+	// a batch that cannot be made in full is not made at all
+	var b WriteBatch
+	b.Put("users", crashKey(0), "lost")
+	b.Put("missing", crashKey(0), "lost")
+	if err = db.Write(&b); !errors.Is(err, ErrUnknownFamily) {
+		t.Fatalf("write to a missing family returned %v", err)
+	}
+
+	b = WriteBatch{}
+	b.Del("users", crashKey(0))
+	b.Put("counters", crashKey(1), "x")
+	b.Merge("counters", crashKey(1), "1")
+	if err = db.Write(&b); err == nil {
+		t.Fatal("merge of 1 into x did not fail")
+	}
+
+	checkCounters(t, counters, want)
+	checkRange(t, users, 0, MERGE_COUNTERS, "user-5")
+	if swapped, err := users.CompareAndSwap(crashKey(0), "user-5-0", "swapped"); err != nil || !swapped {
+		t.Fatalf("CompareAndSwap returned %v, %v", swapped, err)
+	}
+
+	if err = db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err = OpenDB(CRASH_STORE_DIR, opts, map[string]index.Options{"counters": families["counters"]}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	if names := fmt.Sprint(db.Families()); names != "[counters default users]" {
+		t.Fatalf("reopened families are %s", names)
+	}
+
+	users, _ = db.Family("users")
+	counters, _ = db.Family("counters")
+	checkCounters(t, counters, want)
+	if value, _, err := users.Get(crashKey(0)); err != nil || value != "swapped" {
+		t.Fatalf("Get(%s) = %q, %v after reopening, want swapped", crashKey(0), value, err)
+	}
+
+	defaults := make(map[int]string)
+	for i := 0; i < MERGE_COUNTERS; i++ {
+		defaults[i] = "default"
+	}
+
+	st, _ := db.Family(DEFAULT_FAMILY)
+	checkKeys(t, st, defaults)
+}
+
+// familyWorkload writes batches putting or deleting the same key in two
+// families until it is done or the filesystem crashes, and returns how many
+// batches were written.
+func familyWorkload(fs *index.FaultFS) (batches []modelOp, written int) {
+	opts, families := familyOptions(fs)
+	db, err := OpenDB(CRASH_STORE_DIR, opts, families)
+	if err != nil {
+		return batches, written
+	}
+
+	r := rand.New(rand.NewSource(FAMILY_CRASH_SEED))
+	for i := 0; i < FAMILY_BATCHES && !fs.Crashed(); i++ {
+		op := modelOp{key: crashKey(r.Intn(FAMILY_KEYS)), value: fmt.Sprintf("batch-%d", i), del: r.Intn(5) == 0}
+		var b WriteBatch
+		for _, family := range []string{"users", DEFAULT_FAMILY} {
+			if op.del {
+				b.Del(family, op.key)
+			} else {
+				b.Put(family, op.key, op.value)
+			}
+		}
+
+		batches = append(batches, op)
+		if db.Write(&b) != nil {
+			break
+		}
+
+		written = len(batches)
+		if i%FAMILY_FLUSH_GAP == FAMILY_FLUSH_GAP-1 {
+			db.Flush()
+		}
+	}
+
+	db.Close()
+	return batches, written
+}
+
+// checkFamiliesRecovered crashes fs and checks both families of the
+// reopened DB hold every batch written, and nothing or all of the one that
+// failed.
+func checkFamiliesRecovered(t *testing.T, fs *index.FaultFS, batches []modelOp, written int, point string) {
+	after := fs.Crash()
+	opts, families := familyOptions(after)
+	if f, err := after.OpenFile(index.WalPath(CRASH_STORE_DIR), os.O_APPEND|os.O_WRONLY, 0644); err == nil {
+		io.WriteString(f, "batch,1,users,put")
+		f.Close()
+		if st, err := Open(CRASH_STORE_DIR, opts); err == nil {
+			st.Close()
+			t.Fatalf("%s: store opened without replaying its write ahead log", point)
+		}
+	}
+
+	db, err := OpenDB(CRASH_STORE_DIR, opts, families)
+	if err != nil {
+		t.Fatalf("%s: could not reopen: %v", point, err)
+	}
+
+	defer db.Close()
+	for n := written; n <= len(batches); n++ {
+		model := modelAt(batches, uint64(n))
+		matches := true
+		for _, name := range []string{"users", DEFAULT_FAMILY} {
+			st, _ := db.Family(name)
+			for i := 0; i < FAMILY_KEYS && matches; i++ {
+				value, found, err := st.Get(crashKey(i))
+				if err != nil {
+					t.Fatalf("%s: Get(%s) from %s failed: %v", point, crashKey(i), name, err)
+				}
+
+				want, ok := model[crashKey(i)]
+				matches = found == ok && value == want
+			}
+		}
+
+		if matches {
+			return
+		}
+	}
+
+	t.Fatalf("%s: families do not hold the first %d to %d batches", point, written, len(batches))
+}
+
+func TestFamiliesRecoverFromCrashAtEveryIOPoint(t *testing.T) {
+	fs := index.NewFaultFS()
+	batches, written := familyWorkload(fs)
+	if fs.Crashed() || written != FAMILY_BATCHES {
+		t.Fatal("workload did not finish without faults")
+	}
+
+	total := fs.Ops()
+	step := total/200 + 1
+	if testing.Short() {
+		step = total/20 + 1
+	}
+
+	checkFamiliesRecovered(t, fs, batches, written, "no crash")
+	for point := 0; point <= total; point += step {
+		fs := index.NewFaultFS()
+		fs.CrashAfter(point)
+		batches, written := familyWorkload(fs)
+		checkFamiliesRecovered(t, fs, batches, written, fmt.Sprintf("crash after %d of %d ops", point, total))
+	}
+}
+
+func TestWritesDurableUnderSyncFlush(t *testing.T) {
+	fs := index.NewFaultFS()
+	opts, families := familyOptions(fs)
+	opts.SyncPolicy = index.SyncFlush
+	db, err := OpenDB(CRASH_STORE_DIR, opts, families)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, _ := db.Family("users")
+	if err = users.Put(crashKey(0), "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	st, _ := db.Family(DEFAULT_FAMILY)
+	if err = st.Put(crashKey(0), "default"); err != nil {
+		t.Fatal(err)
+	}
+
+	after := fs.Crash()
+	opts.FS = after
+	if db, err = OpenDB(CRASH_STORE_DIR, opts, families); err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	for family, want := range map[string]string{"users": "user", DEFAULT_FAMILY: "default"} {
+		st, _ := db.Family(family)
+		if value, found, err := st.Get(crashKey(0)); err != nil || !found || value != want {
+			t.Fatalf("Get(%s) of %s after a crash = %q, %v, %v, want %q", crashKey(0), family, value, found, err, want)
+		}
+	}
+}
+
+func TestStalledFamilyHoldsUpNoOtherFamily(t *testing.T) {
+	fs := index.NewMemFS()
+	gate := make(chan struct{})
+	opts := crashOptions(fs)
+	users := crashOptions(gateFS{fs, gate})
+	users.MaxPendingFlushes = 1
+	db, err := OpenDB(CONTEXT_STORE_DIR, opts, map[string]index.Options{"users": users})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer db.Close()
+	family, _ := db.Family("users")
+	ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+	defer cancel()
+	for i := 0; err == nil; i++ {
+		err = family.PutContext(ctx, crashKey(i), strings.Repeat("v", 100))
+	}
+
+	if err != context.DeadlineExceeded {
+		t.Fatalf("stalled put returned %v", err)
+	}
+
+	st, _ := db.Family(DEFAULT_FAMILY)
+	stalled := make(chan error)
+	go func() {
+		stalled <- family.Put(crashKey(0), "stalled")
+	}()
+
+	time.Sleep(CONTEXT_TIMEOUT)
+	put := make(chan error, 1)
+	go func() {
+		put <- st.Put(crashKey(0), "default")
+	}()
+
+	select {
+	case err = <-put:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * CONTEXT_TIMEOUT):
+		close(gate)
+		t.Fatal("put to the default family waited on users")
+	}
+
+	close(gate)
+	if err = <-stalled; err != nil {
+		t.Fatal(err)
+	}
+
+	// flushing one family flushes them all, emptying the write ahead log
+	if err = family.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db.wal.Size() != 0 || st.Stats().MemTableBytes != 0 {
+		t.Fatalf("family flush left %d bytes in the write ahead log", db.wal.Size())
+	}
+
+	if err = family.Close(); err == nil {
+		t.Fatal("closing a family without its DB did not fail")
+	}
+
+	if value, _, err := family.Get(crashKey(0)); err != nil || value != "stalled" {
+		t.Fatalf("Get(%s) = %q, %v, want stalled", crashKey(0), value, err)
+	}
+}
@@ -0,0 +1,446 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	"sort"
+	"time"
+)
+
+// Iterator walks the keys of a store and their values in key order, as the
+// store was when the iterator was made. It starts at no key, so one of the
+// Seek methods has to position it first. An Iterator is not safe for
+// concurrent use and must be closed.
+type Iterator interface {
+	// Valid reports whether the iterator is at a key. It is not once it
+	// moves past either end, hits an error or is closed.
+	Valid() bool
+	// Seek moves to the first key at or after key.
+	Seek(key string)
+	// SeekForPrev moves to the last key at or before key.
+	SeekForPrev(key string)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Key() string
+	Value() string
+	// Err returns the error that stopped the iterator, if any.
+	Err() error
+	// Close lets the store delete the files of tables the iterator was
+	// reading once compaction has replaced them.
+	Close() error
+}
+
+// entryIterator is a source of entries for a storeIterator to merge,
+// tombstones included. Its range tombstones hide entries of older sources.
+type entryIterator interface {
+	RangeTombstones() index.RangeTombstones
+	Valid() bool
+	Seek(key string)
+	SeekToFirst()
+	SeekToLast()
+	Next()
+	Prev()
+	Key() string
+	Deleted() bool
+	Operand() bool
+	ExpiresAt() int64
+	Value() (string, error)
+	Err() error
+}
+
+type memEntry struct {
+	key       string
+	value     string
+	deleted   bool
+	operand   bool
+	expiresAt int64
+}
+
+// memTableIterator walks a sorted copy of a memtable, so writes made after
+// it is created are not seen.
+type memTableIterator struct {
+	entries    []memEntry
+	tombstones index.RangeTombstones
+	pos        int
+}
+
+func newMemTableIterator(cache MemTable) *memTableIterator {
+	keys := cache.Keys()
+	sort.Strings(keys)
+	entries := make([]memEntry, 0, len(keys))
+	for _, key := range keys {
+		v, _ := cache.Get(key)
+		cmd, _ := v.(index.Command)
+		entries = append(entries, memEntry{key, cmd.Item.Value(), cmd.Type == DEL_COMMAND,
+			cmd.Type == index.MERGE_COMMAND, cmd.Item.ExpiresAt()})
+	}
+
+	tombstones := append(index.RangeTombstones{}, cache.RangeTombstones()...)
+	return &memTableIterator{entries, tombstones, -1}
+}
+
+func (it *memTableIterator) RangeTombstones() index.RangeTombstones {
+	return it.tombstones
+}
+
+func (it *memTableIterator) Valid() bool {
+	return it.pos >= 0 && it.pos < len(it.entries)
+}
+
+func (it *memTableIterator) Seek(key string) {
+	it.pos = sort.Search(len(it.entries), func(i int) bool { return it.entries[i].key >= key })
+}
+
+func (it *memTableIterator) SeekToFirst() {
+	it.pos = 0
+}
+
+func (it *memTableIterator) SeekToLast() {
+	it.pos = len(it.entries) - 1
+}
+
+func (it *memTableIterator) Next() {
+	it.pos += 1
+}
+
+func (it *memTableIterator) Prev() {
+	it.pos -= 1
+}
+
+func (it *memTableIterator) Key() string {
+	return it.entries[it.pos].key
+}
+
+func (it *memTableIterator) Deleted() bool {
+	return it.entries[it.pos].deleted
+}
+
+func (it *memTableIterator) Operand() bool {
+	return it.entries[it.pos].operand
+}
+
+func (it *memTableIterator) ExpiresAt() int64 {
+	return it.entries[it.pos].expiresAt
+}
+
+func (it *memTableIterator) Value() (string, error) {
+	return it.entries[it.pos].value, nil
+}
+
+func (it *memTableIterator) Err() error {
+	return nil
+}
+
+// storeIterator merges the memtables and tables of a store, given newest
+// first. At each key the newest entry wins, with merge operands folded onto
+// the older entries, and keys whose newest entry is a tombstone, or is
+// covered by a range tombstone of a newer source, are skipped. Moving
+// forward every source is at or after the current key, and moving backward
+// at or before it.
+type storeIterator struct {
+	store   *SsStore
+	sources []entryIterator
+	// now is the time values are expired by.
+	now time.Time
+	// current is the source whose entry the iterator is at, or -1.
+	current int
+	forward bool
+	err     error
+	closed  bool
+}
+
+// NewIterator returns an iterator over the store as it is now. The store
+// keeps the files the iterator reads until it is closed.
+func (s *SsStore) NewIterator() (Iterator, error) {
+	it, err := s.newIterator("")
+	if err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
+
+// newIterator returns an iterator that leaves out tables whose prefix
+// filter rules out prefix, unless they hold range tombstones, so it only
+// sees every key starting with prefix.
+func (s *SsStore) newIterator(prefix string) (*storeIterator, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	sources := []entryIterator{newMemTableIterator(s.cache)}
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		sources = append(sources, newMemTableIterator(s.immutables[i]))
+	}
+
+	for _, table := range append(storages(s.tables), s.blockStorage) {
+		if prefix == "" || table.MayContainPrefix(prefix) || len(table.RangeTombstones()) > 0 {
+			sources = append(sources, table.NewIterator())
+		}
+	}
+
+	s.iterators += 1
+	return &storeIterator{store: s, sources: sources, now: s.opts.Now(), current: -1, forward: true}, nil
+}
+
+// releaseIterator deletes the files kept for iterators once the last one is
+// closed.
+func (s *SsStore) releaseIterator() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.iterators -= 1
+	if s.iterators == 0 && !s.closed && !s.opts.ReadOnly {
+		s.dropFiles()
+	}
+}
+
+func (it *storeIterator) Valid() bool {
+	return !it.closed && it.err == nil && it.current >= 0
+}
+
+// failed records the first error of any source, leaving the iterator at no
+// key if there is one.
+func (it *storeIterator) failed() bool {
+	for _, src := range it.sources {
+		if it.err == nil {
+			it.err = src.Err()
+		}
+	}
+
+	if it.err != nil {
+		it.current = -1
+	}
+
+	return it.err != nil
+}
+
+// atKey moves every source at key on by one in the iterator's direction.
+func (it *storeIterator) atKey(key string) {
+	for _, src := range it.sources {
+		if !src.Valid() || src.Key() != key {
+			continue
+		}
+
+		if it.forward {
+			src.Next()
+		} else {
+			src.Prev()
+		}
+	}
+}
+
+// hidden reports whether the entry source i is at is deleted or expired.
+func (it *storeIterator) hidden(i int) bool {
+	src := it.sources[i]
+	if src.Deleted() || index.Expired(src.ExpiresAt(), it.now) {
+		return true
+	}
+
+	for _, newer := range it.sources[:i] {
+		if newer.RangeTombstones().Covers(src.Key()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// settle finds the nearest key in the iterator's direction whose newest
+// entry is not a tombstone.
+func (it *storeIterator) settle() {
+	for !it.failed() {
+		it.current = -1
+		for i, src := range it.sources {
+			if !src.Valid() {
+				continue
+			}
+
+			if it.current < 0 {
+				it.current = i
+				continue
+			}
+
+			key := it.sources[it.current].Key()
+			if (it.forward && src.Key() < key) || (!it.forward && src.Key() > key) {
+				it.current = i
+			}
+		}
+
+		if it.current < 0 || !it.hidden(it.current) {
+			return
+		}
+
+		it.atKey(it.sources[it.current].Key())
+	}
+}
+
+func (it *storeIterator) Seek(key string) {
+	if it.closed {
+		return
+	}
+
+	for _, src := range it.sources {
+		src.Seek(key)
+	}
+
+	it.forward = true
+	it.settle()
+}
+
+// seekBefore moves src to its last entry before key, or at key too if
+// inclusive.
+func seekBefore(src entryIterator, key string, inclusive bool) {
+	src.Seek(key)
+	if !src.Valid() {
+		src.SeekToLast()
+	} else if !inclusive || src.Key() > key {
+		src.Prev()
+	}
+}
+
+func (it *storeIterator) SeekForPrev(key string) {
+	if it.closed {
+		return
+	}
+
+	for _, src := range it.sources {
+		seekBefore(src, key, true)
+	}
+
+	it.forward = false
+	it.settle()
+}
+
+func (it *storeIterator) SeekToFirst() {
+	if it.closed {
+		return
+	}
+
+	for _, src := range it.sources {
+		src.SeekToFirst()
+	}
+
+	it.forward = true
+	it.settle()
+}
+
+func (it *storeIterator) SeekToLast() {
+	if it.closed {
+		return
+	}
+
+	for _, src := range it.sources {
+		src.SeekToLast()
+	}
+
+	it.forward = false
+	it.settle()
+}
+
+func (it *storeIterator) Next() {
+	if !it.Valid() {
+		return
+	}
+
+	key := it.Key()
+	if !it.forward {
+		for _, src := range it.sources {
+			src.Seek(key)
+		}
+
+		it.forward = true
+	}
+
+	it.atKey(key)
+	it.settle()
+}
+
+func (it *storeIterator) Prev() {
+	if !it.Valid() {
+		return
+	}
+
+	key := it.Key()
+	if it.forward {
+		for _, src := range it.sources {
+			seekBefore(src, key, false)
+		}
+
+		it.forward = false
+		it.settle()
+		return
+	}
+
+	it.atKey(key)
+	it.settle()
+}
+
+func (it *storeIterator) Key() string {
+	return it.sources[it.current].Key()
+}
+
+// Value returns the value at the current key. If it cannot be read the
+// iterator stops with the error.
+func (it *storeIterator) Value() string {
+	value, err := it.value()
+	if err != nil {
+		it.err = err
+		it.current = -1
+	}
+
+	return value
+}
+
+// value reads the value at the current key, folding merge operands of the
+// newest entries onto the older entries of the key below them.
+func (it *storeIterator) value() (string, error) {
+	src := it.sources[it.current]
+	if !src.Operand() {
+		return src.Value()
+	}
+
+	key := src.Key()
+	m := index.NewMerger(it.store.opts, key)
+	for _, older := range it.sources[it.current:] {
+		if older.Valid() && older.Key() == key {
+			value, err := older.Value()
+			if err != nil {
+				return "", err
+			}
+
+			e := index.Entry{Value: value, Deleted: older.Deleted(), Operand: older.Operand(),
+				ExpiresAt: older.ExpiresAt(), Found: true}
+			if m.Add(e) {
+				break
+			}
+		}
+
+		if older.RangeTombstones().Covers(key) {
+			m.Add(index.Entry{Deleted: true, Found: true})
+			break
+		}
+	}
+
+	value, _, err := m.Result()
+	return value, err
+}
+
+func (it *storeIterator) Err() error {
+	return it.err
+}
+
+func (it *storeIterator) Close() error {
+	if it.closed {
+		return nil
+	}
+
+	it.closed = true
+	it.current = -1
+	it.store.releaseIterator()
+	return nil
+}
@@ -0,0 +1,188 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+const (
+	ITERATOR_ROUNDS int = 8
+	ITERATOR_WRITES int = 150
+	ITERATOR_STEPS  int = 40
+)
+
+func sortedKeys(model map[string]string) []string {
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// checkIteratorAt fails unless it is at keys[i] of model, or at no key when i
+// is out of range.
+func checkIteratorAt(t *testing.T, it Iterator, model map[string]string, keys []string, i int, op string) {
+	if it.Err() != nil {
+		t.Fatalf("%s: iterator failed: %v", op, it.Err())
+	}
+
+	if i < 0 || i >= len(keys) {
+		if it.Valid() {
+			t.Fatalf("%s: iterator at %q, want the end", op, it.Key())
+		}
+
+		return
+	}
+
+	if !it.Valid() || it.Key() != keys[i] || it.Value() != model[keys[i]] {
+		got := "the end"
+		if it.Valid() {
+			got = fmt.Sprintf("%q", it.Key())
+		}
+
+		t.Fatalf("%s: iterator at %s, want %q", op, got, keys[i])
+	}
+}
+
+func TestIteratorMatchesModel(t *testing.T) {
+	st, err := memStoreOpener()()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	r := rand.New(rand.NewSource(*modelSeed))
+	model := make(map[string]string)
+	for round := 0; round < ITERATOR_ROUNDS; round++ {
+		for i := 0; i < ITERATOR_WRITES; i++ {
+			key := modelKeys[r.Intn(len(modelKeys))]
+			if r.Intn(4) == 0 {
+				err = st.Del(key)
+				delete(model, key)
+			} else {
+				value := modelValue(r, i)
+				err = st.Put(key, value)
+				model[key] = value
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if round%3 == 1 {
+			if err = st.Flush(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		it, err := st.NewIterator()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := sortedKeys(model)
+		it.SeekToFirst()
+		for i := 0; i <= len(keys); i++ {
+			checkIteratorAt(t, it, model, keys, i, fmt.Sprintf("round %d next %d", round, i))
+			it.Next()
+		}
+
+		it.SeekToLast()
+		for i := len(keys) - 1; i >= -1; i-- {
+			checkIteratorAt(t, it, model, keys, i, fmt.Sprintf("round %d prev %d", round, i))
+			it.Prev()
+		}
+
+		target := modelKeys[r.Intn(len(modelKeys))]
+		it.Seek(target)
+		i := sort.SearchStrings(keys, target)
+		for step := 0; step < ITERATOR_STEPS && i >= 0 && i < len(keys); step++ {
+			checkIteratorAt(t, it, model, keys, i, fmt.Sprintf("round %d step %d from %q", round, step, target))
+			if r.Intn(2) == 0 {
+				it.Next()
+				i += 1
+			} else {
+				it.Prev()
+				i -= 1
+			}
+		}
+
+		checkIteratorAt(t, it, model, keys, i, fmt.Sprintf("round %d walk from %q", round, target))
+		it.SeekForPrev(target)
+		i = sort.SearchStrings(keys, target)
+		if i == len(keys) || keys[i] != target {
+			i -= 1
+		}
+
+		checkIteratorAt(t, it, model, keys, i, fmt.Sprintf("round %d seek for prev %q", round, target))
+		if err = it.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIteratorKeepsItsVersion(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	putRange(t, st, 0, CRASH_KEYS, "a")
+	it, err := st.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 4; round++ {
+		putRange(t, st, 0, CRASH_KEYS, "b")
+	}
+
+	if err = st.Del(crashKey(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Stats().Compactions == 0 {
+		t.Fatal("store never compacted")
+	}
+
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		if want := fmt.Sprintf("a-%d", i); it.Key() != crashKey(i) || it.Value() != want {
+			t.Fatalf("iterator at %s holding %q, want %s holding %q", it.Key(), it.Value(), crashKey(i), want)
+		}
+
+		i += 1
+	}
+
+	if it.Err() != nil || i != CRASH_KEYS {
+		t.Fatalf("iterator stopped after %d keys: %v", i, it.Err())
+	}
+
+	if err = it.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	live := st.(*SsStore).manifest.LiveFiles()
+	entries, err := opts.FS.ReadDir(CRASH_STORE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if _, _, ok := index.ParseFileName(entry.Name()); ok && !live[entry.Name()] {
+			t.Fatalf("obsolete file %s was kept after the iterator closed", entry.Name())
+		}
+	}
+
+	if _, err = st.NewIterator(); err != nil {
+		t.Fatal(err)
+	}
+}
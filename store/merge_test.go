@@ -0,0 +1,174 @@
+package store
+
+import (
+	"errors"
+	"github.com/shimanekb/project2-B/index"
+	"strconv"
+	"testing"
+)
+
+const MERGE_COUNTERS int = 20
+
+// checkCounters fails unless Get, MultiGet and Scan all read counter i of
+// the store as want[i].
+func checkCounters(t *testing.T, st Store, want []int) {
+	keys := make([]string, 0, len(want))
+	for i := range want {
+		keys = append(keys, crashKey(i))
+	}
+
+	results, err := st.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, _, err := st.Scan(keys[0], keys[len(keys)-1], ScanOptions{})
+	if err != nil || len(pairs) != len(want) {
+		t.Fatalf("Scan returned %d pairs, %v, want %d", len(pairs), err, len(want))
+	}
+
+	for i, key := range keys {
+		value, found, err := st.Get(key)
+		if err != nil || !found || value != strconv.Itoa(want[i]) {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %d", key, value, found, err, want[i])
+		}
+
+		if results[i] != (GetResult{value, true}) || pairs[i] != (KeyValue{key, value}) {
+			t.Fatalf("MultiGet and Scan read %s as %+v and %+v, want %q", key, results[i], pairs[i], value)
+		}
+	}
+}
+
+func TestMergeAddsAcrossTables(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	opts.MergeOperatorName = "int64add"
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make([]int, MERGE_COUNTERS)
+	for round := 1; round <= 6; round++ {
+		if round == 3 {
+			if err = st.Put(crashKey(0), "100"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = st.DeleteRange(crashKey(1), crashKey(3)); err != nil {
+				t.Fatal(err)
+			}
+
+			want[0], want[1], want[2] = 100, 0, 0
+		}
+
+		for i := range want {
+			if err = st.Merge(crashKey(i), strconv.Itoa(round)); err != nil {
+				t.Fatal(err)
+			}
+
+			want[i] += round
+		}
+
+		checkCounters(t, st, want)
+		if err = st.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		checkCounters(t, st, want)
+	}
+
+	if st.Stats().Compactions == 0 {
+		t.Fatal("store never compacted")
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	checkCounters(t, st, want)
+	if err = st.Put(crashKey(0), "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Merge(crashKey(0), "1"); err == nil {
+		t.Fatal("merge of 1 into x did not fail")
+	}
+}
+
+func TestMergeNeedsOperator(t *testing.T) {
+	st, err := Open(CRASH_STORE_DIR, crashOptions(index.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	if err = st.Merge(crashKey(0), "1"); !errors.Is(err, ErrNoMergeOperator) {
+		t.Fatalf("Merge without a merge operator returned %v", err)
+	}
+}
+
+func TestMergeOperandsOverFlushedValues(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	opts.MergeOperatorName = "int64add"
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	if err = st.Put(crashKey(0), "5"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Put(crashKey(1), "x"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Merge(crashKey(0), "notanumber"); err == nil {
+		t.Fatal("merge of notanumber was accepted")
+	}
+
+	// the value below is in a table, so this operand only fails to fold
+	// once compacted onto it
+	if err = st.Merge(crashKey(1), "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Merge(crashKey(0), "2"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the operand of key 1 cannot be folded, so compacting stops the store
+	// rather than drop it or the value below it
+	for i := 2; err == nil; i++ {
+		if i > CRASH_KEYS {
+			t.Fatal("store never compacted")
+		}
+
+		if err = st.Put(crashKey(i), "1"); err == nil {
+			err = st.Flush()
+		}
+	}
+
+	var bgErr *BackgroundError
+	if !errors.As(err, &bgErr) || st.Stats().Compactions != 0 {
+		t.Fatalf("compacting an operand that cannot be folded returned %v", err)
+	}
+
+	if value, _, err := st.Get(crashKey(0)); err != nil || value != "7" {
+		t.Fatalf("Get(%s) = %q, %v, want 7", crashKey(0), value, err)
+	}
+
+	if value, _, err := st.Get(crashKey(1)); err == nil {
+		t.Fatalf("Get(%s) = %q, want its operand kept and failing to fold", crashKey(1), value)
+	}
+}
@@ -0,0 +1,473 @@
+package store
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+const (
+	MODEL_STORE_DIR      string = "/db/model"
+	MODEL_KEYS           int    = 80
+	MODEL_COMMANDS       int    = 400
+	MODEL_RUNS           int    = 20
+	SCAN_COMMAND         string = "scan"
+	RSCAN_COMMAND        string = "rscan"
+	DELRANGE_COMMAND     string = "delrange"
+	MGET_COMMAND         string = "mget"
+	MERGE_COMMAND        string = "merge"
+	FLUSH_COMMAND        string = "flush"
+	REOPEN_COMMAND       string = "reopen"
+	MODEL_INPUT_HEADER   string = "type,key1,key2,value"
+	MODEL_MISSING_RESULT string = "<missing>"
+	MODEL_SCAN_LIMIT     int    = 3
+	MODEL_PREFIX_LENGTH  int    = 15
+)
+
+var (
+	modelSeed = flag.Int64("model_seed", 1, "First seed of the randomized model test.")
+	modelRuns = flag.Int("model_runs", MODEL_RUNS, "Number of seeds the randomized model test runs.")
+	modelOut  = flag.String("model_out", "", "Write the shrunk input of a failing model test to this file.")
+)
+
+// modelKeys are the keys commands pick from. Besides the usual key format
+// they hold keys whose hashes collide and keys the csv files have to quote.
+var modelKeys = func() []string {
+	keys := []string{"key0000000009774", "key0000000037751", "key0000000005786",
+		"key0000000054129", "k,comma", `k"quote`, "k\nnewline", " k space", "z"}
+	for i := 0; len(keys) < MODEL_KEYS; i++ {
+		keys = append(keys, crashKey(i*7))
+	}
+
+	return keys
+}()
+
+// modelCommand is one line of a docs/input_*.txt style command file.
+type modelCommand struct {
+	Type   string
+	Key    string
+	KeyTwo string
+	Value  string
+}
+
+func (c modelCommand) String() string {
+	return fmt.Sprintf("%s(%.20q, %.20q, %.20q)", c.Type, c.Key, c.KeyTwo, c.Value)
+}
+
+// storeOpener opens the store under test, returning the same store each
+// time it is called within a run.
+type storeOpener func() (Store, error)
+
+func memStoreOpener() storeOpener {
+	opts := crashOptions(index.NewMemFS())
+	opts.BlockSizeBytes = 256
+	opts.MemTableBytes = 2000
+	opts.PrefixLength = MODEL_PREFIX_LENGTH
+	opts.MergeOperatorName = "stringappend"
+	return func() (Store, error) {
+		return NewSsStore(MODEL_STORE_DIR, opts)
+	}
+}
+
+func modelValue(r *rand.Rand, i int) string {
+	switch r.Intn(6) {
+	case 0:
+		return ""
+	case 1:
+		return fmt.Sprintf("v%d,with \"quotes\"\nand lines", i)
+	case 2:
+		return fmt.Sprintf("v%d-%s", i, strings.Repeat("x", 40+r.Intn(200)))
+	}
+
+	return fmt.Sprintf("v%d-%s", i, strings.Repeat("v", r.Intn(20)))
+}
+
+func generateCommands(seed int64, n int) []modelCommand {
+	r := rand.New(rand.NewSource(seed))
+	key := func() string { return modelKeys[r.Intn(len(modelKeys))] }
+	commands := make([]modelCommand, 0, n)
+	for i := 0; i < n; i++ {
+		var c modelCommand
+		switch p := r.Intn(100); {
+		case p < 40:
+			c = modelCommand{Type: PUT_COMMAND, Key: key(), Value: modelValue(r, i)}
+		case p < 45:
+			c = modelCommand{Type: MERGE_COMMAND, Key: key(), Value: modelValue(r, i)}
+		case p < 63:
+			c = modelCommand{Type: GET_COMMAND, Key: key()}
+		case p < 70:
+			c = modelCommand{Type: MGET_COMMAND, Key: key(), KeyTwo: key(), Value: key()}
+		case p < 80:
+			c = modelCommand{Type: DEL_COMMAND, Key: key()}
+		case p < 83:
+			c = modelCommand{Type: DELRANGE_COMMAND, Key: key(), KeyTwo: key()}
+		case p < 90:
+			c = modelCommand{Type: SCAN_COMMAND, Key: key(), KeyTwo: key()}
+		case p < 95:
+			c = modelCommand{Type: RSCAN_COMMAND, Key: key(), KeyTwo: key()}
+		case p < 98:
+			c = modelCommand{Type: FLUSH_COMMAND}
+		default:
+			c = modelCommand{Type: REOPEN_COMMAND}
+		}
+
+		commands = append(commands, c)
+	}
+
+	return commands
+}
+
+func modelScan(model map[string]string, keyone string, keytwo string, reverse bool) []KeyValue {
+	low, high := index.KeyRange(keyone, keytwo)
+	return modelPairs(model, func(key string) bool { return key >= low && key <= high }, reverse)
+}
+
+func modelPrefixScan(model map[string]string, prefix string, reverse bool) []KeyValue {
+	return modelPairs(model, func(key string) bool { return strings.HasPrefix(key, prefix) }, reverse)
+}
+
+// modelPairs returns the pairs of model whose keys are in the scan, in the
+// order it scans them.
+func modelPairs(model map[string]string, in func(key string) bool, reverse bool) []KeyValue {
+	keys := make([]string, 0)
+	for key := range model {
+		if in(key) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Strings(keys)
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(keys)))
+	}
+
+	pairs := make([]KeyValue, 0, len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, KeyValue{key, model[key]})
+	}
+
+	return pairs
+}
+
+// pagedScan scans between keyone and keytwo MODEL_SCAN_LIMIT pairs at a
+// time, following the cursor of each page.
+func pagedScan(s Store, keyone string, keytwo string, reverse bool) ([]KeyValue, error) {
+	var pairs []KeyValue
+	opts := ScanOptions{Limit: MODEL_SCAN_LIMIT, Reverse: reverse}
+	for {
+		page, cursor, err := s.Scan(keyone, keytwo, opts)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs = append(pairs, page...)
+		if cursor == "" {
+			return pairs, nil
+		}
+
+		opts.Cursor = cursor
+	}
+}
+
+func samePairs(got []KeyValue, want []KeyValue) bool {
+	if len(got) != len(want) {
+		return false
+	}
+
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// runModel runs commands against the store open returns and checks every
+// result against a map. It returns how the first wrong result differs, or
+// an empty string if the store agreed with the map throughout.
+func runModel(open storeOpener, commands []modelCommand) (failure string) {
+	step := -1
+	defer func() {
+		if r := recover(); r != nil {
+			failure = fmt.Sprintf("command %d %v panicked: %v", step, commands[step], r)
+		}
+	}()
+
+	s, err := open()
+	if err != nil {
+		return fmt.Sprintf("could not open store: %v", err)
+	}
+
+	model := make(map[string]string)
+	for i, c := range commands {
+		step = i
+		switch c.Type {
+		case PUT_COMMAND:
+			if err = s.Put(c.Key, c.Value); err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			model[c.Key] = c.Value
+		case MERGE_COMMAND:
+			if err = s.Merge(c.Key, c.Value); err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			if old, ok := model[c.Key]; ok {
+				model[c.Key] = old + "," + c.Value
+			} else {
+				model[c.Key] = c.Value
+			}
+		case DEL_COMMAND:
+			if err = s.Del(c.Key); err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			delete(model, c.Key)
+		case MGET_COMMAND:
+			keys := []string{c.Key, c.KeyTwo, c.Value}
+			results, err := s.MultiGet(keys)
+			if err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			for j, key := range keys {
+				want, wantOk := model[key]
+				if results[j].Found != wantOk || results[j].Value != want {
+					return fmt.Sprintf("command %d %v returned %+.40v for %.20q, want %.40q, %v",
+						i, c, results[j], key, want, wantOk)
+				}
+			}
+		case DELRANGE_COMMAND:
+			err = s.DeleteRange(c.Key, c.KeyTwo)
+			if c.Key >= c.KeyTwo {
+				if !errors.Is(err, ErrInvalidArgument) {
+					return fmt.Sprintf("command %d %v of an empty range returned %v", i, c, err)
+				}
+
+				break
+			}
+
+			if err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			for key := range model {
+				if key >= c.Key && key < c.KeyTwo {
+					delete(model, key)
+				}
+			}
+		case GET_COMMAND:
+			want, wantOk := model[c.Key]
+			got, ok, err := s.Get(c.Key)
+			if err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			if ok != wantOk || (ok && got != want) {
+				if !wantOk {
+					want = MODEL_MISSING_RESULT
+				}
+
+				if !ok {
+					got = MODEL_MISSING_RESULT
+				}
+
+				return fmt.Sprintf("command %d %v returned %.40q, want %.40q", i, c, got, want)
+			}
+		case SCAN_COMMAND, RSCAN_COMMAND:
+			reverse := c.Type == RSCAN_COMMAND
+			want := modelScan(model, c.Key, c.KeyTwo, reverse)
+			got, _, err := s.Scan(c.Key, c.KeyTwo, ScanOptions{Reverse: reverse})
+			if err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			if !samePairs(got, want) {
+				return fmt.Sprintf("command %d %v returned %d pairs %.60q, want %d pairs %.60q",
+					i, c, len(got), got, len(want), want)
+			}
+
+			if got, err = pagedScan(s, c.Key, c.KeyTwo, reverse); err != nil {
+				return fmt.Sprintf("command %d %v failed in pages: %v", i, c, err)
+			}
+
+			if !samePairs(got, want) {
+				return fmt.Sprintf("command %d %v returned %d pairs in pages %.60q, want %d pairs %.60q",
+					i, c, len(got), got, len(want), want)
+			}
+
+			prefix := c.Key
+			if len(prefix) > MODEL_PREFIX_LENGTH {
+				prefix = prefix[:MODEL_PREFIX_LENGTH]
+			}
+
+			want = modelPrefixScan(model, prefix, reverse)
+			if got, _, err = s.ScanPrefix(prefix, ScanOptions{Reverse: reverse}); err != nil {
+				return fmt.Sprintf("command %d %v failed to scan prefix %q: %v", i, c, prefix, err)
+			}
+
+			if !samePairs(got, want) {
+				return fmt.Sprintf("command %d %v returned %d pairs for prefix %q %.60q, want %d pairs %.60q",
+					i, c, len(got), prefix, got, len(want), want)
+			}
+		case FLUSH_COMMAND:
+			if err = s.Flush(); err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+		case REOPEN_COMMAND:
+			if err = s.Close(); err != nil {
+				return fmt.Sprintf("command %d %v failed: %v", i, c, err)
+			}
+
+			if s, err = open(); err != nil {
+				return fmt.Sprintf("command %d %v could not reopen store: %v", i, c, err)
+			}
+		}
+	}
+
+	if err = s.Close(); err != nil {
+		return fmt.Sprintf("could not close store: %v", err)
+	}
+
+	return ""
+}
+
+// shrinkCommands removes commands from a failing input for as long as what
+// remains still fails, trying large chunks first, and returns the smallest
+// failing input found along with its failure.
+func shrinkCommands(newOpener func() storeOpener, commands []modelCommand, failure string) ([]modelCommand, string) {
+	for chunk := len(commands) / 2; chunk > 0; {
+		shrunk := false
+		for start := 0; start+chunk <= len(commands); {
+			candidate := append(append([]modelCommand{}, commands[:start]...), commands[start+chunk:]...)
+			if f := runModel(newOpener(), candidate); f != "" {
+				commands, failure, shrunk = candidate, f, true
+				continue
+			}
+
+			start += chunk
+		}
+
+		if !shrunk {
+			chunk /= 2
+		}
+	}
+
+	return commands, failure
+}
+
+// commandsCsv writes commands in the format of the docs/input_*.txt files.
+func commandsCsv(commands []modelCommand) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(MODEL_INPUT_HEADER + "\n")
+	w := csv.NewWriter(&buf)
+	for _, c := range commands {
+		w.Write([]string{c.Type, c.Key, c.KeyTwo, c.Value})
+	}
+
+	w.Flush()
+	return buf.String(), w.Error()
+}
+
+// checkModel runs the commands seed generates and, if the store disagrees
+// with the model, fails with the shrunk input that reproduces it.
+func checkModel(t *testing.T, newOpener func() storeOpener, seed int64, n int) {
+	commands := generateCommands(seed, n)
+	failure := runModel(newOpener(), commands)
+	if failure == "" {
+		return
+	}
+
+	commands, failure = shrinkCommands(newOpener, commands, failure)
+	input, err := commandsCsv(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if *modelOut != "" {
+		if err = ioutil.WriteFile(*modelOut, []byte(input), 0644); err != nil {
+			t.Errorf("could not write %s: %v", *modelOut, err)
+		}
+	}
+
+	t.Fatalf("seed %d: %s\nshrunk to %d commands:\n%s", seed, failure, len(commands), input)
+}
+
+func TestStoreMatchesModel(t *testing.T) {
+	runs := *modelRuns
+	if testing.Short() && runs > MODEL_RUNS/5 {
+		runs = MODEL_RUNS / 5
+	}
+
+	for i := 0; i < runs; i++ {
+		checkModel(t, memStoreOpener, *modelSeed+int64(i), MODEL_COMMANDS)
+	}
+}
+
+// lossyStore forgets deletes of one key, standing in for a store with a bug.
+type lossyStore struct {
+	Store
+	key string
+}
+
+func (s lossyStore) Del(key string) error {
+	if key != s.key {
+		return s.Store.Del(key)
+	}
+
+	return nil
+}
+
+func TestModelShrinksFailures(t *testing.T) {
+	newOpener := func() storeOpener {
+		open := memStoreOpener()
+		return func() (Store, error) {
+			s, err := open()
+			return lossyStore{s, modelKeys[0]}, err
+		}
+	}
+
+	var commands []modelCommand
+	var failure string
+	for seed := int64(1); failure == "" && seed < 100; seed++ {
+		commands = generateCommands(seed, MODEL_COMMANDS)
+		failure = runModel(newOpener(), commands)
+	}
+
+	if failure == "" {
+		t.Fatal("model never caught the lost delete")
+	}
+
+	commands, failure = shrinkCommands(newOpener, commands, failure)
+	if len(commands) != 3 || commands[0].Type != PUT_COMMAND || commands[1].Type != DEL_COMMAND {
+		t.Fatalf("shrunk to %v, want a put, del and read of %s", commands, modelKeys[0])
+	}
+
+	input, err := commandsCsv(commands)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(strings.NewReader(input)).ReadAll()
+	if err != nil || len(records) != 4 || strings.Join(records[0], ",") != MODEL_INPUT_HEADER {
+		t.Fatalf("reproducer %q does not read back as an input file: %v", input, err)
+	}
+
+	if records[2][0] != DEL_COMMAND || records[2][1] != modelKeys[0] {
+		t.Fatalf("reproducer %q lost the failing delete", input)
+	}
+
+	if !strings.Contains(failure, "want") {
+		t.Fatalf("shrunk failure %q does not say what was expected", failure)
+	}
+}
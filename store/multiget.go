@@ -0,0 +1,88 @@
+package store
+
+import (
+	"context"
+	"github.com/shimanekb/project2-B/index"
+	"sort"
+)
+
+// GetResult is the outcome of looking up one key of a MultiGet.
+type GetResult struct {
+	Value string
+	Found bool
+}
+
+// MultiGet looks keys up together, returning a result for each in the order
+// given. Keys are looked up in key order, and those a table keeps in the
+// same block share one read of it.
+func (s *SsStore) MultiGet(keys []string) ([]GetResult, error) {
+	return s.MultiGetContext(context.Background(), keys)
+}
+
+// MultiGetContext is MultiGet that stops reading tables once ctx is done.
+func (s *SsStore) MultiGetContext(ctx context.Context, keys []string) ([]GetResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+
+	sorted := append([]string{}, keys...)
+	sort.Strings(sorted)
+	mergers := make(map[string]*index.Merger, len(sorted))
+	pending := make([]string, 0, len(sorted))
+	for i, key := range sorted {
+		if i > 0 && key == sorted[i-1] {
+			continue
+		}
+
+		mergers[key] = index.NewMerger(s.opts, key)
+		if !s.memTableGet(mergers[key], key) {
+			pending = append(pending, key)
+		}
+	}
+
+	for _, table := range append(storages(s.tables), s.blockStorage) {
+		if len(pending) == 0 {
+			break
+		}
+
+		entries, err := table.MultiGet(ctx, pending)
+		if err != nil {
+			return nil, err
+		}
+
+		rest := pending[:0]
+		for i, key := range pending {
+			m := mergers[key]
+			if m.Add(entries[i]) {
+				continue
+			}
+
+			if table.RangeTombstones().Covers(key) {
+				m.Add(index.Entry{Deleted: true, Found: true})
+			} else {
+				rest = append(rest, key)
+			}
+		}
+
+		pending = rest
+	}
+
+	results := make([]GetResult, len(keys))
+	for i, key := range keys {
+		value, found, err := mergers[key].Result()
+		if err != nil {
+			return nil, err
+		}
+
+		results[i] = GetResult{value, found}
+	}
+
+	return results, nil
+}
@@ -0,0 +1,161 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"os"
+	"testing"
+)
+
+// checkKeys fails unless the store holds exactly the keys of want, as read by
+// Get, Scan and an iterator.
+func checkKeys(t *testing.T, st Store, want map[int]string) {
+	for i := 0; i < CRASH_KEYS; i++ {
+		value, found, err := st.Get(crashKey(i))
+		if err != nil || found != (want[i] != "") || value != want[i] {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", crashKey(i), value, found, err, want[i])
+		}
+	}
+
+	pairs, _, err := st.Scan(crashKey(0), crashKey(CRASH_KEYS), ScanOptions{})
+	if err != nil || len(pairs) != len(want) {
+		t.Fatalf("Scan returned %d pairs, %v, want %d", len(pairs), err, len(want))
+	}
+
+	it, err := st.NewIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer it.Close()
+	n := 0
+	for it.SeekToLast(); it.Valid(); it.Prev() {
+		n += 1
+	}
+
+	if it.Err() != nil || n != len(want) {
+		t.Fatalf("iterator walked %d keys, %v, want %d", n, it.Err(), len(want))
+	}
+}
+
+func TestDeleteRangeHidesOlderKeys(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[int]string)
+	putRange(t, st, 0, CRASH_KEYS, "a")
+	for i := 0; i < CRASH_KEYS; i++ {
+		want[i] = fmt.Sprintf("a-%d", i)
+	}
+
+	if err = st.Put(crashKey(12), "memtable"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.DeleteRange(crashKey(10), crashKey(20)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Put(crashKey(15), "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 10; i < 20; i++ {
+		delete(want, i)
+	}
+
+	want[15] = "b"
+	checkKeys(t, st, want)
+	for _, end := range []string{crashKey(20), crashKey(30)} {
+		if err = st.DeleteRange(crashKey(30), end); !errors.Is(err, ErrInvalidArgument) {
+			t.Fatalf("DeleteRange(%s, %s) returned %v", crashKey(30), end, err)
+		}
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	if tables := st.(*SsStore).tables; len(tables) == 0 || len(tables[0].RangeTombstones()) != 1 {
+		t.Fatal("range tombstone was not flushed into an L0 table")
+	}
+
+	checkKeys(t, st, want)
+	if err = st.DeleteRange(crashKey(0), crashKey(CRASH_KEYS)); err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < opts.L0CompactionTrigger; round++ {
+		if err = st.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = st.DeleteRange(crashKey(0), crashKey(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	ss := st.(*SsStore)
+	if len(ss.tables) != 0 || len(ss.blockStorage.RangeTombstones()) != 0 || ss.blockStorage.FileSize() == 0 {
+		t.Fatalf("compaction left %d L0 tables and range tombstones %v", len(ss.tables), ss.blockStorage.RangeTombstones())
+	}
+
+	checkKeys(t, st, map[int]string{})
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatalf("could not reopen a store compacted to nothing: %v", err)
+	}
+
+	defer reopened.Close()
+	checkKeys(t, reopened, map[int]string{})
+}
+
+func TestMemTableCommandsKeepPutsAfterRangeTombstones(t *testing.T) {
+	cache := NewMemTableCache()
+	cache.Add(crashKey(1), index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(crashKey(1), "a")})
+	cache.AddRangeTombstone(index.RangeTombstone{Start: crashKey(0), End: crashKey(5)})
+	cache.Add(crashKey(2), index.Command{Type: PUT_COMMAND, Item: index.NewKeyValueItem(crashKey(2), "b")})
+
+	fs := index.NewMemFS()
+	if err := fs.MkdirAll(CRASH_STORE_DIR, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	base, err := index.NewSsBlockStorage(index.TableFileName(CRASH_STORE_DIR, 1), crashOptions(fs))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	written, err := base.WriteKvItems(convertToKeyValueItems(cache))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, want := range map[string]string{crashKey(1): "", crashKey(2): "b"} {
+		block, err := written.ReadBlock(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if value, _, err := block.Get(key); err != nil || value != want {
+			t.Fatalf("Get(%s) = %q, %v, want %q", key, value, err, want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// openReadOnly opens the existing store at dataPath for reading. It shares
+// the lock on the READ_LOCK file of the store with other read only stores,
+// which keeps the store writing to dataPath from deleting files they may
+// still be reading.
+func openReadOnly(dataPath string, opts index.Options) (Store, error) {
+	if err := checkStoreFile(dataPath, opts); err != nil {
+		log.Errorf("Could not open store at %s. %v", dataPath, err)
+		return nil, err
+	}
+
+	lock, err := opts.FileSystem().RLock(index.ReadLockFileName(dataPath))
+	if err != nil {
+		log.Errorf("Could not lock store at %s for reading. %v", dataPath, err)
+		return nil, err
+	}
+
+	store := SsStore{dir: dataPath, cache: NewMemTableCache(), opts: opts, lock: lock}
+	store.cond = sync.NewCond(&store.mu)
+	store.stats.Stall.DurationByReason = make(map[StallReason]time.Duration)
+	manifest, err := index.ReadManifest(dataPath, opts)
+	if err == nil {
+		err = store.loadVersion(manifest)
+	}
+
+	if err != nil {
+		log.Errorf("Could not open store at %s for reading. %v", dataPath, err)
+		lock.Close()
+		return nil, err
+	}
+
+	log.Infof("Opened store %s for reading at sequence %d.", dataPath, store.lastSequence)
+	return &store, nil
+}
+
+// Refresh replays the manifest of a read only store to pick up the tables
+// flushed and compacted since it was opened or last refreshed.
+func (s *SsStore) Refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if !s.opts.ReadOnly {
+		return nil
+	}
+
+	manifest, err := index.ReadManifest(s.dir, s.opts)
+	if err != nil {
+		log.Errorf("Could not refresh store %s. %v", s.dir, err)
+		return err
+	}
+
+	if err = s.loadVersion(manifest); err != nil {
+		log.Errorf("Could not refresh store %s. %v", s.dir, err)
+		return err
+	}
+
+	log.Infof("Refreshed store %s to sequence %d.", s.dir, s.lastSequence)
+	return nil
+}
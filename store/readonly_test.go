@@ -0,0 +1,142 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const READ_ONLY_STORE_DIR string = "/db/readonly"
+
+func readOnlyOptions(opts index.Options) index.Options {
+	opts.ReadOnly = true
+	return opts
+}
+
+func putRange(t *testing.T, st Store, start int, end int, version string) {
+	for i := start; i < end; i++ {
+		if err := st.Put(crashKey(i), fmt.Sprintf("%s-%d", version, i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkRange(t *testing.T, st Store, start int, end int, version string) {
+	for i := start; i < end; i++ {
+		want := fmt.Sprintf("%s-%d", version, i)
+		if got, found, err := st.Get(crashKey(i)); err != nil || !found || got != want {
+			t.Fatalf("Get(%s) = %q, %v, %v, want %q", crashKey(i), got, found, err, want)
+		}
+	}
+}
+
+func TestReadOnlyStoreReadsLiveStore(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	if _, err := Open(READ_ONLY_STORE_DIR, readOnlyOptions(opts)); err == nil {
+		t.Fatal("opened a store that does not exist read only")
+	}
+
+	writer, err := Open(READ_ONLY_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer writer.Close()
+	putRange(t, writer, 0, CRASH_KEYS, "a")
+	reader, err := Open(READ_ONLY_STORE_DIR, readOnlyOptions(opts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := Open(READ_ONLY_STORE_DIR, readOnlyOptions(opts))
+	if err != nil {
+		t.Fatalf("second read only store could not open: %v", err)
+	}
+
+	other.Close()
+	checkRange(t, reader, 0, CRASH_KEYS, "a")
+	if err = reader.Put(crashKey(0), "b"); err != ErrReadOnly {
+		t.Fatalf("read only Put returned %v", err)
+	}
+
+	if err = reader.Del(crashKey(0)); err != ErrReadOnly {
+		t.Fatalf("read only Del returned %v", err)
+	}
+
+	if err = reader.Flush(); err != ErrReadOnly {
+		t.Fatalf("read only Flush returned %v", err)
+	}
+
+	for round := 0; round < 4; round++ {
+		putRange(t, writer, 0, CRASH_KEYS, "b")
+	}
+
+	if writer.Stats().Compactions == 0 {
+		t.Fatal("writer never compacted")
+	}
+
+	rs := reader.(*SsStore)
+	for _, meta := range append(rs.manifest.Tables(0), rs.manifest.Tables(1)...) {
+		if path := index.TableFileName(READ_ONLY_STORE_DIR, meta.Number); !fileExists(opts.FS, path) {
+			t.Fatalf("%s was deleted while a read only store was open", path)
+		}
+	}
+
+	checkRange(t, reader, 0, CRASH_KEYS, "a")
+	if err = reader.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkRange(t, reader, 0, CRASH_KEYS, "b")
+	if err = reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	putRange(t, writer, 0, CRASH_KEYS, "c")
+	live := writer.(*SsStore).manifest.LiveFiles()
+	entries, err := opts.FS.ReadDir(READ_ONLY_STORE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		if _, _, ok := index.ParseFileName(entry.Name()); ok && !live[entry.Name()] {
+			t.Fatalf("obsolete file %s was kept after the read only store closed", entry.Name())
+		}
+	}
+}
+
+func TestReadOnlyStoreSharesLockOnDisk(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	opts := index.DefaultOptions()
+	writer, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer writer.Close()
+	putRange(t, writer, 0, 10, "a")
+	for i := 0; i < 2; i++ {
+		reader, err := Open(dir, readOnlyOptions(opts))
+		if err != nil {
+			t.Fatalf("read only store %d could not open: %v", i, err)
+		}
+
+		defer reader.Close()
+		checkRange(t, reader, 0, 10, "a")
+	}
+
+	if readersOpen(opts.FileSystem(), dir) == false {
+		t.Fatal("writer does not see the read only stores")
+	}
+
+	if _, err = os.Stat(index.LockFileName(dir)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,165 @@
+package store
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/shimanekb/project2-B/index"
+)
+
+// KeyValue is a key of the store and its value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// ScanOptions page through the results of a scan.
+type ScanOptions struct {
+	// Limit caps the number of pairs a scan returns, or is 0 for no limit.
+	Limit int
+	// Cursor continues a scan from where the one that returned it stopped.
+	Cursor string
+	// Reverse scans in descending key order.
+	Reverse bool
+}
+
+func encodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+func decodeCursor(cursor string) (key string, err error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", ErrInvalidCursor
+	}
+
+	return string(b), nil
+}
+
+// scanRange bounds the keys of a scan. It holds keys from low, and up to
+// high unless unbounded, taking high itself unless exclusive.
+type scanRange struct {
+	low       string
+	high      string
+	exclusive bool
+	unbounded bool
+}
+
+// prefixRange holds the keys starting with prefix.
+func prefixRange(prefix string) scanRange {
+	// the first key past the prefix has its last byte below 0xff raised
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			return scanRange{low: prefix, high: prefix[:i] + string([]byte{prefix[i] + 1}), exclusive: true}
+		}
+	}
+
+	return scanRange{low: prefix, unbounded: true}
+}
+
+func (r scanRange) contains(key string) bool {
+	return key >= r.low && (r.unbounded || key < r.high || (!r.exclusive && key == r.high))
+}
+
+// resume narrows r to the keys a scan in the direction of opts has left
+// after its cursor.
+func (r scanRange) resume(opts ScanOptions) (scanRange, error) {
+	if opts.Cursor == "" {
+		return r, nil
+	}
+
+	key, err := decodeCursor(opts.Cursor)
+	if err != nil {
+		return r, err
+	}
+
+	if opts.Reverse && (r.unbounded || key < r.high) {
+		r.high, r.exclusive, r.unbounded = key, false, false
+	} else if !opts.Reverse && key > r.low {
+		r.low = key
+	}
+
+	return r, nil
+}
+
+// Scan returns the keys between keyone and keytwo in key order, or in
+// descending order if reversed, with their newest values. If the limit cut
+// it short, cursor is returned to carry on from the next key, otherwise it
+// is empty.
+func (s *SsStore) Scan(keyone string, keytwo string, opts ScanOptions) (pairs []KeyValue, cursor string, err error) {
+	return s.ScanContext(context.Background(), keyone, keytwo, opts)
+}
+
+func (s *SsStore) ScanContext(ctx context.Context, keyone string, keytwo string, opts ScanOptions) (pairs []KeyValue, cursor string, err error) {
+	low, high := index.KeyRange(keyone, keytwo)
+	return s.scan(ctx, scanRange{low: low, high: high}, "", opts)
+}
+
+// ScanPrefix is Scan of the keys starting with prefix. Tables whose prefix
+// bloom filter rules the prefix out are not read.
+func (s *SsStore) ScanPrefix(prefix string, opts ScanOptions) (pairs []KeyValue, cursor string, err error) {
+	return s.ScanPrefixContext(context.Background(), prefix, opts)
+}
+
+func (s *SsStore) ScanPrefixContext(ctx context.Context, prefix string, opts ScanOptions) (pairs []KeyValue, cursor string, err error) {
+	return s.scan(ctx, prefixRange(prefix), prefix, opts)
+}
+
+// scan returns the pairs of r, reading only tables that may hold prefix.
+func (s *SsStore) scan(ctx context.Context, r scanRange, prefix string, opts ScanOptions) (pairs []KeyValue, cursor string, err error) {
+	if err = ctx.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if r, err = r.resume(opts); err != nil {
+		return nil, "", err
+	}
+
+	it, err := s.newIterator(prefix)
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer it.Close()
+	switch {
+	case !opts.Reverse:
+		it.Seek(r.low)
+	case r.unbounded:
+		it.SeekToLast()
+	default:
+		it.SeekForPrev(r.high)
+		if r.exclusive && it.Valid() && it.Key() == r.high {
+			it.Prev()
+		}
+	}
+
+	for ; it.Valid() && r.contains(it.Key()); scanNext(it, opts) {
+		if err = ctx.Err(); err != nil {
+			return nil, "", err
+		}
+
+		if opts.Limit > 0 && len(pairs) == opts.Limit {
+			return pairs, encodeCursor(it.Key()), nil
+		}
+
+		pair := KeyValue{it.Key(), it.Value()}
+		if it.Err() != nil {
+			break
+		}
+
+		pairs = append(pairs, pair)
+	}
+
+	if err = it.Err(); err != nil {
+		return nil, "", err
+	}
+
+	return pairs, "", nil
+}
+
+func scanNext(it Iterator, opts ScanOptions) {
+	if opts.Reverse {
+		it.Prev()
+	} else {
+		it.Next()
+	}
+}
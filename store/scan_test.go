@@ -0,0 +1,91 @@
+package store
+
+import (
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"testing"
+)
+
+func TestScanPagesWithCursor(t *testing.T) {
+	st, err := Open(CRASH_STORE_DIR, crashOptions(index.NewMemFS()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	putRange(t, st, 0, 10, "a")
+	if err = st.Del(crashKey(4)); err != nil {
+		t.Fatal(err)
+	}
+
+	pairs, cursor, err := st.Scan(crashKey(8), crashKey(2), ScanOptions{Limit: 3})
+	if err != nil || len(pairs) != 3 || cursor == "" {
+		t.Fatalf("first page returned %v, %q, %v", pairs, cursor, err)
+	}
+
+	want := []int{2, 3, 5, 6, 7, 8}
+	pairs, cursor, err = st.Scan(crashKey(8), crashKey(2), ScanOptions{Limit: 3, Cursor: cursor})
+	if err != nil || len(pairs) != 3 || cursor != "" {
+		t.Fatalf("last page returned %v, %q, %v", pairs, cursor, err)
+	}
+
+	for i, pair := range pairs {
+		if n := want[i+3]; pair.Key != crashKey(n) || pair.Value != fmt.Sprintf("a-%d", n) {
+			t.Fatalf("last page holds %v, want %s", pair, crashKey(n))
+		}
+	}
+
+	if _, _, err = st.Scan(crashKey(0), crashKey(9), ScanOptions{Cursor: "!"}); err != ErrInvalidCursor {
+		t.Fatalf("scan with a bad cursor returned %v", err)
+	}
+}
+
+func TestScanPrefixSkipsTables(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	opts.PrefixLength = len("tenant00")
+	opts.L0CompactionTrigger = 8
+	opts.L0SlowdownWritesTrigger = 8
+	opts.L0StopWritesTrigger = 8
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	for tenant := 0; tenant < 4; tenant++ {
+		for i := 0; i < 20; i++ {
+			if err = st.Put(fmt.Sprintf("tenant%02d/%03d", tenant, i), fmt.Sprintf("v%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err = st.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if files := st.Stats().L0Files; files != 4 {
+		t.Fatalf("store holds %d L0 tables, want one per tenant", files)
+	}
+
+	pairs, _, err := st.ScanPrefix("tenant02", ScanOptions{Reverse: true})
+	if err != nil || len(pairs) != 20 {
+		t.Fatalf("ScanPrefix returned %d pairs, %v", len(pairs), err)
+	}
+
+	for i, pair := range pairs {
+		if want := fmt.Sprintf("tenant02/%03d", 19-i); pair.Key != want {
+			t.Fatalf("pair %d is %s, want %s", i, pair.Key, want)
+		}
+	}
+
+	it, err := st.(*SsStore).newIterator("tenant02")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer it.Close()
+	if len(it.sources) != 2 {
+		t.Fatalf("prefix iterator reads %d sources, want the memtable and one table", len(it.sources))
+	}
+}
@@ -0,0 +1,198 @@
+package store
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+// StallReason names what background work writes are waiting on.
+type StallReason int
+
+const (
+	NoStall StallReason = iota
+	StallPendingFlushes
+	StallL0Files
+	StallPendingCompactionBytes
+)
+
+var stallReasonNames = []string{"none", "pending flushes", "L0 files", "pending compaction bytes"}
+
+func (r StallReason) String() string {
+	return stallReasonNames[r]
+}
+
+type StallStats struct {
+	// Reason is the stall writes are currently held up by, if any.
+	Reason           StallReason
+	Slowdowns        int64
+	Stops            int64
+	SlowdownDuration time.Duration
+	StopDuration     time.Duration
+	DurationByReason map[StallReason]time.Duration
+}
+
+type Stats struct {
+	MemTableBytes          int64
+	ImmutableMemTables     int
+	L0Files                int
+	PendingCompactionBytes int64
+	Flushes                int64
+	Compactions            int64
+	Stall                  StallStats
+}
+
+func (s *SsStore) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stats := s.stats
+	stats.Stall.DurationByReason = make(map[StallReason]time.Duration)
+	for reason, d := range s.stats.Stall.DurationByReason {
+		stats.Stall.DurationByReason[reason] = d
+	}
+
+	stats.MemTableBytes = s.cache.ApproximateMemoryUsage()
+	stats.ImmutableMemTables = len(s.immutables)
+	stats.L0Files = len(s.tables)
+	stats.PendingCompactionBytes = s.pendingCompactionBytes
+	return stats
+}
+
+// stallCondition decides whether background work has fallen far enough
+// behind that the next write should be delayed, or stopped outright.
+func (s *SsStore) stallCondition() (reason StallReason, stop bool) {
+	o := s.opts
+	l0 := len(s.tables)
+	pending := s.pendingCompactionBytes
+	switch {
+	case s.shouldFlush() && len(s.immutables) >= o.MaxPendingFlushes:
+		return StallPendingFlushes, true
+	case l0 >= o.L0StopWritesTrigger:
+		return StallL0Files, true
+	case o.HardPendingCompactionBytes > 0 && pending >= o.HardPendingCompactionBytes:
+		return StallPendingCompactionBytes, true
+	case o.PendingFlushesSlowdownTrigger > 0 && len(s.immutables) >= o.PendingFlushesSlowdownTrigger:
+		return StallPendingFlushes, false
+	case l0 >= o.L0SlowdownWritesTrigger:
+		return StallL0Files, false
+	case o.SoftPendingCompactionBytes > 0 && pending >= o.SoftPendingCompactionBytes:
+		return StallPendingCompactionBytes, false
+	}
+
+	return NoStall, false
+}
+
+func (s *SsStore) recordStall(reason StallReason, stop bool, d time.Duration) {
+	if stop {
+		s.stats.Stall.StopDuration += d
+	} else {
+		s.stats.Stall.SlowdownDuration += d
+	}
+
+	s.stats.Stall.DurationByReason[reason] += d
+}
+
+// waitContext waits on cond like cond.Wait, also waking once ctx is done,
+// and returns the error of ctx if it is.
+func (s *SsStore) waitContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		s.cond.Wait()
+		return nil
+	}
+
+	waited := make(chan struct{})
+	defer close(waited)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-waited:
+		}
+	}()
+
+	s.cond.Wait()
+	return ctx.Err()
+}
+
+// sleepContext sleeps for d with mu released, waking early once ctx is done.
+func (s *SsStore) sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	s.mu.Unlock()
+	defer s.mu.Lock()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hasRoom is called with mu held to report whether a write can be made
+// without makeRoomForWrite waiting or switching memtables first. A slowdown
+// is no reason to wait once the write has been delayed.
+func (s *SsStore) hasRoom(delayed bool) bool {
+	if s.closed || s.opts.ReadOnly || s.bgErr != nil || s.shouldFlush() {
+		return false
+	}
+
+	reason, stop := s.stallCondition()
+	return reason == NoStall || (delayed && !stop)
+}
+
+// makeRoomForWrite is called with mu held before every write. It delays the
+// write once while background work is behind, waits while it is too far
+// behind, and switches to a new memtable once the current one is full. It
+// gives up with the error of ctx once ctx is done.
+func (s *SsStore) makeRoomForWrite(ctx context.Context) error {
+	delayed := false
+	for {
+		if s.closed {
+			return ErrClosed
+		}
+
+		if s.opts.ReadOnly {
+			return ErrReadOnly
+		}
+
+		if s.bgErr != nil {
+			return s.bgErr
+		}
+
+		reason, stop := s.stallCondition()
+		switch {
+		case reason != NoStall && stop:
+			log.Infof("Stopping writes, waiting on %s.", reason)
+			s.stats.Stall.Reason = reason
+			s.stats.Stall.Stops += 1
+			start := time.Now()
+			err := s.waitContext(ctx)
+			s.recordStall(reason, stop, time.Since(start))
+			if err != nil {
+				return err
+			}
+		case reason != NoStall && !delayed:
+			log.Infof("Slowing writes, waiting on %s.", reason)
+			s.stats.Stall.Reason = reason
+			s.stats.Stall.Slowdowns += 1
+			delay := time.Duration(s.opts.SlowdownDelayMicros) * time.Microsecond
+			start := time.Now()
+			err := s.sleepContext(ctx, delay)
+			s.recordStall(reason, stop, time.Since(start))
+			if err != nil {
+				return err
+			}
+
+			delayed = true
+		case s.shouldFlush():
+			s.switchMemTable()
+		default:
+			s.stats.Stall.Reason = NoStall
+			return nil
+		}
+	}
+}
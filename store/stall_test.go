@@ -0,0 +1,121 @@
+package store
+
+import (
+	"context"
+	"github.com/shimanekb/project2-B/index"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stallOptions slow writes at 2 pending flushes, 3 L0 tables and 1000
+// pending compaction bytes, and stop them at 3, 4 and 2000.
+func stallOptions() index.Options {
+	opts := crashOptions(index.NewMemFS())
+	opts.MaxPendingFlushes = 3
+	opts.PendingFlushesSlowdownTrigger = 2
+	opts.SoftPendingCompactionBytes = 1000
+	opts.HardPendingCompactionBytes = 2000
+	opts.SlowdownDelayMicros = 1000
+	return opts
+}
+
+// stalledStore is a store with no background work running, behind by
+// immutables full memtables, l0 tables and pending compaction bytes.
+func stalledStore(opts index.Options, immutables int, l0 int, pending int64, full bool) *SsStore {
+	s := &SsStore{opts: opts, cache: NewMemTableCache(), pendingCompactionBytes: pending}
+	s.cond = sync.NewCond(&s.mu)
+	s.stats.Stall.DurationByReason = make(map[StallReason]time.Duration)
+	for i := 0; i < immutables; i++ {
+		s.immutables = append(s.immutables, immutableMemTable{NewMemTableCache(), 0})
+	}
+
+	for i := 0; i < l0; i++ {
+		s.tables = append(s.tables, levelTable{number: i + 1})
+	}
+
+	if full {
+		value := strings.Repeat("v", int(opts.MemTableBytes))
+		s.cache.Add(crashKey(0), index.Command{Type: index.PUT_COMMAND, Item: index.NewKeyValueItem(crashKey(0), value)})
+	}
+
+	return s
+}
+
+func TestStallReasonsAndStats(t *testing.T) {
+	cases := []struct {
+		name       string
+		immutables int
+		l0         int
+		pending    int64
+		full       bool
+		reason     StallReason
+		stop       bool
+	}{
+		{name: "no stall", immutables: 1, l0: 2, pending: 999, reason: NoStall},
+		{name: "pending flushes slowdown", immutables: 2, reason: StallPendingFlushes},
+		{name: "pending flushes stop", immutables: 3, full: true, reason: StallPendingFlushes, stop: true},
+		{name: "L0 files slowdown", l0: 3, reason: StallL0Files},
+		{name: "L0 files stop", l0: 4, reason: StallL0Files, stop: true},
+		{name: "pending compaction bytes slowdown", pending: 1000, reason: StallPendingCompactionBytes},
+		{name: "pending compaction bytes stop", pending: 2000, reason: StallPendingCompactionBytes, stop: true},
+	}
+
+	for _, c := range cases {
+		s := stalledStore(stallOptions(), c.immutables, c.l0, c.pending, c.full)
+		ctx, cancel := context.WithTimeout(context.Background(), CONTEXT_TIMEOUT)
+		s.mu.Lock()
+		reason, stop := s.stallCondition()
+		err := s.makeRoomForWrite(ctx)
+		s.mu.Unlock()
+		cancel()
+
+		if reason != c.reason || stop != c.stop {
+			t.Fatalf("%s: stall condition is %s, stop %v, want %s, stop %v", c.name, reason, stop, c.reason, c.stop)
+		}
+
+		stall := s.Stats().Stall
+		switch {
+		case c.stop:
+			if err != context.DeadlineExceeded || stall.Reason != c.reason || stall.Stops != 1 || stall.Slowdowns != 0 {
+				t.Fatalf("%s: write returned %v with stall stats %+v", c.name, err, stall)
+			}
+
+			if stall.StopDuration < CONTEXT_TIMEOUT || stall.DurationByReason[c.reason] != stall.StopDuration {
+				t.Fatalf("%s: stopped for %v, by reason %v", c.name, stall.StopDuration, stall.DurationByReason)
+			}
+		case c.reason != NoStall:
+			if err != nil || stall.Reason != NoStall || stall.Slowdowns != 1 || stall.Stops != 0 {
+				t.Fatalf("%s: write returned %v with stall stats %+v", c.name, err, stall)
+			}
+
+			delay := time.Duration(s.opts.SlowdownDelayMicros) * time.Microsecond
+			if stall.SlowdownDuration < delay || stall.DurationByReason[c.reason] != stall.SlowdownDuration {
+				t.Fatalf("%s: slowed down for %v, by reason %v", c.name, stall.SlowdownDuration, stall.DurationByReason)
+			}
+		default:
+			if err != nil || stall.Slowdowns+stall.Stops != 0 || len(stall.DurationByReason) != 0 {
+				t.Fatalf("%s: write returned %v with stall stats %+v", c.name, err, stall)
+			}
+		}
+	}
+}
+
+func TestPendingFlushesSlowdownIsOptional(t *testing.T) {
+	opts := stallOptions()
+	opts.PendingFlushesSlowdownTrigger = 0
+	s := stalledStore(opts, 2, 0, 0, false)
+	if reason, stop := s.stallCondition(); reason != NoStall || stop {
+		t.Fatalf("disabled pending flushes slowdown stalls writes on %s, stop %v", reason, stop)
+	}
+
+	if index.DefaultOptions().PendingFlushesSlowdownTrigger != 0 {
+		t.Fatal("pending flushes slowdown is on by default")
+	}
+
+	opts.PendingFlushesSlowdownTrigger = opts.MaxPendingFlushes + 1
+	if err := opts.Validate(); err == nil {
+		t.Fatal("pending flushes slowdown trigger above max pending flushes was accepted")
+	}
+}
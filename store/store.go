@@ -1,32 +1,115 @@
 package store
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/shimanekb/project2-B/index"
 	log "github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"sync"
+	"time"
 )
 
 const (
-	DATA_FLUSH_THRESHOLD int    = 125000
-	GET_COMMAND          string = "get"
-	PUT_COMMAND          string = "put"
-	DEL_COMMAND          string = "del"
+	VALUE_LOG_GC_RATIO float64 = 0.5
+	GET_COMMAND        string  = "get"
+	PUT_COMMAND        string  = "put"
+	DEL_COMMAND        string  = "del"
 )
 
+// Store is a key value store. The Context variants give up once their
+// context is done, returning its error, while the others never give up.
 type Store interface {
 	Put(key string, value string) error
-	Get(key string) (value string, ok bool)
-	Del(key string)
-	Scan(keyone string, keytwo string) (values []string, ok bool)
-	Flush()
+	PutContext(ctx context.Context, key string, value string) error
+	PutWithTTL(key string, value string, ttl time.Duration) error
+	PutWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) error
+	Get(key string) (value string, found bool, err error)
+	GetContext(ctx context.Context, key string) (value string, found bool, err error)
+	Del(key string) error
+	DelContext(ctx context.Context, key string) error
+	Merge(key string, operand string) error
+	MergeContext(ctx context.Context, key string, operand string) error
+	CompareAndSwap(key string, expected string, value string) (swapped bool, err error)
+	CompareAndSwapContext(ctx context.Context, key string, expected string, value string) (swapped bool, err error)
+	PutIfAbsent(key string, value string) (put bool, err error)
+	PutIfAbsentContext(ctx context.Context, key string, value string) (put bool, err error)
+	DeleteIfEquals(key string, expected string) (deleted bool, err error)
+	DeleteIfEqualsContext(ctx context.Context, key string, expected string) (deleted bool, err error)
+	MultiGet(keys []string) ([]GetResult, error)
+	MultiGetContext(ctx context.Context, keys []string) ([]GetResult, error)
+	DeleteRange(start string, end string) error
+	DeleteRangeContext(ctx context.Context, start string, end string) error
+	Scan(keyone string, keytwo string, opts ScanOptions) (pairs []KeyValue, cursor string, err error)
+	ScanContext(ctx context.Context, keyone string, keytwo string, opts ScanOptions) (pairs []KeyValue, cursor string, err error)
+	ScanPrefix(prefix string, opts ScanOptions) (pairs []KeyValue, cursor string, err error)
+	ScanPrefixContext(ctx context.Context, prefix string, opts ScanOptions) (pairs []KeyValue, cursor string, err error)
+	Flush() error
+	FlushContext(ctx context.Context) error
+	NewIterator() (Iterator, error)
+	Stats() Stats
+	// Refresh picks up tables written since a read only store was opened.
+	// It does nothing on a store opened for writing.
+	Refresh() error
+	// Close flushes the store, stops its background work and releases its
+	// lock. Every later operation fails with ErrClosed.
+	Close() error
 }
 
+// SsStore keeps recent writes in a memtable that is flushed in the
+// background into L0 tables, which are in turn compacted into the base
+// sstable. Tables hold full keys in key order. The tables and value log live
+// in the store directory, and its manifest records which of them make up
+// the store.
 type SsStore struct {
+	// mu guards every field below and is held for reading for the whole of
+	// a lookup so tables are not swapped out from under it.
+	mu   sync.RWMutex
+	cond *sync.Cond
+
+	dir          string
+	manifest     *index.Manifest
 	blockStorage index.BlockStorage
-	cache        Cache
+	baseNumber   int
+	// tables are the L0 tables, newest first.
+	tables                 []levelTable
+	pendingCompactionBytes int64
+	// obsolete are files of older versions kept for read only stores and
+	// the open iterators.
+	obsolete  []string
+	iterators int
+	// lastSequence numbers the last write made to the store.
+	lastSequence uint64
+
+	cache MemTable
+	// immutables are full memtables waiting to be flushed, oldest first.
+	immutables []immutableMemTable
+	flushing   bool
+	compacting bool
+	bgErr      error
+	closed     bool
+
+	// lock is held on the LOCK file of dir while the store is open, or
+	// shared on its READ_LOCK file if read only, and background is done once
+	// the flush and compaction workers exit.
+	lock       io.Closer
+	background sync.WaitGroup
+
+	stats Stats
+	opts  index.Options
 }
 
-func convertToKeyValueItems(cache Cache) []index.Command {
+// convertToKeyValueItems lists the commands of cache to be written in order.
+// Range tombstones come first, since a range tombstone drops the keys it
+// covers from the memtable, so any key it covers there was written after it.
+func convertToKeyValueItems(cache MemTable) []index.Command {
 	items := make([]index.Command, 0, cache.Size())
+	for _, t := range cache.RangeTombstones() {
+		items = append(items, index.NewRangeDeleteCommand(t.Start, t.End))
+	}
+
 	for _, key := range cache.Keys() {
 		value, _ := cache.Get(key)
 		v := value.(index.Command)
@@ -36,93 +119,492 @@ func convertToKeyValueItems(cache Cache) []index.Command {
 	return items
 }
 
-func (s *SsStore) Scan(keyone string, keytwo string) (values []string, ok bool) {
-	ok = true
-	values, err := s.blockStorage.RangeSearch(keyone, keytwo)
-	if err != nil {
-		log.Error(err)
-		ok = false
+// Flush writes the memtable out and waits for background flushes and any
+// compaction they trigger to finish. It returns the error that stopped the
+// background work if any did.
+func (s *SsStore) Flush() error {
+	return s.FlushContext(context.Background())
+}
+
+// FlushContext is Flush that stops waiting once ctx is done. The memtable is
+// still flushed in the background.
+func (s *SsStore) FlushContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if s.opts.ReadOnly {
+		return ErrReadOnly
 	}
 
-	return values, ok
+	return s.flush(ctx)
 }
 
-func (s *SsStore) Flush() {
+// flush is called with mu held to write the memtable out and wait for the
+// background work it causes.
+func (s *SsStore) flush(ctx context.Context) error {
 	log.Infof("Writing %d items from memcache into new ss table.", s.cache.Size())
-	items := convertToKeyValueItems(s.cache)
-	str, err := s.blockStorage.WriteKvItems(items)
-	if err != nil {
-		log.Fatalf("Could not flush items into new ss table.", err)
+	if s.cache.Size() > 0 {
+		s.switchMemTable()
+	}
+
+	for !s.closed && s.bgErr == nil && (len(s.immutables) > 0 || s.flushing || s.compacting || s.needsCompaction()) {
+		if err := s.waitContext(ctx); err != nil {
+			log.Infof("Stopped waiting for flush. %v", err)
+			return err
+		}
+	}
+
+	if s.closed {
+		return ErrClosed
+	}
+
+	if s.bgErr != nil {
+		log.Errorf("Could not flush items into new ss table. %v", s.bgErr)
+		return s.bgErr
 	}
 
-	log.Info("Created new index store.")
-	s.blockStorage = str
-	s.cache = NewMemTableCache()
 	log.Info("Written items from memcache into new ss table.")
+	return nil
 }
 
-func (s *SsStore) Put(key string, value string) error {
-	log.Infof("Cache size is %d", s.cache.Size())
-	if s.cache.Size() >= DATA_FLUSH_THRESHOLD {
-		log.Info("Data threshold met, creating new index store.")
-		items := convertToKeyValueItems(s.cache)
-		str, err := s.blockStorage.WriteKvItems(items)
+// Close flushes the store and waits for its background workers to exit
+// before releasing the lock on its directory. A flush that fails still
+// closes the store, returning the error.
+func (s *SsStore) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
 
-		if err != nil {
-			return err
+	var err error
+	if !s.opts.ReadOnly {
+		err = s.flush(context.Background())
+	}
+
+	s.closed = true
+	if s.opts.WriteBufferManager != nil {
+		usage := s.cache.ApproximateMemoryUsage()
+		for _, imm := range s.immutables {
+			usage += imm.ApproximateMemoryUsage()
 		}
 
-		log.Info("Created new index store.")
-		s.blockStorage = str
-		s.cache = NewMemTableCache()
-		log.Infof("Created new cache, size is %d", s.cache.Size())
+		s.opts.WriteBufferManager.FreeMem(s, usage)
+		s.opts.WriteBufferManager.Unregister(s)
+	}
+
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	s.background.Wait()
+	if !s.opts.ReadOnly {
+		s.mu.Lock()
+		s.dropFiles()
+		s.mu.Unlock()
+	}
+
+	if lockErr := s.lock.Close(); err == nil {
+		err = lockErr
+	}
+
+	log.Infof("Closed store %s.", s.dir)
+	return err
+}
+
+// shouldFlush reports whether the memtable has used up its own byte budget,
+// or the write buffer shared with other stores is full and this store holds
+// the most of it.
+func (s *SsStore) shouldFlush() bool {
+	if s.cache.Size() == 0 {
+		return false
+	}
+
+	if s.cache.ApproximateMemoryUsage() >= s.opts.MemTableBytes {
+		return true
+	}
+
+	return s.opts.WriteBufferManager != nil && s.opts.WriteBufferManager.ShouldFlush(s)
+}
+
+// switchMemTable hands the memtable to the background flusher and starts a
+// new one.
+func (s *SsStore) switchMemTable() {
+	log.Info("Data threshold met, creating new index store.")
+	s.immutables = append(s.immutables, immutableMemTable{s.cache, s.lastSequence})
+	s.cache = NewMemTableCache()
+	log.Infof("Created new cache, size is %d", s.cache.Size())
+	s.cond.Broadcast()
+}
+
+// requestFlush is called by the write buffer manager to switch out the
+// memtable once the buffer shared with other stores is used up and this
+// store holds the most of it, however little it is writing.
+func (s *SsStore) requestFlush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.closed && s.bgErr == nil && s.cache.Size() > 0 && len(s.immutables) < s.opts.MaxPendingFlushes {
+		log.Infof("Write buffer is full, flushing memtable of %s.", s.dir)
+		s.switchMemTable()
+	}
+}
+
+func (s *SsStore) addToCache(key string, cmd index.Command) {
+	before := s.cache.ApproximateMemoryUsage()
+	s.cache.Add(key, cmd)
+	if s.opts.WriteBufferManager != nil {
+		s.opts.WriteBufferManager.ReserveMem(s, s.cache.ApproximateMemoryUsage()-before)
+	}
+}
+
+func (s *SsStore) Put(key string, value string) error {
+	return s.PutContext(context.Background(), key, value)
+}
+
+// PutContext is Put that gives up waiting for a stalled write once ctx is
+// done.
+func (s *SsStore) PutContext(ctx context.Context, key string, value string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log.Infof("Cache size is %d, using %d bytes", s.cache.Size(), s.cache.ApproximateMemoryUsage())
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		return err
 	}
 
 	log.Infof("Adding key %s to cache.", key)
 	kv := index.NewKeyValueItem(key, value)
-	cmd := index.Command{PUT_COMMAND, kv}
-	s.cache.Add(key, cmd)
+	cmd := index.Command{Type: PUT_COMMAND, Item: kv}
+	s.lastSequence += 1
+	s.addToCache(key, cmd)
 	return nil
 }
 
-func (s *SsStore) Get(key string) (value string, ok bool) {
-	v, ok := s.cache.Get(key)
+// PutWithTTL sets key to value until ttl has passed by the clock of the
+// store's options. The key then reads as deleted, and compaction drops it.
+// Merges into the key fold onto the value while it lasts, and the merged
+// value has no TTL.
+func (s *SsStore) PutWithTTL(key string, value string, ttl time.Duration) error {
+	return s.PutWithTTLContext(context.Background(), key, value, ttl)
+}
 
-	if ok {
-		log.Infof("Key %s found in cache.", key)
-		cmd, _ := v.(index.Command)
-		log.Infof("Current command for key %s, is %s", cmd.Item.Key(), cmd.Type)
-		if cmd.Type == DEL_COMMAND {
-			log.Infof("Key %s is a delete entry in cache.", key)
-			return "", false
+// PutWithTTLContext is PutWithTTL that gives up waiting for a stalled write
+// once ctx is done.
+func (s *SsStore) PutWithTTLContext(ctx context.Context, key string, value string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if ttl <= 0 {
+		return errors.New(fmt.Sprintf("TTL of key %s must be positive, got %s", key, ttl))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		return err
+	}
+
+	log.Infof("Adding key %s to cache, expiring in %s.", key, ttl)
+	kv := index.NewExpiringKeyValueItem(key, value, s.opts.Now().Add(ttl))
+	cmd := index.Command{Type: PUT_COMMAND, Item: kv}
+	s.lastSequence += 1
+	s.addToCache(key, cmd)
+	return nil
+}
+
+// Merge records operand for key, to be folded onto its value by the merge
+// operator of the store's options when the key is read or compacted. It
+// fails with ErrNoMergeOperator if the options have none.
+func (s *SsStore) Merge(key string, operand string) error {
+	return s.MergeContext(context.Background(), key, operand)
+}
+
+// MergeContext is Merge that gives up waiting for a stalled write once ctx
+// is done. An operand over a value or delete held by the memtable is folded
+// into it at once, returning the error of the merge operator if it fails.
+func (s *SsStore) MergeContext(ctx context.Context, key string, operand string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		log.Errorf("Could not make room to merge into key %s. %v", key, err)
+		return err
+	}
+
+	cmd, err := index.NewMergeCommand(s.opts, key, operand, cacheGet(s.cache, key))
+	if err != nil {
+		log.Errorf("Could not merge into key %s. %v", key, err)
+		return err
+	}
+
+	s.lastSequence += 1
+	s.addToCache(key, cmd)
+	return nil
+}
+
+// cacheGet looks key up in a memtable, where a range tombstone covering
+// it counts as a delete.
+func cacheGet(cache MemTable, key string) index.Entry {
+	v, ok := cache.Get(key)
+	if !ok {
+		covered := cache.RangeTombstones().Covers(key)
+		return index.Entry{Deleted: covered, Found: covered}
+	}
+
+	log.Infof("Key %s found in cache.", key)
+	cmd, _ := v.(index.Command)
+	log.Infof("Current command for key %s, is %s", cmd.Item.Key(), cmd.Type)
+	return commandEntry(cmd)
+}
+
+// commandEntry returns the entry a memtable command leaves for its key.
+func commandEntry(cmd index.Command) index.Entry {
+	if cmd.Type == DEL_COMMAND {
+		log.Infof("Key %s is a delete entry in cache.", cmd.Item.Key())
+		return index.Entry{Deleted: true, Found: true}
+	}
+
+	return index.Entry{Value: cmd.Item.Value(), Operand: cmd.Type == index.MERGE_COMMAND,
+		ExpiresAt: cmd.Item.ExpiresAt(), Found: true}
+}
+
+// memTableGet gives m the entries of key in the memtable and then the
+// immutable memtables, newest first, reporting whether they settle its
+// value.
+func (s *SsStore) memTableGet(m *index.Merger, key string) bool {
+	if m.Add(cacheGet(s.cache, key)) {
+		return true
+	}
+
+	for i := len(s.immutables) - 1; i >= 0; i-- {
+		if m.Add(cacheGet(s.immutables[i], key)) {
+			return true
 		}
+	}
+
+	return false
+}
 
-		return cmd.Item.Value(), ok
+// Get returns the value of key. A missing or deleted key is not found and
+// not an error.
+func (s *SsStore) Get(key string) (value string, found bool, err error) {
+	return s.GetContext(context.Background(), key)
+}
+
+// GetContext is Get that stops reading tables once ctx is done.
+func (s *SsStore) GetContext(ctx context.Context, key string) (value string, found bool, err error) {
+	if err = ctx.Err(); err != nil {
+		return "", false, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return "", false, ErrClosed
+	}
+
+	return s.get(ctx, key)
+}
+
+// get is called with mu held to look key up in the memtables and then the
+// tables, newest first.
+func (s *SsStore) get(ctx context.Context, key string) (value string, found bool, err error) {
+	m := index.NewMerger(s.opts, key)
+	if s.memTableGet(m, key) {
+		return m.Result()
 	}
 
 	log.Infof("Key %s not found in cache, reading block.", key)
-	block, err := s.blockStorage.ReadBlock(key)
-	if err != nil {
-		log.Fatal("Could not load block", err)
+	for _, table := range append(storages(s.tables), s.blockStorage) {
+		if err = ctx.Err(); err != nil {
+			return "", false, err
+		}
+
+		block, err := table.ReadBlock(key)
+		if err != nil {
+			log.Errorf("Could not load block for key %s. %v", key, err)
+			return "", false, err
+		}
+
+		e, err := block.GetEntry(key)
+		if err != nil {
+			return "", false, err
+		}
+
+		if m.Add(e) {
+			break
+		}
+
+		if table.RangeTombstones().Covers(key) {
+			m.Add(index.Entry{Deleted: true, Found: true})
+			break
+		}
 	}
-	log.Info("Block loaded.")
 
-	value, ok = block.Get(key)
-	return value, ok
+	return m.Result()
 }
 
-func (s *SsStore) Del(key string) {
+func (s *SsStore) Del(key string) error {
+	return s.DelContext(context.Background(), key)
+}
+
+// DelContext is Del that gives up waiting for a stalled write once ctx is
+// done.
+func (s *SsStore) DelContext(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	kv := index.NewKeyValueItem(key, "")
-	cmd := index.Command{DEL_COMMAND, kv}
+	cmd := index.Command{Type: DEL_COMMAND, Item: kv}
 
-	s.cache.Add(key, cmd)
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		log.Errorf("Could not make room to delete key %s. %v", key, err)
+		return err
+	}
+
+	s.lastSequence += 1
+	s.addToCache(key, cmd)
+	return nil
+}
+
+// DeleteRange deletes the keys from start up to but not including end. It
+// is kept as a single range tombstone however many keys it covers, until
+// compaction removes them. A range whose end is not after its start is
+// refused with ErrInvalidArgument.
+func (s *SsStore) DeleteRange(start string, end string) error {
+	return s.DeleteRangeContext(context.Background(), start, end)
+}
+
+// DeleteRangeContext is DeleteRange that gives up waiting for a stalled
+// write once ctx is done.
+func (s *SsStore) DeleteRangeContext(ctx context.Context, start string, end string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if start >= end {
+		log.Errorf("Range to delete from %s to %s is empty.", start, end)
+		return ErrInvalidArgument
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.makeRoomForWrite(ctx); err != nil {
+		log.Errorf("Could not make room to delete range %s to %s. %v", start, end, err)
+		return err
+	}
+
+	s.lastSequence += 1
+	s.addRangeTombstone(start, end)
+	return nil
+}
+
+func (s *SsStore) addRangeTombstone(start string, end string) {
+	before := s.cache.ApproximateMemoryUsage()
+	s.cache.AddRangeTombstone(index.RangeTombstone{Start: start, End: end})
+	if s.opts.WriteBufferManager != nil {
+		s.opts.WriteBufferManager.ReserveMem(s, s.cache.ApproximateMemoryUsage()-before)
+	}
 }
 
-func NewSsStore(dataPath string) (Store, error) {
-	cache := NewMemTableCache()
-	storage := index.NewSsBlockStorage(dataPath)
+// NewSsStore opens the store at dataPath. It is Open under its older name.
+func NewSsStore(dataPath string, opts index.Options) (Store, error) {
+	return Open(dataPath, opts)
+}
+
+// Open opens the store kept in the directory at dataPath, tuned by opts,
+// and starts its background flush and compaction workers. The directory is
+// locked until the store is closed, so opening it again before then fails
+// with ErrLocked. With opts.ReadOnly an existing store is opened for
+// reading instead, which any number of processes can do alongside the one
+// writing it. A store whose column families have writes left in their
+// write ahead log has to be opened with OpenDB.
+func Open(dataPath string, opts index.Options) (Store, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	if opts.ReadOnly {
+		return openReadOnly(dataPath, opts)
+	}
+
+	if fileSize(opts.FileSystem(), index.WalPath(dataPath)) > 0 {
+		return nil, errors.New(fmt.Sprintf("Store in %s has column family writes in its write ahead log, open it with OpenDB", dataPath))
+	}
+
+	st, err := open(dataPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// open opens the store at dataPath for writing once opts are validated.
+func open(dataPath string, opts index.Options) (*SsStore, error) {
+	if opts.WriteBufferManager == nil && opts.WriteBufferSize > 0 {
+		opts.WriteBufferManager = index.NewWriteBufferManager(opts.WriteBufferSize)
+	}
+
+	if err := checkStoreFile(dataPath, opts); err != nil {
+		log.Errorf("Could not open store at %s. %v", dataPath, err)
+		return nil, err
+	}
+
+	if err := opts.FileSystem().MkdirAll(dataPath, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	if err := syncParentDir(dataPath, opts); err != nil {
+		return nil, err
+	}
+
+	lock, err := opts.FileSystem().Lock(index.LockFileName(dataPath))
+	if err != nil {
+		log.Errorf("Could not lock store at %s. %v", dataPath, err)
+		return nil, err
+	}
+
+	store := SsStore{dir: dataPath, cache: NewMemTableCache(), opts: opts, lock: lock}
+	store.cond = sync.NewCond(&store.mu)
+	store.stats.Stall.DurationByReason = make(map[StallReason]time.Duration)
+	if err := store.recover(); err != nil {
+		log.Errorf("Could not recover store at %s. %v", dataPath, err)
+		lock.Close()
+		return nil, err
+	}
+
+	if opts.WriteBufferManager != nil {
+		opts.WriteBufferManager.Register(&store, store.requestFlush)
+	}
 
-	store := SsStore{storage, cache}
+	store.background.Add(2)
+	go store.flushLoop()
+	go store.compactLoop()
 
 	log.Info("Created new SsStore")
 	return &store, nil
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	"testing"
+	"time"
+)
+
+const TTL_KEYS int = 40
+
+// checkExpiry fails unless the keys below live are found holding value by
+// Get, MultiGet and Scan, and the other keys of TTL_KEYS are missing.
+func checkExpiry(t *testing.T, st Store, live int, value string) {
+	keys := make([]string, 0, TTL_KEYS)
+	for i := 0; i < TTL_KEYS; i++ {
+		keys = append(keys, crashKey(i))
+	}
+
+	results, err := st.MultiGet(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range keys {
+		got, found, err := st.Get(key)
+		if err != nil || found != (i < live) || (found && got != value) {
+			t.Fatalf("Get(%s) = %q, %v, %v with %d live keys holding %q", key, got, found, err, live, value)
+		}
+
+		if results[i] != (GetResult{got, found}) {
+			t.Fatalf("MultiGet read %s as %+v, want %q, %v", key, results[i], got, found)
+		}
+	}
+
+	pairs, _, err := st.Scan(keys[0], keys[len(keys)-1], ScanOptions{})
+	if err != nil || len(pairs) != live {
+		t.Fatalf("Scan returned %d pairs, %v, want %d", len(pairs), err, live)
+	}
+}
+
+func TestPutWithTTLExpires(t *testing.T) {
+	clock := index.NewManualClock(time.Unix(1700000000, 0))
+	opts := crashOptions(index.NewMemFS())
+	opts.Clock = clock
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putRange(t, st, 0, TTL_KEYS, "old")
+	for i := 0; i < TTL_KEYS; i++ {
+		ttl := time.Minute
+		if i < TTL_KEYS/2 {
+			ttl = time.Hour
+		}
+
+		// values past the threshold go to the value log with their expiry
+		if err = st.PutWithTTL(crashKey(i), "session-value-kept-in-the-value-log", ttl); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkExpiry(t, st, TTL_KEYS, "session-value-kept-in-the-value-log")
+	clock.Advance(time.Minute)
+	checkExpiry(t, st, TTL_KEYS/2, "session-value-kept-in-the-value-log")
+	if err = st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkExpiry(t, st, TTL_KEYS/2, "session-value-kept-in-the-value-log")
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	checkExpiry(t, st, TTL_KEYS/2, "session-value-kept-in-the-value-log")
+	clock.Advance(time.Hour)
+	checkExpiry(t, st, 0, "")
+	for round := 0; round < 4 && st.Stats().Compactions == 0; round++ {
+		putRange(t, st, TTL_KEYS, TTL_KEYS+20, "filler")
+	}
+
+	if st.Stats().Compactions == 0 {
+		t.Fatal("store never compacted")
+	}
+
+	checkExpiry(t, st, 0, "")
+	base := st.(*SsStore).blockStorage
+	for i := 0; i < TTL_KEYS; i++ {
+		block, err := base.ReadBlock(crashKey(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if e, _ := block.GetEntry(crashKey(i)); e.Found {
+			t.Fatalf("compaction kept the expired entry of %s", crashKey(i))
+		}
+	}
+
+	if err = st.PutWithTTL(crashKey(0), "v", 0); err == nil {
+		t.Fatal("PutWithTTL took a TTL of zero")
+	}
+}
@@ -0,0 +1,241 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// levelTable is a live sstable along with the file number the manifest
+// knows it by.
+type levelTable struct {
+	number int
+	index.BlockStorage
+}
+
+// immutableMemTable is a full memtable waiting to be flushed along with the
+// sequence number of the last write it holds.
+type immutableMemTable struct {
+	MemTable
+	lastSequence uint64
+}
+
+func storages(tables []levelTable) []index.BlockStorage {
+	s := make([]index.BlockStorage, 0, len(tables))
+	for _, t := range tables {
+		s = append(s, t.BlockStorage)
+	}
+
+	return s
+}
+
+func fileExists(fs index.FS, path string) bool {
+	_, err := fs.Stat(path)
+	return err == nil
+}
+
+func fileSize(fs index.FS, path string) int64 {
+	stat, err := fs.Stat(path)
+	if err != nil {
+		return 0
+	}
+
+	return stat.Size()
+}
+
+// syncParentDir makes the creation or renaming of path durable.
+func syncParentDir(path string, opts index.Options) error {
+	if opts.SyncPolicy < index.SyncFlush {
+		return nil
+	}
+
+	return opts.FileSystem().SyncDir(filepath.Dir(path))
+}
+
+// checkStoreFile rejects a store file from before the manifest at dataPath,
+// whose tables are in format 1. It only looks at dataPath, so nothing is
+// written to a store that cannot be opened.
+func checkStoreFile(dataPath string, opts index.Options) error {
+	stat, err := opts.FileSystem().Stat(dataPath)
+	if err == nil && !stat.IsDir() {
+		return &FormatError{Path: dataPath, Format: 1}
+	}
+
+	return nil
+}
+
+// removeObsoleteFiles deletes tables and value logs in dir that the
+// manifest does not refer to, along with leftover temp files. They are what
+// a crash between writing a file and recording it, or between recording a
+// compaction and deleting its inputs, leaves behind.
+func removeObsoleteFiles(fs index.FS, dir string, manifest *index.Manifest) error {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	live := manifest.LiveFiles()
+	for _, entry := range entries {
+		name := entry.Name()
+		_, _, ok := index.ParseFileName(name)
+		if live[name] || (!ok && !strings.HasSuffix(name, index.TEMP_FILE_SUFFIX)) {
+			continue
+		}
+
+		log.Infof("Removing obsolete file %s.", name)
+		if err = fs.Remove(filepath.Join(dir, name)); err != nil {
+			log.Errorf("Could not remove obsolete file %s. %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// checkFormat rejects a store whose tables are not in the current format.
+// Stores from before formats were recorded have format 1 tables.
+func checkFormat(dir string, manifest *index.Manifest) error {
+	if manifest.Format() != index.TABLE_FORMAT {
+		return &FormatError{Path: dir, Format: manifest.Format()}
+	}
+
+	return nil
+}
+
+// readersOpen reports whether read only stores may be reading files of dir,
+// which is taken to be so if it cannot be told.
+func readersOpen(fs index.FS, dir string) bool {
+	lock, err := fs.Lock(index.ReadLockFileName(dir))
+	if err != nil {
+		return true
+	}
+
+	lock.Close()
+	return false
+}
+
+// dropFiles is called with mu held to delete files no longer in the current
+// version. While iterators or read only stores are open they may still be
+// reading older versions, so the files are kept until a later call finds
+// none open.
+func (s *SsStore) dropFiles(paths ...string) {
+	s.obsolete = append(s.obsolete, paths...)
+	if len(s.obsolete) == 0 {
+		return
+	}
+
+	if s.iterators > 0 || readersOpen(s.opts.FileSystem(), s.dir) {
+		log.Infof("Iterators or read only stores are open on %s, keeping %d obsolete files.", s.dir, len(s.obsolete))
+		return
+	}
+
+	removeFiles(s.opts.FileSystem(), s.obsolete...)
+	s.obsolete = nil
+}
+
+// removeFiles deletes files no longer in the current version. Failures only
+// leave files for the next open to clean up.
+func removeFiles(fs index.FS, paths ...string) {
+	for _, path := range paths {
+		if err := fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Errorf("Could not remove obsolete file %s. %v", path, err)
+		}
+	}
+}
+
+// recover opens the manifest of the store in s.dir and loads the version it
+// describes.
+func (s *SsStore) recover() error {
+	// a store in another format is refused before its manifest is rewritten
+	if fileExists(s.opts.FileSystem(), index.ManifestPath(s.dir)) {
+		manifest, err := index.ReadManifest(s.dir, s.opts)
+		if err == nil {
+			err = checkFormat(s.dir, manifest)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	manifest, err := index.OpenManifest(s.dir, s.opts)
+	if err != nil {
+		return err
+	}
+
+	if manifest.ValueLogNumber() == 0 {
+		edit := index.VersionEdit{ValueLogNumber: manifest.NewFileNumber()}
+		if err = manifest.LogAndApply(edit); err != nil {
+			return err
+		}
+	}
+
+	if readersOpen(s.opts.FileSystem(), s.dir) {
+		log.Infof("Read only stores are open on %s, keeping obsolete files.", s.dir)
+	} else if err = removeObsoleteFiles(s.opts.FileSystem(), s.dir, manifest); err != nil {
+		return err
+	}
+
+	if err = s.loadVersion(manifest); err != nil {
+		return err
+	}
+
+	log.Infof("Recovered store %s at sequence %d with %d L0 tables.", s.dir, s.lastSequence, len(s.tables))
+	if len(s.tables) == 0 {
+		// garbage left by the last compaction before the store closed
+		return s.collectValueLog()
+	}
+
+	return nil
+}
+
+// loadVersion opens the tables manifest lists and makes them the tables of
+// the store. The store is left as it was if any cannot be opened.
+func (s *SsStore) loadVersion(manifest *index.Manifest) error {
+	if err := checkFormat(s.dir, manifest); err != nil {
+		return err
+	}
+
+	bases := manifest.Tables(1)
+	if len(bases) > 1 {
+		return &index.CorruptionError{Path: index.ManifestPath(s.dir),
+			Err: errors.New(fmt.Sprintf("manifest lists %d base tables", len(bases)))}
+	}
+
+	baseNumber := 0
+	basePath := ""
+	if len(bases) == 1 {
+		baseNumber = bases[0].Number
+		basePath = index.TableFileName(s.dir, baseNumber)
+	}
+
+	vlogPath := index.ValueLogFileName(s.dir, manifest.ValueLogNumber())
+	base, err := index.NewSsTable(basePath, vlogPath, s.opts)
+	if err != nil {
+		return err
+	}
+
+	var tables []levelTable
+	var pendingCompactionBytes int64
+	for _, meta := range manifest.Tables(0) {
+		log.Infof("Opening L0 table %d.", meta.Number)
+		table, err := base.OpenTable(index.TableFileName(s.dir, meta.Number))
+		if err != nil {
+			return err
+		}
+
+		tables = append([]levelTable{{meta.Number, table}}, tables...)
+		pendingCompactionBytes += table.FileSize()
+	}
+
+	s.manifest = manifest
+	s.blockStorage = base
+	s.baseNumber = baseNumber
+	s.tables = tables
+	s.pendingCompactionBytes = pendingCompactionBytes
+	s.lastSequence = manifest.LastSequence()
+	return nil
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeFile creates name on fs holding data.
+func writeFile(t *testing.T, fs index.FS, name string, data string) {
+	f, err := fs.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer f.Close()
+	if _, err = f.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenRemovesObsoleteFiles(t *testing.T) {
+	fs := index.NewMemFS()
+	opts := crashOptions(fs)
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLargeValues(t, st, 1)
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// files a crash mid-compaction leaves behind that the manifest never
+	// recorded
+	obsolete := []string{index.TableFileName(CRASH_STORE_DIR, 900), index.ValueLogFileName(CRASH_STORE_DIR, 901)}
+	kept := filepath.Join(CRASH_STORE_DIR, "notes.txt")
+	for _, name := range append(obsolete, kept) {
+		writeFile(t, fs, name, "left over")
+	}
+
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	for _, name := range obsolete {
+		if fileExists(fs, name) {
+			t.Fatalf("obsolete file %s survived opening the store", name)
+		}
+	}
+
+	if !fileExists(fs, kept) {
+		t.Fatalf("opening the store removed %s, which is not a store file", kept)
+	}
+
+	live := st.(*SsStore).manifest.LiveFiles()
+	infos, err := fs.ReadDir(CRASH_STORE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+		_, _, ok := index.ParseFileName(info.Name())
+		if ok && !live[info.Name()] {
+			t.Fatalf("store holds %s, which the manifest does not list", info.Name())
+		}
+	}
+
+	checkLargeValues(t, st, 1)
+}
+
+func TestOpenRemovesLeftoverTempFiles(t *testing.T) {
+	fs := index.NewMemFS()
+	opts := crashOptions(fs)
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLargeValues(t, st, 1)
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// temp files of the tables, value log and manifest a crash stopped
+	// before they were renamed into place
+	var temps []string
+	for name := range st.(*SsStore).manifest.LiveFiles() {
+		temps = append(temps, index.TempFilePath(filepath.Join(CRASH_STORE_DIR, name)))
+	}
+
+	for _, name := range temps {
+		writeFile(t, fs, name, "partly written")
+	}
+
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	for _, name := range temps {
+		if fileExists(fs, name) {
+			t.Fatalf("temp file %s survived opening the store", name)
+		}
+	}
+
+	checkLargeValues(t, st, 1)
+}
@@ -0,0 +1,114 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"github.com/shimanekb/project2-B/index"
+	"strings"
+	"testing"
+)
+
+// valueLogBytes is the size of the value logs in the store directory.
+func valueLogBytes(t *testing.T, fs index.FS) (size int64) {
+	infos, err := fs.ReadDir(CRASH_STORE_DIR)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, info := range infos {
+		if strings.HasSuffix(info.Name(), index.VALUE_LOG_SUFFIX) {
+			size += info.Size()
+		}
+	}
+
+	return size
+}
+
+func putLargeValues(t *testing.T, st Store, round int) {
+	for i := 0; i < CRASH_KEYS; i++ {
+		value := fmt.Sprintf("%d-%s", round, strings.Repeat("v", 100))
+		if err := st.Put(crashKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkLargeValues(t *testing.T, st Store, round int) {
+	for i := 0; i < CRASH_KEYS; i++ {
+		value, found, err := st.Get(crashKey(i))
+		if want := fmt.Sprintf("%d-%s", round, strings.Repeat("v", 100)); err != nil || !found || value != want {
+			t.Fatalf("Get(%s) = %.20q, %v, %v, want %.20q", crashKey(i), value, found, err, want)
+		}
+	}
+}
+
+func TestValueLogCollectedOnceOverwritten(t *testing.T) {
+	fs := index.NewFaultFS()
+	opts := crashOptions(fs)
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	putLargeValues(t, st, 1)
+	written := valueLogBytes(t, fs)
+	if written < int64(CRASH_KEYS*100) {
+		t.Fatalf("value log holds %d bytes, values were not separated", written)
+	}
+
+	putLargeValues(t, st, 2)
+	if st.Stats().Compactions == 0 {
+		t.Fatal("store never compacted")
+	}
+
+	if size := valueLogBytes(t, fs); size > written*3/2 {
+		t.Fatalf("value log grew to %d bytes from %d, garbage was not collected", size, written)
+	}
+
+	checkLargeValues(t, st, 2)
+
+	// a failed collection stops the store, and the garbage it leaves is
+	// collected when the store is next opened
+	fs.Inject(index.Fault{Op: index.FaultCreate, Name: index.VALUE_LOG_SUFFIX + index.TEMP_FILE_SUFFIX, Sticky: true})
+	for i := 0; i < CRASH_KEYS; i++ {
+		if err = st.Put(crashKey(i), fmt.Sprintf("%d-%s", 3, strings.Repeat("v", 100))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var bgErr *BackgroundError
+	if err = st.Flush(); !errors.As(err, &bgErr) || !errors.Is(err, index.ErrInjected) {
+		t.Fatalf("Flush() = %v after value log collection failed, want the background error", err)
+	}
+
+	if err = st.Put(crashKey(0), "v"); !errors.As(err, &bgErr) {
+		t.Fatalf("Put() = %v after value log collection failed, want the background error", err)
+	}
+
+	st.Close()
+
+	garbage := valueLogBytes(t, fs)
+	if garbage < written*3/2 {
+		t.Fatalf("value log holds %d bytes, collection did not fail", garbage)
+	}
+
+	if _, err = Open(CRASH_STORE_DIR, opts); !errors.Is(err, index.ErrInjected) {
+		t.Fatalf("Open() = %v while value log collection fails", err)
+	}
+
+	fs.ClearFaults()
+	if st, err = Open(CRASH_STORE_DIR, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	if size := valueLogBytes(t, fs); size > written*3/2 {
+		t.Fatalf("value log holds %d bytes after reopening, garbage was not collected", size)
+	}
+
+	checkLargeValues(t, st, 3)
+}
@@ -0,0 +1,134 @@
+package store
+
+import (
+	"github.com/shimanekb/project2-B/index"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entryBytes is the memory a put of key and value takes in a memtable.
+func entryBytes(key string, value string) int64 {
+	return int64(len(key)+len(value)) + MEMTABLE_ENTRY_OVERHEAD
+}
+
+func TestMemTableSwitchesAtMemTableBytes(t *testing.T) {
+	opts := crashOptions(index.NewMemFS())
+	opts.MemTableBytes = 1000
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer st.Close()
+	size := entryBytes(crashKey(0), "v")
+	full := int(opts.MemTableBytes/size) + 1
+	for i := 0; i < full; i++ {
+		if err = st.Put(crashKey(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stats := st.Stats()
+	if stats.MemTableBytes != int64(full)*size || stats.Flushes+int64(stats.ImmutableMemTables) != 0 {
+		t.Fatalf("memtable of %d puts holds %d bytes after %d flushes, want %d bytes and none",
+			full, stats.MemTableBytes, stats.Flushes, int64(full)*size)
+	}
+
+	if err = st.Put(crashKey(full), "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if stats = st.Stats(); stats.MemTableBytes != size {
+		t.Fatalf("memtable holds %d bytes once over %d, want it switched", stats.MemTableBytes, opts.MemTableBytes)
+	}
+}
+
+func TestWriteBufferFreedAfterFlush(t *testing.T) {
+	manager := index.NewWriteBufferManager(1 << 20)
+	opts := crashOptions(index.NewMemFS())
+	opts.WriteBufferManager = manager
+	st, err := Open(CRASH_STORE_DIR, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = st.Put(crashKey(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if usage := manager.MemoryUsage(); usage != 10*entryBytes(crashKey(0), "v") {
+		t.Fatalf("write buffer holds %d bytes for 10 puts", usage)
+	}
+
+	if err = st.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage := manager.MemoryUsage(); usage != 0 {
+		t.Fatalf("write buffer holds %d bytes after flush", usage)
+	}
+
+	if err = st.Put(crashKey(0), "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = st.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if usage := manager.MemoryUsage(); usage != 0 {
+		t.Fatalf("write buffer holds %d bytes after close", usage)
+	}
+}
+
+func TestWriteBufferFlushesStoreHoldingMost(t *testing.T) {
+	fs := index.NewMemFS()
+	manager := index.NewWriteBufferManager(20000)
+	opts := crashOptions(fs)
+	opts.MemTableBytes = 1 << 20
+	opts.WriteBufferManager = manager
+	idle, err := Open("/db/idle", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer idle.Close()
+	busy, err := Open("/db/busy", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer busy.Close()
+	value := strings.Repeat("v", 100)
+	for i := 0; manager.MemoryUsage() < 19000; i++ {
+		if err = idle.Put(crashKey(i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		if err = busy.Put(crashKey(i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for idle.Stats().Flushes == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("idle store holding most of the write buffer never flushed")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if flushes := busy.Stats().Flushes; flushes != 0 {
+		t.Fatalf("store holding little of the write buffer flushed %d times", flushes)
+	}
+
+	if usage := manager.OwnerMemoryUsage(busy); usage != 50*entryBytes(crashKey(0), "v") {
+		t.Fatalf("write buffer holds %d bytes of the busy store", usage)
+	}
+}